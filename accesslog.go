@@ -0,0 +1,420 @@
+package go_virtual_host
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+//访问日志的格式,其他值作为text/template模板,字段为AccessLogEntry
+const (
+	AccessLogJSON = "json"
+	AccessLogCommon = "common"
+	AccessLogCombined = "combined"
+)
+
+//访问日志中的一行
+//http和crack模式下每个连接一行,记录第一个请求和对应响应的状态码
+//keepalive模式下每个请求一行,tls模式下每个连接一行
+type AccessLogEntry struct {
+	Time time.Time `json:"time"`
+	Listener string `json:"listener"`
+	Proxy string `json:"proxy"`
+	ConnID uint64 `json:"conn_id"`
+	Client string `json:"client"`
+	Backend string `json:"backend,omitempty"`
+	Host string `json:"host,omitempty"`
+
+	//http请求
+	Method string `json:"method,omitempty"`
+	URI string `json:"uri,omitempty"`
+	Version string `json:"version,omitempty"`
+	//0表示没有得到响应
+	Status int `json:"status,omitempty"`
+	Referer string `json:"referer,omitempty"`
+	UserAgent string `json:"user_agent,omitempty"`
+	//crack模式下升级成功之后的协议
+	Upgrade string `json:"upgrade,omitempty"`
+
+	//tls的ClientHello
+	SNI string `json:"sni,omitempty"`
+	ALPN []string `json:"alpn,omitempty"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+
+	//客户端到后端和后端到客户端的字节数
+	BytesIn int64 `json:"bytes_in"`
+	BytesOut int64 `json:"bytes_out"`
+
+	Duration Duration `json:"duration"`
+	Err string `json:"error,omitempty"`
+}
+
+//请求行,不是http请求时为"-"
+func (e *AccessLogEntry) RequestLine() string{
+	if e.Method == ""{
+		return "-"
+	}
+	return e.Method + " " + e.URI + " " + e.Version
+}
+
+//使用request填充http相关的字段
+func (e *AccessLogEntry) setRequest(request *Request){
+	if request == nil{
+		return
+	}
+
+	e.Host = request.Header("Host")
+	e.Method, e.URI, e.Version = request.Method, request.URI, request.Version
+	e.Referer = request.Header("Referer")
+	e.UserAgent = request.Header("User-Agent")
+}
+
+func (e *AccessLogEntry) setClientHello(hello *ClientHello){
+	if hello == nil{
+		return
+	}
+
+	e.Host, e.SNI = hello.ServerName, hello.ServerName
+	e.ALPN = hello.ALPN
+	e.Fingerprint = hello.Fingerprint()
+}
+
+type accessLogFormatter func(b *bytes.Buffer, e *AccessLogEntry) error
+
+//把日志写入io.Writer,多个代理可以共用一个AccessLog
+//没有设置输出时不记录
+type AccessLog struct {
+	mu sync.Mutex
+	w io.Writer
+	format accessLogFormatter
+	buf bytes.Buffer
+}
+
+func NewAccessLog(w io.Writer, format string) (*AccessLog, error){
+	l := &AccessLog{}
+	if err := l.SetOutput(w, format); err != nil{
+		return nil, err
+	}
+	return l, nil
+}
+
+//替换输出和格式,w为nil时停止记录,原来的输出由调用者关闭
+func (l *AccessLog) SetOutput(w io.Writer, format string) error{
+	formatter, err := newAccessLogFormatter(format)
+	if err != nil{
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w, l.format = w, formatter
+	return nil
+}
+
+//代理使用l记录访问日志
+func WithAccessLog(l *AccessLog) Option{
+	return func(p *Proxy) {
+		p.accessLog = l
+	}
+}
+
+func (l *AccessLog) enabled() bool{
+	if l == nil{
+		return false
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w != nil
+}
+
+//格式化并写入一行日志,写入失败时丢弃
+func (l *AccessLog) Log(e *AccessLogEntry){
+	if l == nil{
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.w == nil{
+		return
+	}
+
+	l.buf.Reset()
+	if err := l.format(&l.buf, e); err != nil{
+		fmt.Printf("[access-log]: format entry of conn %d error: %v\n", e.ConnID, err)
+		return
+	}
+
+	if b := l.buf.Bytes(); len(b) == 0 || b[len(b) - 1] != '\n'{
+		l.buf.WriteByte('\n')
+	}
+	_, _ = l.w.Write(l.buf.Bytes())
+}
+
+func newAccessLogFormatter(format string) (accessLogFormatter, error){
+	switch format {
+	case "", AccessLogJSON:
+		return formatJSON, nil
+	case AccessLogCommon:
+		return formatCommon, nil
+	case AccessLogCombined:
+		return formatCombined, nil
+	}
+
+	tmpl, err := template.New("access_log").Parse(format)
+	if err != nil{
+		return nil, fmt.Errorf("invalid access log template: %v", err)
+	}
+
+	return func(b *bytes.Buffer, e *AccessLogEntry) error {
+		return tmpl.Execute(b, e)
+	}, nil
+}
+
+func formatJSON(b *bytes.Buffer, e *AccessLogEntry) error{
+	return json.NewEncoder(b).Encode(e)
+}
+
+//Common Log Format: client - - [time] "request line" status bytes
+func formatCommon(b *bytes.Buffer, e *AccessLogEntry) error{
+	client := e.Client
+	if host, _, err := net.SplitHostPort(client); err == nil{
+		client = host
+	}
+
+	status := "-"
+	if e.Status > 0{
+		status = strconv.Itoa(e.Status)
+	}
+
+	size := "-"
+	if e.BytesOut > 0{
+		size = strconv.FormatInt(e.BytesOut, 10)
+	}
+
+	_, err := fmt.Fprintf(b, "%s - - [%s] %s %s %s", client, e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		clfQuote(e.RequestLine()), status, size)
+	return err
+}
+
+//Combined Log Format: 在Common Log Format之后加上Referer和User-Agent
+func formatCombined(b *bytes.Buffer, e *AccessLogEntry) error{
+	if err := formatCommon(b, e); err != nil{
+		return err
+	}
+
+	_, err := fmt.Fprintf(b, " %s %s", clfQuote(orDash(e.Referer)), clfQuote(orDash(e.UserAgent)))
+	return err
+}
+
+func orDash(s string) string{
+	if s == ""{
+		return "-"
+	}
+	return s
+}
+
+//加上双引号,转义其中的双引号、反斜杠和控制字符
+func clfQuote(s string) string{
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++{
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c == 0x7f:
+			fmt.Fprintf(&b, "\\x%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}//for
+	b.WriteByte('"')
+	return b.String()
+}
+
+//按大小切分的日志文件,超过maxBytes时把path重命名为path.1,原来的path.1重命名为path.2,以此类推
+//最多保留maxBackups个旧文件,maxBytes为0时不切分
+type RotatingFile struct {
+	path string
+	maxBytes int64
+	maxBackups int
+
+	mu sync.Mutex
+	file *os.File
+	size int64
+}
+
+func OpenRotatingFile(path string, maxBytes int64, maxBackups int) (*RotatingFile, error){
+	r := &RotatingFile{path: path, maxBytes: maxBytes, maxBackups: maxBackups}
+	if err := r.open(); err != nil{
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *RotatingFile) open() error{
+	file, err := os.OpenFile(r.path, os.O_WRONLY | os.O_CREATE | os.O_APPEND, 0644)
+	if err != nil{
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil{
+		_ = file.Close()
+		return err
+	}
+
+	r.file, r.size = file, info.Size()
+	return nil
+}
+
+func (r *RotatingFile) Write(p []byte) (int, error){
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.file == nil{
+		return 0, os.ErrClosed
+	}
+
+	if r.maxBytes > 0 && r.size > 0 && r.size + int64(len(p)) > r.maxBytes{
+		if err := r.rotate(); err != nil{
+			return 0, err
+		}
+	}
+
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *RotatingFile) rotate() error{
+	if err := r.file.Close(); err != nil{
+		return err
+	}
+	r.file = nil
+
+	if r.maxBackups <= 0{
+		_ = os.Remove(r.path)
+		return r.open()
+	}
+
+	_ = os.Remove(fmt.Sprintf("%s.%d", r.path, r.maxBackups))
+	for i := r.maxBackups - 1; i > 0; i--{
+		_ = os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i + 1))
+	}//for
+
+	//重命名失败时继续写入原来的文件
+	_ = os.Rename(r.path, r.path + ".1")
+	return r.open()
+}
+
+//重新打开文件,用于外部工具切分日志之后
+func (r *RotatingFile) Reopen() error{
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.file != nil{
+		_ = r.file.Close()
+		r.file = nil
+	}
+	return r.open()
+}
+
+func (r *RotatingFile) Close() error{
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.file == nil{
+		return nil
+	}
+
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+//http和crack模式下从后端连接读取的第一块数据中解析响应的状态码
+//作为bufferedConn交给copyConn,之后仍然直接使用内部的连接转发
+type statusConn struct {
+	net.Conn
+	status int
+}
+
+func (c *statusConn) innerConn() net.Conn{
+	return c.Conn
+}
+
+func (c *statusConn) takeBuffered() []byte{
+	buf := make([]byte, 512)
+	n, _ := c.Conn.Read(buf)
+
+	//只解析完整的状态行
+	if end := bytes.Index(buf[: n], []byte("\r\n")); end > 0{
+		if _, status, _, ok := parseStatusLine(string(buf[: end])); ok{
+			c.status = status
+		}
+	}
+	return buf[: n]
+}
+
+func (c *statusConn) CloseWrite() error{
+	return closeWrite(c.Conn)
+}
+
+//由convert得到的连接生成日志,请求信息在转发之前读取,不记录访问日志时返回nil
+func (p *Proxy) accessEntry(entry *connEntry, from net.Conn) *AccessLogEntry{
+	if !p.accessLog.enabled(){
+		return nil
+	}
+
+	e := &AccessLogEntry{
+		Time: entry.started,
+		Listener: p.label(),
+		Proxy: p.name,
+		ConnID: entry.id,
+		Client: entry.info().Client,
+	}
+
+	switch c := from.(type) {
+	case *HttpConn:
+		e.setRequest(c.Request)
+	case *HttpCrack:
+		e.setRequest(c.Request)
+	case *TlsConn:
+		e.setClientHello(c.clientHello)
+	case *ConnectConn:
+		//Host记录CONNECT的目的地址
+		e.setClientHello(c.clientHello)
+		e.setRequest(c.Request)
+		e.Host, e.Status = c.Request.URI, 200
+	}
+	return e
+}
+
+//记录日志,补上结束时才能确定的字段
+func (p *Proxy) logAccess(e *AccessLogEntry, err error){
+	if e == nil{
+		return
+	}
+
+	e.Duration = Duration(time.Since(e.Time))
+	if err != nil{
+		e.Err = err.Error()
+		if e.Status == 0{
+			e.Status = respondedStatus(err)
+		}
+	}
+	p.accessLog.Log(e)
+}
@@ -0,0 +1,200 @@
+package go_virtual_host
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessLogFormats(t *testing.T) {
+	e := &AccessLogEntry{
+		Time: time.Date(2020, 3, 1, 8, 30, 0, 0, time.UTC),
+		Client: "10.0.0.1:5000",
+		Host: "example.com",
+		Method: "GET",
+		URI: "/a\"b",
+		Version: "HTTP/1.1",
+		Status: 200,
+		UserAgent: "curl/7.0",
+		BytesOut: 42,
+	}
+
+	cases := []struct{
+		format string
+		expect string
+	}{
+		{AccessLogCommon, `10.0.0.1 - - [01/Mar/2020:08:30:00 +0000] "GET /a\"b HTTP/1.1" 200 42` + "\n"},
+		{AccessLogCombined, `10.0.0.1 - - [01/Mar/2020:08:30:00 +0000] "GET /a\"b HTTP/1.1" 200 42 "-" "curl/7.0"` + "\n"},
+		{"{{.Host}} {{.RequestLine}} {{.Status}}", "example.com GET /a\"b HTTP/1.1 200\n"},
+	}
+
+	for _, c := range cases{
+		var b bytes.Buffer
+		l, err := NewAccessLog(&b, c.format)
+		if err != nil{
+			t.Fatal(err)
+		}
+
+		l.Log(e)
+		if b.String() != c.expect{
+			t.Fatalf("format %q: expect %q, got %q", c.format, c.expect, b.String())
+		}
+	}//for
+
+	var b bytes.Buffer
+	l, _ := NewAccessLog(&b, AccessLogJSON)
+	l.Log(&AccessLogEntry{SNI: "example.com", ALPN: []string{"h2"}})
+
+	var v map[string]interface{}
+	if err := json.Unmarshal(b.Bytes(), &v); err != nil{
+		t.Fatal(err)
+	}
+	if v["sni"] != "example.com" || v["method"] != nil{
+		t.Fatalf("unexpected json %s", b.String())
+	}
+
+	if _, err := NewAccessLog(&b, "{{.Host"); err == nil{
+		t.Fatal("expect template error")
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vhost")
+	if err != nil{
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "access.log")
+	r, err := OpenRotatingFile(path, 10, 2)
+	if err != nil{
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	for i := 0; i < 4; i++{
+		if _, err = fmt.Fprintf(r, "line %d\n", i); err != nil{
+			t.Fatal(err)
+		}
+	}//for
+
+	expect := map[string]string{
+		path: "line 3\n",
+		path + ".1": "line 2\n",
+		path + ".2": "line 1\n",
+	}
+	for name, content := range expect{
+		data, err := ioutil.ReadFile(name)
+		if err != nil || string(data) != content{
+			t.Fatalf("%s: expect %q, got %q %v", name, content, data, err)
+		}
+	}//for
+
+	if _, err = os.Stat(path + ".3"); !os.IsNotExist(err){
+		t.Fatalf("expect at most 2 backups, got %v", err)
+	}
+}
+
+//每次Write作为一行日志
+type lineWriter chan string
+
+func (w lineWriter) Write(p []byte) (int, error){
+	w <- string(p)
+	return len(p), nil
+}
+
+func readAccessLog(t *testing.T, lines lineWriter) *AccessLogEntry{
+	select {
+	case line := <-lines:
+		e := new(AccessLogEntry)
+		if err := json.Unmarshal([]byte(line), e); err != nil{
+			t.Fatalf("%v: %s", err, line)
+		}
+		return e
+	case <-time.After(2 * time.Second):
+		t.Fatal("no access log written")
+	}
+	return nil
+}
+
+func TestProxyAccessLog(t *testing.T) {
+	backend := startBackend(t, "a")
+	defer backend.Close()
+
+	lines := make(lineWriter, 10)
+	accessLog, _ := NewAccessLog(lines, AccessLogJSON)
+
+	getProxy := func(request *Request) (net.Conn, error){
+		return net.Dial("tcp", backend.Addr().String())
+	}
+	crack := NewCrackProxy("127.0.0.1:0", getProxy, nil, WithAccessLog(accessLog)).(*Proxy)
+	defer crack.Close()
+	crack.AsyncStart()
+
+	body := getBody(t, crack.Addr().String())
+	e := readAccessLog(t, lines)
+	if e.Host != "example.com" || e.RequestLine() != "GET / HTTP/1.1" || e.Status != 200 ||
+		e.Backend != backend.Addr().String() || e.BytesOut != int64(len("HTTP/1.1 200 OK\r\nContent-Length: 3\r\n\r\n") + len(body)){
+		t.Fatalf("unexpected entry %+v", e)
+	}
+
+	//keepalive模式下每个请求一行
+	route := func(request *Request) (string, error){
+		return backend.Addr().String(), nil
+	}
+	keepAlive := NewKeepAliveProxy("127.0.0.1:0", route, nil, nil, WithAccessLog(accessLog)).(*Proxy)
+	defer keepAlive.Close()
+	keepAlive.AsyncStart()
+
+	conn, err := net.Dial("tcp", keepAlive.Addr().String())
+	if err != nil{
+		t.Fatal(err)
+	}
+	_, _ = io.WriteString(conn, "GET /1 HTTP/1.1\r\nHost: example.com\r\n\r\nGET /2 HTTP/1.1\r\nHost: example.com\r\nReferer: /1\r\n\r\n")
+
+	for _, uri := range []string{"/1", "/2"}{
+		e = readAccessLog(t, lines)
+		if e.URI != uri || e.Status != 200 || e.BytesOut != 4{
+			t.Fatalf("unexpected entry %+v", e)
+		}
+	}//for
+	if e.Referer != "/1"{
+		t.Fatalf("expect referer /1, got %+v", e)
+	}
+
+	//无法解析的请求返回400
+	_, _ = io.WriteString(conn, "BAD\r\n\r\n")
+	if e = readAccessLog(t, lines); e.Status != 400 || e.Err == ""{
+		t.Fatalf("unexpected entry %+v", e)
+	}
+	_ = conn.Close()
+
+	//tls模式记录SNI、ALPN和指纹
+	tlsProxy := NewTlsProxy("127.0.0.1:0", func(hello *ClientHello) (net.Conn, error) {
+		return net.Dial("tcp", backend.Addr().String())
+	}, WithAccessLog(accessLog)).(*Proxy)
+	defer tlsProxy.Close()
+	tlsProxy.AsyncStart()
+
+	raw, err := net.Dial("tcp", tlsProxy.Addr().String())
+	if err != nil{
+		t.Fatal(err)
+	}
+	client := tls.Client(raw, &tls.Config{ServerName: "example.com", NextProtos: []string{"h2", "http/1.1"}})
+	_ = client.Handshake()
+	_ = client.Close()
+
+	e = readAccessLog(t, lines)
+	if e.SNI != "example.com" || strings.Join(e.ALPN, ",") != "h2,http/1.1" || len(e.Fingerprint) != 32 || e.BytesIn == 0{
+		t.Fatalf("unexpected entry %+v", e)
+	}
+}
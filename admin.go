@@ -0,0 +1,194 @@
+package go_virtual_host
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+//管理接口的http服务
+type adminServer struct {
+	listen string
+	server *http.Server
+}
+
+//管理接口:
+//  GET  /metrics                                  Prometheus格式的监控指标
+//  GET  /connections                              正在处理的连接
+//  POST /connections/close?id=                    关闭连接
+//  GET  /routes                                   每个listener生效的路由
+//  GET  /backends                                 后端集群的状态
+//  POST /backends/drain?pool=&backend=            不再选择该后端
+//  POST /backends/undrain?pool=&backend=          恢复选择该后端
+//  POST /reload                                   重新加载配置文件
+func (m *Manager) adminHandler() http.Handler{
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m.metrics)
+
+	mux.HandleFunc("/connections", adminGet(func(r *http.Request) (interface{}, error) {
+		return m.Connections(), nil
+	}))
+	mux.HandleFunc("/routes", adminGet(func(r *http.Request) (interface{}, error) {
+		return m.liveRoutes(), nil
+	}))
+	mux.HandleFunc("/backends", adminGet(func(r *http.Request) (interface{}, error) {
+		return m.BackendStatus(), nil
+	}))
+
+	mux.HandleFunc("/connections/close", adminPost(func(r *http.Request) (interface{}, error) {
+		id, err := strconv.ParseUint(r.URL.Query().Get("id"), 10, 64)
+		if err != nil{
+			return nil, adminError{http.StatusBadRequest, "invalid id"}
+		}
+		if !m.CloseConnection(id){
+			return nil, adminError{http.StatusNotFound, "connection not found"}
+		}
+		return adminOK, nil
+	}))
+	mux.HandleFunc("/backends/drain", adminPost(func(r *http.Request) (interface{}, error) {
+		return m.adminDrain(r, true)
+	}))
+	mux.HandleFunc("/backends/undrain", adminPost(func(r *http.Request) (interface{}, error) {
+		return m.adminDrain(r, false)
+	}))
+	mux.HandleFunc("/reload", adminPost(func(r *http.Request) (interface{}, error) {
+		if err := m.Reload(); err != nil{
+			return nil, adminError{http.StatusUnprocessableEntity, err.Error()}
+		}
+		return adminOK, nil
+	}))
+
+	return mux
+}
+
+var adminOK = map[string]string{"status": "ok"}
+
+//带状态码的错误
+type adminError struct {
+	code int
+	message string
+}
+
+func (e adminError) Error() string{
+	return e.message
+}
+
+func adminGet(handler func(r *http.Request) (interface{}, error)) http.HandlerFunc{
+	return adminMethod(http.MethodGet, handler)
+}
+
+func adminPost(handler func(r *http.Request) (interface{}, error)) http.HandlerFunc{
+	return adminMethod(http.MethodPost, handler)
+}
+
+//检查请求方法,以json格式返回结果或者错误
+func adminMethod(method string, handler func(r *http.Request) (interface{}, error)) http.HandlerFunc{
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method{
+			w.Header().Set("Allow", method)
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+			return
+		}
+
+		result, err := handler(r)
+		if err != nil{
+			code := http.StatusInternalServerError
+			if ae, ok := err.(adminError); ok{
+				code = ae.code
+			}
+			writeJSON(w, code, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, result)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}){
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	_ = encoder.Encode(v)
+}
+
+func (m *Manager) adminDrain(r *http.Request, drained bool) (interface{}, error){
+	query := r.URL.Query()
+	if err := m.DrainBackend(query.Get("pool"), query.Get("backend"), drained); err != nil{
+		return nil, adminError{http.StatusNotFound, err.Error()}
+	}
+	return adminOK, nil
+}
+
+//管理接口输出的路由
+type adminRoutes struct {
+	Name string `json:"name"`
+	Listen string `json:"listen"`
+	Mode string `json:"mode"`
+	Routes []string `json:"routes"`
+}
+
+//正在运行的listener使用的路由
+func (m *Manager) liveRoutes() []adminRoutes{
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	routes := make([]adminRoutes, 0, len(m.listeners))
+	for name, ml := range m.listeners{
+		lr := adminRoutes{Name: name, Listen: ml.cfg.Listen, Mode: ml.cfg.Mode, Routes: []string{}}
+		for _, route := range ml.holder.router().table.Routes(){
+			lr.Routes = append(lr.Routes, route.String())
+		}
+		routes = append(routes, lr)
+	}
+
+	sort.Slice(routes, func(i, j int) bool {
+		return routes[i].Name < routes[j].Name
+	})
+	return routes
+}
+
+//管理接口的地址变化时打开新的listener,关闭管理接口时listener为nil
+func (m *Manager) listenAdmin(cfg *Config) (listener net.Listener, changed bool, err error){
+	current, listen := "", ""
+	if m.admin != nil{
+		current = m.admin.listen
+	}
+	if cfg.Admin != nil{
+		listen = cfg.Admin.Listen
+	}
+
+	if current == listen{
+		return nil, false, nil
+	}
+
+	if listen == ""{
+		return nil, true, nil
+	}
+
+	listener, err = net.Listen("tcp", listen)
+	return listener, true, err
+}
+
+//关闭旧的管理接口,在listener上开始新的管理接口
+func (m *Manager) switchAdmin(cfg *Config, listener net.Listener){
+	if m.admin != nil{
+		m.logLn("stop admin on %s", m.admin.listen)
+		_ = m.admin.server.Close()
+		m.admin = nil
+	}
+
+	if listener == nil{
+		return
+	}
+
+	server := &http.Server{Handler: m.adminHandler()}
+	m.admin = &adminServer{listen: cfg.Admin.Listen, server: server}
+	m.logLn("start admin on %s", cfg.Admin.Listen)
+
+	go func() {
+		_ = server.Serve(listener)
+	}()
+}
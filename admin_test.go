@@ -0,0 +1,136 @@
+package go_virtual_host
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func adminDo(t *testing.T, handler http.Handler, method string, target string, v interface{}) int{
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(method, target, nil))
+
+	if v != nil{
+		if err := json.Unmarshal(recorder.Body.Bytes(), v); err != nil{
+			t.Fatalf("%s %s: %v: %s", method, target, err, recorder.Body.String())
+		}
+	}
+	return recorder.Code
+}
+
+func TestAdminAPI(t *testing.T) {
+	a := startBackend(t, "a")
+	defer a.Close()
+
+	dir, err := ioutil.TempDir("", "vhost")
+	if err != nil{
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config.json")
+	writeConfig(t, path, a.Addr().String())
+
+	m, err := NewManager(path)
+	if err != nil{
+		t.Fatal(err)
+	}
+	if err = m.Start(); err != nil{
+		t.Fatal(err)
+	}
+	defer m.Stop()
+
+	handler := m.adminHandler()
+	addr := m.Proxies()["web"].Addr().String()
+
+	//保持一个keep-alive连接
+	conn, err := net.Dial("tcp", addr)
+	if err != nil{
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	_, _ = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	tr := NewTextReader(conn)
+	response, err := tr.ReadResponse()
+	if err != nil{
+		t.Fatal(err)
+	}
+	_, _ = tr.ReadUntilN(response.ContentLength)
+
+	var conns []ConnInfo
+	if code := adminDo(t, handler, "GET", "/connections", &conns); code != 200 || len(conns) != 1{
+		t.Fatalf("unexpected connections %d %+v", code, conns)
+	}
+	if c := conns[0]; c.Listener != "web" || c.Host != "example.com" || c.Backend != a.Addr().String() || c.BytesOut != 3{
+		t.Fatalf("unexpected connection %+v", c)
+	}
+
+	var routes []adminRoutes
+	if code := adminDo(t, handler, "GET", "/routes", &routes); code != 200 || len(routes) != 1 || routes[0].Routes[0] != "** -> web"{
+		t.Fatalf("unexpected routes %d %+v", code, routes)
+	}
+
+	if code := adminDo(t, handler, "GET", "/connections/close?id=" + strconv.FormatUint(conns[0].ID, 10), nil); code != 405{
+		t.Fatalf("expect 405, got %d", code)
+	}
+	if code := adminDo(t, handler, "POST", "/connections/close?id=" + strconv.FormatUint(conns[0].ID, 10), nil); code != 200{
+		t.Fatalf("close connection: %d", code)
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err = conn.Read(make([]byte, 1)); err != io.EOF{
+		t.Fatalf("expect connection closed, got %v", err)
+	}
+
+	//drain之后没有可用的后端
+	if code := adminDo(t, handler, "POST", "/backends/drain?pool=web&backend=" + a.Addr().String(), nil); code != 200{
+		t.Fatalf("drain: %d", code)
+	}
+
+	var status map[string][]BackendStatus
+	adminDo(t, handler, "GET", "/backends", &status)
+	if !status["web"][0].Drained{
+		t.Fatalf("expect drained, got %+v", status)
+	}
+
+	//重新加载配置之后仍然保持drain
+	if code := adminDo(t, handler, "POST", "/reload", nil); code != 200{
+		t.Fatalf("reload: %d", code)
+	}
+
+	conn2, err := net.Dial("tcp", addr)
+	if err != nil{
+		t.Fatal(err)
+	}
+	defer conn2.Close()
+	_, _ = io.WriteString(conn2, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	if response, err = NewTextReader(conn2).ReadResponse(); err != nil || response.StatusCode != 503{
+		t.Fatalf("expect 503, got %v %v", response, err)
+	}
+
+	if code := adminDo(t, handler, "POST", "/backends/undrain?pool=web&backend=" + a.Addr().String(), nil); code != 200{
+		t.Fatalf("undrain: %d", code)
+	}
+	if body := getBody(t, addr); body != "a /"{
+		t.Fatalf("expect a /, got %q", body)
+	}
+
+	if code := adminDo(t, handler, "POST", "/backends/drain?pool=web&backend=missing:1", nil); code != 404{
+		t.Fatalf("expect 404, got %d", code)
+	}
+
+	var result map[string]string
+	if code := adminDo(t, handler, "POST", "/connections/close?id=x", &result); code != 400 || !strings.Contains(result["error"], "invalid id"){
+		t.Fatalf("unexpected result %d %v", code, result)
+	}
+}
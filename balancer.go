@@ -0,0 +1,423 @@
+package go_virtual_host
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var errNoBackend = errors.New("no backend available")
+
+type Backend struct {
+	Addr string
+
+	//权重,只用于加权轮询和一致性哈希
+	Weight int
+
+	//正在使用的连接数
+	active int64
+
+	//平滑加权轮询的当前权重,由pool的锁保护
+	currentWeight int
+
+	health backendHealth
+
+	//为nil时不熔断
+	breaker *circuitBreaker
+
+	//为1时不再选择该后端
+	drained int32
+
+	pool *BackendPool
+}
+
+func NewBackend(addr string, weight int) *Backend{
+	if weight <= 0{
+		weight = 1
+	}
+	return &Backend{Addr: addr, Weight: weight}
+}
+
+//正在使用的连接数
+func (b *Backend) Active() int64{
+	return atomic.LoadInt64(&b.active)
+}
+
+//负载均衡策略,从健康的后端中选择一个
+//调用时持有pool的锁,backends不为空
+type Balancer interface {
+	Pick(backends []*Backend, request *Request) *Backend
+}
+
+type roundRobin struct {
+	next uint64
+}
+
+func RoundRobin() Balancer{
+	return &roundRobin{}
+}
+
+func (r *roundRobin) Pick(backends []*Backend, request *Request) *Backend{
+	n := atomic.AddUint64(&r.next, 1)
+	return backends[int((n - 1) % uint64(len(backends)))]
+}
+
+//nginx的平滑加权轮询
+type weightedRoundRobin struct {}
+
+func WeightedRoundRobin() Balancer{
+	return weightedRoundRobin{}
+}
+
+func (weightedRoundRobin) Pick(backends []*Backend, request *Request) *Backend{
+	var (
+		best *Backend
+		total int
+	)
+
+	for _, b := range backends{
+		b.currentWeight += b.Weight
+		total += b.Weight
+		if best == nil || b.currentWeight > best.currentWeight{
+			best = b
+		}
+	}//for
+
+	best.currentWeight -= total
+	return best
+}
+
+//选择正在使用的连接数最少的后端,相同时轮流选择
+type leastConnections struct {
+	next uint64
+}
+
+func LeastConnections() Balancer{
+	return &leastConnections{}
+}
+
+func (l *leastConnections) Pick(backends []*Backend, request *Request) *Backend{
+	start := int(atomic.AddUint64(&l.next, 1) % uint64(len(backends)))
+
+	best := backends[start]
+	for i := 1; i < len(backends); i++{
+		b := backends[(start + i) % len(backends)]
+		if b.Active() < best.Active(){
+			best = b
+		}
+	}
+	return best
+}
+
+//随机选择两个后端,使用连接数较少的一个
+type randomTwoChoices struct {
+	mu sync.Mutex
+	rand *rand.Rand
+}
+
+func RandomTwoChoices() Balancer{
+	return &randomTwoChoices{rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+func (r *randomTwoChoices) Pick(backends []*Backend, request *Request) *Backend{
+	if len(backends) == 1{
+		return backends[0]
+	}
+
+	r.mu.Lock()
+	i := r.rand.Intn(len(backends))
+	j := r.rand.Intn(len(backends) - 1)
+	r.mu.Unlock()
+
+	if j >= i{
+		j++
+	}
+
+	if backends[j].Active() < backends[i].Active(){
+		return backends[j]
+	}
+	return backends[i]
+}
+
+//从请求中取出用于一致性哈希的key
+type HashKey func(*Request) string
+
+func HashClientIP(request *Request) string{
+	return remoteIP(request.RemoteAddr)
+}
+
+func HashHost(request *Request) string{
+	return strings.ToLower(hostWithoutPort(request.Header("Host")))
+}
+
+func HashHeader(name string) HashKey{
+	return func(request *Request) string {
+		return request.Header(name)
+	}
+}
+
+func HashCookie(name string) HashKey{
+	return func(request *Request) string {
+		return requestCookie(request, name)
+	}
+}
+
+//读取Cookie头中的值
+func requestCookie(request *Request, name string) string{
+	for _, pair := range strings.Split(request.Header("Cookie"), ";"){
+		pair = strings.TrimSpace(pair)
+		if eq := strings.IndexByte(pair, '='); eq > 0 && pair[: eq] == name{
+			return pair[eq + 1: ]
+		}
+	}
+	return ""
+}
+
+//每个权重对应的虚拟节点数
+const hashReplicas = 100
+
+type hashNode struct {
+	hash uint32
+	backend *Backend
+}
+
+//一致性哈希,后端不可用时顺延到环上的下一个后端,其他key的映射不受影响
+type consistentHash struct {
+	key HashKey
+
+	//可用后端变化时重新生成哈希环
+	signature string
+	ring []hashNode
+}
+
+func ConsistentHash(key HashKey) Balancer{
+	return &consistentHash{key: key}
+}
+
+func (c *consistentHash) build(backends []*Backend){
+	var sig strings.Builder
+	for _, b := range backends{
+		sig.WriteString(b.Addr)
+		sig.WriteByte('/')
+		sig.WriteString(strconv.Itoa(b.Weight))
+		sig.WriteByte(' ')
+	}
+
+	if sig.String() == c.signature{
+		return
+	}
+
+	c.signature = sig.String()
+	c.ring = c.ring[: 0]
+	for _, b := range backends{
+		for i := 0; i < hashReplicas * b.Weight; i++{
+			c.ring = append(c.ring, hashNode{crc32.ChecksumIEEE([]byte(b.Addr + "#" + strconv.Itoa(i))), b})
+		}
+	}
+
+	sort.Slice(c.ring, func(i, j int) bool {
+		return c.ring[i].hash < c.ring[j].hash
+	})
+}
+
+func (c *consistentHash) Pick(backends []*Backend, request *Request) *Backend{
+	c.build(backends)
+
+	h := crc32.ChecksumIEEE([]byte(c.key(request)))
+	i := sort.Search(len(c.ring), func(i int) bool {
+		return c.ring[i].hash >= h
+	})
+
+	if i == len(c.ring){
+		i = 0
+	}
+	return c.ring[i].backend
+}
+
+//一组提供相同服务的后端
+type BackendPool struct {
+	mu sync.Mutex
+	backends []*Backend
+	balancer Balancer
+	dialTimeout time.Duration
+	outlier *OutlierDetection
+	breaker *CircuitBreakerSettings
+	fallback *BackendPool
+}
+
+//balancer为nil时使用轮询
+func NewBackendPool(balancer Balancer, backends ...*Backend) *BackendPool{
+	if balancer == nil{
+		balancer = RoundRobin()
+	}
+
+	pool := &BackendPool{balancer: balancer}
+	for _, b := range backends{
+		pool.Add(b)
+	}
+	return pool
+}
+
+func (p *BackendPool) Add(b *Backend){
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	b.pool = p
+	if p.breaker != nil{
+		b.breaker = newCircuitBreaker(*p.breaker)
+	}
+	p.backends = append(p.backends, b)
+}
+
+//按地址查找后端
+func (p *BackendPool) Backend(addr string) *Backend{
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, b := range p.backends{
+		if b.Addr == addr{
+			return b
+		}
+	}
+	return nil
+}
+
+func (p *BackendPool) Backends() []*Backend{
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	backends := make([]*Backend, len(p.backends))
+	copy(backends, p.backends)
+	return backends
+}
+
+//0表示不超时
+func (p *BackendPool) SetDialTimeout(timeout time.Duration){
+	p.dialTimeout = timeout
+}
+
+func (p *BackendPool) Pick(request *Request) (*Backend, error){
+	b, err := p.pick(request)
+	if err != errNoBackend{
+		return b, err
+	}
+
+	p.mu.Lock()
+	fallback := p.fallback
+	p.mu.Unlock()
+
+	if fallback == nil{
+		return nil, err
+	}
+	return fallback.pick(request)
+}
+
+func (p *BackendPool) pick(request *Request) (*Backend, error){
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	//跳过不健康、被摘除、熔断和连接数已满的后端
+	now := time.Now()
+	available := make([]*Backend, 0, len(p.backends))
+	saturated := false
+	for _, b := range p.backends{
+		if !b.available(now){
+			continue
+		}
+		if b.saturated(){
+			saturated = true
+			continue
+		}
+		available = append(available, b)
+	}//for
+
+	//可用的后端连接数都已满时不使用fallback
+	if len(available) == 0 && saturated{
+		return nil, errTooManyConns
+	}
+	if len(available) == 0{
+		return nil, errNoBackend
+	}
+
+	return p.balancer.Pick(available, request), nil
+}
+
+//选择一个后端并建立连接,连接关闭时更新后端的连接数
+//可以直接作为NewCommonProxy和NewCrackProxy的getProxy
+func (p *BackendPool) Dial(request *Request) (net.Conn, error){
+	b, err := p.Pick(request)
+	if err != nil{
+		return nil, err
+	}
+
+	return b.pool.dialBackend(b)
+}
+
+//可以直接作为NewTlsProxy的getProxy
+func (p *BackendPool) DialTls(hello *ClientHello) (net.Conn, error){
+	return p.Dial(helloRequest(hello))
+}
+
+func (p *BackendPool) dialBackend(b *Backend) (net.Conn, error){
+	var (
+		conn net.Conn
+		err error
+	)
+
+	if !b.reserve(){
+		return nil, errTooManyConns
+	}
+	if b.breaker != nil{
+		if err = b.breaker.allow(); err != nil{
+			b.release()
+			return nil, err
+		}
+	}
+
+	if p.dialTimeout > 0{
+		conn, err = net.DialTimeout("tcp", b.Addr, p.dialTimeout)
+	}else{
+		conn, err = net.Dial("tcp", b.Addr)
+	}
+
+	p.mu.Lock()
+	outlier := p.outlier
+	p.mu.Unlock()
+
+	if b.recordDial(err, outlier){
+		fmt.Printf("[outlier-detection]: backend %s ejected for %v after %d dial failures\n", b.Addr, outlier.Duration, outlier.Failures)
+	}
+
+	if b.breaker != nil && b.breaker.record(err){
+		fmt.Printf("[circuit-breaker]: backend %s circuit %s, last error: %v\n", b.Addr, b.breaker.State(), err)
+	}
+
+	if err != nil{
+		b.release()
+		return nil, err
+	}
+
+	return &backendTrackedConn{Conn: conn, backend: b}, nil
+}
+
+//关闭时减少后端的连接数
+type backendTrackedConn struct {
+	net.Conn
+	backend *Backend
+	closed int32
+}
+
+func (c *backendTrackedConn) Close() error{
+	if atomic.CompareAndSwapInt32(&c.closed, 0, 1){
+		c.backend.release()
+	}
+	return c.Conn.Close()
+}
@@ -0,0 +1,67 @@
+package go_virtual_host
+
+import "testing"
+
+func TestWeightedRoundRobin(t *testing.T) {
+	pool := NewBackendPool(WeightedRoundRobin(), NewBackend("a:1", 5), NewBackend("b:1", 1), NewBackend("c:1", 1))
+
+	counts := make(map[string]int)
+	var order []string
+	for i := 0; i < 7; i++{
+		b, err := pool.Pick(nil)
+		if err != nil{
+			t.Fatal(err)
+		}
+		counts[b.Addr]++
+		order = append(order, b.Addr)
+	}
+
+	if counts["a:1"] != 5 || counts["b:1"] != 1 || counts["c:1"] != 1{
+		t.Fatalf("unexpected distribution %v", counts)
+	}
+
+	//平滑加权轮询不会连续选择a超过3次
+	if order[0] == "a:1" && order[1] == "a:1" && order[2] == "a:1" && order[3] == "a:1"{
+		t.Fatalf("not smooth: %v", order)
+	}
+}
+
+func TestLeastConnections(t *testing.T) {
+	a, b := NewBackend("a:1", 1), NewBackend("b:1", 1)
+	pool := NewBackendPool(LeastConnections(), a, b)
+	a.active = 3
+
+	for i := 0; i < 4; i++{
+		picked, _ := pool.Pick(nil)
+		if picked != b{
+			t.Fatalf("expect b, got %s", picked.Addr)
+		}
+	}
+}
+
+func TestConsistentHash(t *testing.T) {
+	backends := []*Backend{NewBackend("a:1", 1), NewBackend("b:1", 1), NewBackend("c:1", 1)}
+	pool := NewBackendPool(ConsistentHash(HashCookie("session")), backends...)
+
+	request := &Request{Method: "GET", URI: "/"}
+	request.SetHeader("Cookie", "theme=dark; session=abc123")
+
+	first, _ := pool.Pick(request)
+	for i := 0; i < 10; i++{
+		if b, _ := pool.Pick(request); b != first{
+			t.Fatalf("expect %s, got %s", first.Addr, b.Addr)
+		}
+	}
+
+	//去掉其他后端不影响该key的映射
+	var others []*Backend
+	for _, b := range backends{
+		if b != first{
+			others = append(others, b)
+		}
+	}
+	balancer := ConsistentHash(HashCookie("session"))
+	if b := balancer.Pick([]*Backend{first, others[0]}, request); b != first{
+		t.Fatalf("expect %s after removing a backend, got %s", first.Addr, b.Addr)
+	}
+}
@@ -0,0 +1,203 @@
+package go_virtual_host
+
+import (
+	"io"
+	"strconv"
+	"strings"
+)
+
+//缓冲模式下原始body默认的最大字节数
+const DefaultMaxBodyBytes = 1 << 20
+
+//原始body超过BodyTransformer.MaxBytes
+var errBodyTooLarge = &HttpError{StatusCode: 413, Message: "request body too large"}
+
+//crack模式下改写请求的body,Buffered和Stream二选一,都设置时使用Stream
+//改写在middleware之后进行,request为middleware处理后的请求
+type BodyTransformer struct {
+	//为nil时改写所有带body的请求
+	Match func(ctx *ConnContext, request *Request) bool
+
+	//读取完整的body之后改写,转发时按结果重新设置Content-Length
+	//返回HttpError时按其中的状态码响应,其他错误响应500,之后连接会被关闭
+	Buffered func(ctx *ConnContext, request *Request, body []byte) ([]byte, error)
+
+	//返回改写后的body,转发时使用chunked编码,读取出错时连接会被关闭
+	Stream func(ctx *ConnContext, request *Request, body io.Reader) io.Reader
+
+	//原始body的最大字节数,0表示DefaultMaxBodyBytes,负数表示不限制
+	//缓冲模式下超过时响应413,流式模式下超过时关闭连接
+	MaxBytes int64
+}
+
+//代理在middleware之后按t改写请求的body,目前只有crack模式支持
+func WithBodyTransformer(t *BodyTransformer) Option{
+	return func(p *Proxy) {
+		p.bodyTransformer = t
+	}
+}
+
+func (t *BodyTransformer) match(ctx *ConnContext, request *Request) bool{
+	if t == nil || (t.Buffered == nil && t.Stream == nil){
+		return false
+	}
+	return t.Match == nil || t.Match(ctx, request)
+}
+
+func (t *BodyTransformer) limit(body io.Reader) io.Reader{
+	max := t.MaxBytes
+	if max == 0{
+		max = DefaultMaxBodyBytes
+	}
+	if max < 0{
+		return body
+	}
+	return &maxBytesReader{r: body, remain: max}
+}
+
+//超过remain个字节时返回errBodyTooLarge
+type maxBytesReader struct {
+	r io.Reader
+	remain int64
+}
+
+func (m *maxBytesReader) Read(p []byte) (int, error){
+	//多读一个字节判断是否超过
+	if int64(len(p)) > m.remain + 1{
+		p = p[: m.remain + 1]
+	}
+
+	n, err := m.r.Read(p)
+	if int64(n) > m.remain{
+		n = int(m.remain)
+		m.remain = 0
+		return n, errBodyTooLarge
+	}
+	m.remain -= int64(n)
+	return n, err
+}
+
+//解码后的请求body,chunked编码时去掉分块的长度和trailer
+type bodyReader struct {
+	tr *TextReader
+	kind int
+	//当前chunk或者Content-Length剩余的字节数
+	remain int64
+	done bool
+}
+
+//按照body类型读取解码后的body,读完时返回io.EOF,连接提前结束时返回io.ErrUnexpectedEOF
+func (tr *TextReader) bodyReader(kind int, length int) io.Reader{
+	b := &bodyReader{tr: tr, kind: kind}
+	switch kind {
+	case bodyLength:
+		b.remain = int64(length)
+	case bodyChunked:
+	default:
+		b.done = true
+	}
+	return b
+}
+
+func (b *bodyReader) Read(p []byte) (int, error){
+	if b.done{
+		return 0, io.EOF
+	}
+
+	if b.remain == 0{
+		if b.kind != bodyChunked{
+			b.done = true
+			return 0, io.EOF
+		}
+
+		size, err := b.tr.readChunkSize()
+		if err != nil{
+			return 0, err
+		}
+
+		if size == 0{
+			b.done = true
+			//丢弃trailer
+			if err := b.tr.discardTrailer(); err != nil{
+				return 0, err
+			}
+			return 0, io.EOF
+		}
+		b.remain = size
+	}//if
+
+	if int64(len(p)) > b.remain{
+		p = p[: b.remain]
+	}
+
+	n, err := b.tr.br.Read(p)
+	b.remain -= int64(n)
+	if err == io.EOF{
+		return n, io.ErrUnexpectedEOF
+	}
+	if err != nil{
+		return n, err
+	}
+
+	//chunk数据之后的\r\n
+	if b.remain == 0 && b.kind == bodyChunked{
+		line, err := b.tr.Readline()
+		if err != nil{
+			return n, err
+		}
+		if line != ""{
+			return n, unexpectHttpMsg
+		}
+	}//if
+	return n, nil
+}
+
+//读取chunk的长度行,忽略chunk扩展
+func (tr *TextReader) readChunkSize() (int64, error){
+	line, err := tr.Readline()
+	if err != nil{
+		return 0, err
+	}
+	return parseChunkSize(line)
+}
+
+func parseChunkSize(line string) (int64, error){
+	if i := strings.IndexByte(line, ';'); i >= 0{
+		line = line[: i]
+	}
+
+	size, err := strconv.ParseInt(strings.TrimSpace(line), 16, 64)
+	if err != nil || size < 0{
+		return 0, unexpectHttpMsg
+	}
+	return size, nil
+}
+
+//读取trailer直到空行
+func (tr *TextReader) discardTrailer() error{
+	for {
+		line, err := tr.Readline()
+		if err != nil{
+			return err
+		}
+		if line == ""{
+			return nil
+		}
+	}//for
+}
+
+//按chunked编码写入一个chunk,p为空时不写入
+func writeChunk(w io.Writer, p []byte) error{
+	if len(p) == 0{
+		return nil
+	}
+
+	if _, err := io.WriteString(w, strconv.FormatInt(int64(len(p)), 16) + "\r\n"); err != nil{
+		return err
+	}
+	if _, err := w.Write(p); err != nil{
+		return err
+	}
+	_, err := io.WriteString(w, "\r\n")
+	return err
+}
@@ -0,0 +1,266 @@
+package go_virtual_host
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBodyReader(t *testing.T) {
+	tr := NewTextReader(strings.NewReader("4;ext=1\r\nabcd\r\n3\r\nefg\r\n0\r\nX-Trailer: 1\r\n\r\nGET / HTTP/1.1\r\n\r\n"))
+	body, err := ioutil.ReadAll(tr.bodyReader(bodyChunked, -1))
+	if err != nil || string(body) != "abcdefg"{
+		t.Fatalf("unexpected chunked body %q %v", body, err)
+	}
+	//trailer之后是下一个请求
+	if request, err := tr.ReadRequest(); err != nil || request.URI != "/"{
+		t.Fatalf("unexpected next request %v %v", request, err)
+	}
+
+	tr = NewTextReader(strings.NewReader("hello world"))
+	if body, err = ioutil.ReadAll(tr.bodyReader(bodyLength, 5)); err != nil || string(body) != "hello"{
+		t.Fatalf("unexpected body %q %v", body, err)
+	}
+
+	tr = NewTextReader(strings.NewReader("hel"))
+	if _, err = ioutil.ReadAll(tr.bodyReader(bodyLength, 5)); err != io.ErrUnexpectedEOF{
+		t.Fatalf("expect ErrUnexpectedEOF, got %v", err)
+	}
+
+	limited := (&BodyTransformer{MaxBytes: 4}).limit(strings.NewReader("12345"))
+	if body, err = ioutil.ReadAll(limited); err != errBodyTooLarge || string(body) != "1234"{
+		t.Fatalf("expect errBodyTooLarge, got %q %v", body, err)
+	}
+	limited = (&BodyTransformer{MaxBytes: 4}).limit(strings.NewReader("1234"))
+	if body, err = ioutil.ReadAll(limited); err != nil || string(body) != "1234"{
+		t.Fatalf("unexpected limited body %q %v", body, err)
+	}
+}
+
+//返回后端收到的Content-Length、Transfer-Encoding和解码后的body
+func startBodyEchoBackend(t *testing.T) net.Listener{
+	return startHttpBackend(t, func(conn net.Conn, tr *TextReader, request *Request) bool {
+		body, err := ioutil.ReadAll(tr.bodyReader(requestBodyKind(request), request.ContentLength))
+		if err != nil{
+			return false
+		}
+
+		writeOK(conn, fmt.Sprintf("cl=%s te=%s body=%s", request.Header("Content-Length"), request.Header("Transfer-Encoding"), body))
+		return true
+	})
+}
+
+func startBodyProxy(t *testing.T, backend net.Listener, transformer *BodyTransformer) *Proxy{
+	getProxy := func(request *Request) (net.Conn, error){
+		return net.Dial("tcp", backend.Addr().String())
+	}
+
+	proxy := NewCrackProxy("127.0.0.1:0", getProxy, nil, WithBodyTransformer(transformer)).(*Proxy)
+	proxy.AsyncStart()
+	return proxy
+}
+
+func TestCrackBufferedBody(t *testing.T) {
+	backend := startBodyEchoBackend(t)
+	defer backend.Close()
+
+	proxy := startBodyProxy(t, backend, &BodyTransformer{
+		Match: func(ctx *ConnContext, request *Request) bool {
+			return request.Path() == "/api"
+		},
+		Buffered: func(ctx *ConnContext, request *Request, body []byte) ([]byte, error) {
+			if bytes.Contains(body, []byte("forbidden")){
+				return nil, &HttpError{StatusCode: 400, Message: "bad body"}
+			}
+			return bytes.Replace(body, []byte("secret"), []byte("***"), -1), nil
+		},
+		MaxBytes: 32,
+	})
+	defer proxy.Close()
+
+	conn, err := net.Dial("tcp", proxy.Addr().String())
+	if err != nil{
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	tr := NewTextReader(conn)
+
+	cases := []struct{
+		request string
+		expect string
+	}{
+		{"POST /api HTTP/1.1\r\nHost: a\r\nContent-Length: 16\r\n\r\npassword=secret!", "cl=13 te= body=password=***!"},
+		{"POST /api HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n3\r\npw=\r\n6\r\nsecret\r\n0\r\n\r\n", "cl=6 te= body=pw=***"},
+		{"POST /other HTTP/1.1\r\nHost: a\r\nContent-Length: 6\r\n\r\nsecret", "cl=6 te= body=secret"},
+		{"GET /api HTTP/1.1\r\nHost: a\r\n\r\n", "cl= te= body="},
+	}
+	for i, c := range cases{
+		if _, body := roundTrip(t, conn, tr, c.request); body != c.expect{
+			t.Fatalf("case %d: expect %q, got %q", i, c.expect, body)
+		}
+	}//for
+
+	//超过MaxBytes时响应413并关闭连接
+	response, _ := roundTrip(t, conn, tr, "POST /api HTTP/1.1\r\nHost: a\r\nContent-Length: 40\r\n\r\n" + strings.Repeat("x", 40))
+	if response.StatusCode != 413{
+		t.Fatalf("expect 413, got %d", response.StatusCode)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err = conn.Read(make([]byte, 1)); err != io.EOF{
+		t.Fatalf("expect EOF, got %v", err)
+	}
+
+	//改写失败时按HttpError响应,第一个请求需要等到body读完
+	c, err := net.Dial("tcp", proxy.Addr().String())
+	if err != nil{
+		t.Fatal(err)
+	}
+	defer c.Close()
+	response, _ = roundTrip(t, c, NewTextReader(c), "POST /api HTTP/1.1\r\nHost: a\r\nContent-Length: 9\r\n\r\nforbidden")
+	if response.StatusCode != 400{
+		t.Fatalf("expect 400, got %d", response.StatusCode)
+	}
+}
+
+func TestCrackStreamBody(t *testing.T) {
+	backend := startBodyEchoBackend(t)
+	defer backend.Close()
+
+	proxy := startBodyProxy(t, backend, &BodyTransformer{
+		Stream: func(ctx *ConnContext, request *Request, body io.Reader) io.Reader {
+			return &upperReader{r: body}
+		},
+		MaxBytes: -1,
+	})
+	defer proxy.Close()
+
+	conn, err := net.Dial("tcp", proxy.Addr().String())
+	if err != nil{
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	tr := NewTextReader(conn)
+
+	long := strings.Repeat("abc", maxReadBlock)
+	cases := []struct{
+		request string
+		expect string
+	}{
+		{"POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\n\r\nhello", "cl= te=chunked body=HELLO"},
+		{"POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n2\r\nab\r\n1\r\nc\r\n0\r\n\r\n", "cl= te=chunked body=ABC"},
+		{"GET / HTTP/1.1\r\nHost: a\r\n\r\n", "cl= te= body="},
+		{"POST / HTTP/1.1\r\nHost: a\r\nContent-Length: " + fmt.Sprint(len(long)) + "\r\n\r\n" + long, "cl= te=chunked body=" + strings.ToUpper(long)},
+	}
+	for i, c := range cases{
+		if _, body := roundTrip(t, conn, tr, c.request); body != c.expect{
+			t.Fatalf("case %d: expect %q, got %q", i, c.expect, body)
+		}
+	}//for
+}
+
+type upperReader struct {
+	r io.Reader
+}
+
+func (u *upperReader) Read(p []byte) (int, error){
+	n, err := u.r.Read(p)
+	copy(p, bytes.ToUpper(p[: n]))
+	return n, err
+}
+
+//没有transformer时chunked的body按chunk原样转发,body中的内容不会被当作请求
+func TestCrackChunkedBody(t *testing.T) {
+	backend := startBodyEchoBackend(t)
+	defer backend.Close()
+
+	var paths []string
+	record := RequestFunc(func(request *Request) *Request {
+		paths = append(paths, request.Path())
+		return request
+	})
+	getProxy := func(request *Request) (net.Conn, error){
+		return net.Dial("tcp", backend.Addr().String())
+	}
+	proxy := NewCrackProxy("127.0.0.1:0", getProxy, nil, WithMiddleware(record)).(*Proxy)
+	defer proxy.Close()
+	proxy.AsyncStart()
+
+	conn, err := net.Dial("tcp", proxy.Addr().String())
+	if err != nil{
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	tr := NewTextReader(conn)
+
+	long := strings.Repeat("x", maxReadBlock * 2 + 1)
+	inner := "GET /inner HTTP/1.1\r\nHost: a\r\n\r\n"
+	chunked := "POST /upload HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n" +
+		fmt.Sprintf("%x\r\n%s\r\n%x;ext=1\r\n%s\r\n0\r\nX-Trailer: 1\r\n\r\n", len(inner), inner, len(long), long)
+	//chunked的请求之后紧接着pipeline的请求
+	if _, err = io.WriteString(conn, chunked + "GET /next HTTP/1.1\r\nHost: a\r\n\r\n"); err != nil{
+		t.Fatal(err)
+	}
+
+	for _, expect := range []string{"cl= te=chunked body=" + inner + long, "cl= te= body="}{
+		response, err := tr.ReadResponse()
+		if err != nil{
+			t.Fatal(err)
+		}
+		body, err := tr.ReadUntilN(response.ContentLength)
+		if err != nil || string(body) != expect{
+			t.Fatalf("expect %q, got %q %v", expect, body, err)
+		}
+	}//for
+
+	if fmt.Sprint(paths) != "[/upload /next]"{
+		t.Fatalf("unexpected requests %v", paths)
+	}
+}
+
+//同时有Content-Length和Transfer-Encoding的请求响应400,body中夹带的请求不会转发
+func TestCrackRejectsAmbiguousBody(t *testing.T) {
+	backend := startBodyEchoBackend(t)
+	defer backend.Close()
+	proxy := startBodyProxy(t, backend, nil)
+	defer proxy.Close()
+
+	smuggled := "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 40\r\nTransfer-Encoding: chunked\r\n\r\n" +
+		"0\r\n\r\nGET /smuggled HTTP/1.1\r\nHost: a\r\n\r\n"
+
+	//作为第一个请求和作为之后的请求
+	for _, prefix := range []string{"", "GET /first HTTP/1.1\r\nHost: a\r\n\r\n"}{
+		conn, err := net.Dial("tcp", proxy.Addr().String())
+		if err != nil{
+			t.Fatal(err)
+		}
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		tr := NewTextReader(conn)
+
+		if prefix != ""{
+			if _, body := roundTrip(t, conn, tr, prefix); body != "cl= te= body="{
+				t.Fatalf("unexpected first response %q", body)
+			}
+		}
+		if _, err = io.WriteString(conn, smuggled); err != nil{
+			t.Fatal(err)
+		}
+
+		response, err := tr.ReadResponse()
+		if err != nil || response.StatusCode != 400{
+			t.Fatalf("expect 400, got %v %v", response, err)
+		}
+		if _, err = tr.ReadUntilN(response.ContentLength); err != nil{
+			t.Fatal(err)
+		}
+		if _, err = tr.ReadResponse(); err == nil{
+			t.Fatal("expect connection closed after 400")
+		}
+		conn.Close()
+	}//for
+}
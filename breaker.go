@@ -0,0 +1,217 @@
+package go_virtual_host
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	errCircuitOpen = errors.New("circuit breaker is open")
+	errTooManyConns = errors.New("too many connections to backend")
+)
+
+const (
+	CircuitClosed = "closed"
+	CircuitOpen = "open"
+	CircuitHalfOpen = "half-open"
+)
+
+//熔断设置,满足任意一个条件时熔断
+type CircuitBreakerSettings struct {
+	//连续失败的次数,0表示不使用
+	ConsecutiveFailures int
+
+	//Window时间内失败的比例,0表示不使用
+	//请求数少于MinRequests时不计算失败比例
+	ErrorRate float64
+	MinRequests int
+	Window time.Duration
+
+	//熔断之后经过OpenTimeout进入半开状态
+	OpenTimeout time.Duration
+
+	//半开状态下允许同时尝试的连接数,全部成功后恢复
+	HalfOpenRequests int
+
+	//同时使用的连接数上限,0表示不限制,超过时直接失败但不计入失败次数
+	MaxConnections int64
+}
+
+func (s *CircuitBreakerSettings) setDefaults(){
+	if s.Window <= 0{
+		s.Window = 10 * time.Second
+	}
+	if s.OpenTimeout <= 0{
+		s.OpenTimeout = 30 * time.Second
+	}
+	if s.HalfOpenRequests <= 0{
+		s.HalfOpenRequests = 1
+	}
+	if s.MinRequests <= 0{
+		s.MinRequests = 10
+	}
+}
+
+type circuitBreaker struct {
+	settings CircuitBreakerSettings
+
+	mu sync.Mutex
+	state string
+	consecutive int
+
+	//当前统计窗口的开始时间、请求数和失败数
+	windowStart time.Time
+	requests int
+	failures int
+
+	openedAt time.Time
+
+	//半开状态下已经放行和已经成功的连接数
+	probes int
+	successes int
+}
+
+func newCircuitBreaker(settings CircuitBreakerSettings) *circuitBreaker{
+	settings.setDefaults()
+	return &circuitBreaker{settings: settings, state: CircuitClosed, windowStart: time.Now()}
+}
+
+func (cb *circuitBreaker) State() string{
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.advance(time.Now())
+	return cb.state
+}
+
+//熔断时间到了进入半开状态
+func (cb *circuitBreaker) advance(now time.Time){
+	if cb.state == CircuitOpen && now.Sub(cb.openedAt) >= cb.settings.OpenTimeout{
+		cb.state = CircuitHalfOpen
+		cb.probes, cb.successes = 0, 0
+	}
+
+	if now.Sub(cb.windowStart) >= cb.settings.Window{
+		cb.windowStart = now
+		cb.requests, cb.failures = 0, 0
+	}
+}
+
+//是否可以选择该后端,不占用半开状态的名额
+func (cb *circuitBreaker) ready() bool{
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.advance(time.Now())
+	switch cb.state {
+	case CircuitOpen:
+		return false
+	case CircuitHalfOpen:
+		return cb.probes < cb.settings.HalfOpenRequests
+	}
+	return true
+}
+
+func (cb *circuitBreaker) saturated(active int64) bool{
+	return cb.settings.MaxConnections > 0 && active >= cb.settings.MaxConnections
+}
+
+//连接后端之前调用,允许时必须调用record记录结果
+//连接数由Backend.reserve限制
+func (cb *circuitBreaker) allow() error{
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.advance(time.Now())
+
+	switch cb.state {
+	case CircuitOpen:
+		return errCircuitOpen
+	case CircuitHalfOpen:
+		if cb.probes >= cb.settings.HalfOpenRequests{
+			return errCircuitOpen
+		}
+		cb.probes++
+	}
+
+	return nil
+}
+
+//记录连接后端的结果,返回状态是否变化
+func (cb *circuitBreaker) record(err error) (changed bool){
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	now := time.Now()
+	cb.advance(now)
+	cb.requests++
+
+	if cb.state == CircuitHalfOpen{
+		if err != nil{
+			cb.trip(now)
+			return true
+		}
+
+		cb.successes++
+		if cb.successes >= cb.settings.HalfOpenRequests{
+			cb.reset(now)
+			return true
+		}
+		return false
+	}
+
+	if err == nil{
+		cb.consecutive = 0
+		return false
+	}
+
+	cb.consecutive++
+	cb.failures++
+
+	s := &cb.settings
+	if (s.ConsecutiveFailures > 0 && cb.consecutive >= s.ConsecutiveFailures) ||
+		(s.ErrorRate > 0 && cb.requests >= s.MinRequests && float64(cb.failures) / float64(cb.requests) >= s.ErrorRate){
+		if cb.state == CircuitClosed{
+			cb.trip(now)
+			return true
+		}
+	}
+	return false
+}
+
+func (cb *circuitBreaker) trip(now time.Time){
+	cb.state = CircuitOpen
+	cb.openedAt = now
+	cb.consecutive = 0
+}
+
+func (cb *circuitBreaker) reset(now time.Time){
+	cb.state = CircuitClosed
+	cb.consecutive = 0
+	cb.windowStart = now
+	cb.requests, cb.failures = 0, 0
+}
+
+//为pool中的每个后端设置熔断,之后添加的后端也会使用该设置
+func (p *BackendPool) SetCircuitBreaker(settings CircuitBreakerSettings){
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.breaker = &settings
+	for _, b := range p.backends{
+		b.breaker = newCircuitBreaker(settings)
+	}
+}
+
+//所有后端都不可用时使用fallback中的后端,fallback自身的fallback不会被使用
+func (p *BackendPool) SetFallback(fallback *BackendPool){
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.fallback = fallback
+}
+
+//后端不可用的错误,不需要再重试
+func isBackendUnavailable(err error) bool{
+	return err == errNoBackend || err == errCircuitOpen || err == errTooManyConns
+}
@@ -0,0 +1,186 @@
+package go_virtual_host
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerTripAndRecover(t *testing.T) {
+	cb := newCircuitBreaker(CircuitBreakerSettings{ConsecutiveFailures: 2, OpenTimeout: 20 * time.Millisecond})
+	failure := errors.New("dial error")
+
+	for i := 0; i < 2; i++{
+		if err := cb.allow(); err != nil{
+			t.Fatal(err)
+		}
+		cb.record(failure)
+	}
+
+	if cb.State() != CircuitOpen{
+		t.Fatalf("expect open, got %s", cb.State())
+	}
+	if err := cb.allow(); err != errCircuitOpen{
+		t.Fatalf("expect errCircuitOpen, got %v", err)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if cb.State() != CircuitHalfOpen{
+		t.Fatalf("expect half-open, got %s", cb.State())
+	}
+
+	//半开状态下只放行一个连接
+	if err := cb.allow(); err != nil{
+		t.Fatal(err)
+	}
+	if cb.ready() || cb.allow() != errCircuitOpen{
+		t.Fatal("expect only one probe in half-open state")
+	}
+
+	cb.record(nil)
+	if cb.State() != CircuitClosed{
+		t.Fatalf("expect closed, got %s", cb.State())
+	}
+}
+
+func TestCircuitBreakerErrorRate(t *testing.T) {
+	cb := newCircuitBreaker(CircuitBreakerSettings{ErrorRate: 0.5, MinRequests: 4})
+	failure := errors.New("dial error")
+
+	for _, err := range []error{nil, failure, nil}{
+		cb.record(err)
+	}
+	if cb.State() != CircuitClosed{
+		t.Fatal("expect closed before min requests")
+	}
+
+	cb.record(failure)
+	if cb.State() != CircuitOpen{
+		t.Fatalf("expect open, got %s", cb.State())
+	}
+}
+
+func TestPoolFallbackAndMaxConnections(t *testing.T) {
+	up := startBackend(t, "fallback")
+	defer up.Close()
+
+	bad := NewBackend(closedAddr(t), 1)
+	pool := NewBackendPool(RoundRobin(), bad)
+	pool.SetCircuitBreaker(CircuitBreakerSettings{ConsecutiveFailures: 1, OpenTimeout: time.Minute})
+
+	good := NewBackend(up.Addr().String(), 1)
+	fallback := NewBackendPool(RoundRobin(), good)
+	fallback.SetCircuitBreaker(CircuitBreakerSettings{MaxConnections: 1})
+	pool.SetFallback(fallback)
+
+	if _, err := pool.Dial(nil); err == nil{
+		t.Fatal("expect dial error")
+	}
+	if bad.Status().Circuit != CircuitOpen{
+		t.Fatalf("expect open circuit, got %s", bad.Status().Circuit)
+	}
+
+	conn, err := pool.Dial(nil)
+	if err != nil{
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if conn.RemoteAddr().String() != good.Addr{
+		t.Fatalf("expect fallback backend, got %s", conn.RemoteAddr())
+	}
+
+	if _, err := pool.Dial(nil); err != errTooManyConns{
+		t.Fatalf("expect errTooManyConns, got %v", err)
+	}
+	_ = conn.Close()
+	conn, err = pool.Dial(nil)
+	if err != nil{
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+}
+
+func TestPickSkipsSaturatedBackend(t *testing.T) {
+	a := startBackend(t, "a")
+	defer a.Close()
+	b := startBackend(t, "b")
+	defer b.Close()
+
+	pool := NewBackendPool(RoundRobin(), NewBackend(a.Addr().String(), 1), NewBackend(b.Addr().String(), 1))
+	pool.SetCircuitBreaker(CircuitBreakerSettings{MaxConnections: 1})
+
+	busy, err := pool.Dial(nil)
+	if err != nil{
+		t.Fatal(err)
+	}
+	defer busy.Close()
+
+	//连接数已满的后端不再被选择,轮询不会返回503
+	for i := 0; i < 4; i++{
+		conn, err := pool.Dial(nil)
+		if err != nil{
+			t.Fatalf("dial %d: %v", i, err)
+		}
+		if conn.RemoteAddr().String() == busy.RemoteAddr().String(){
+			t.Fatalf("dial %d: expect the idle backend, got saturated %s", i, conn.RemoteAddr())
+		}
+		_ = conn.Close()
+	}//for
+}
+
+//同时进行的连接先占用连接数,成功的连接不会超过MaxConnections
+func TestConcurrentDialsRespectMaxConnections(t *testing.T) {
+	//不accept,连接停留在backlog中
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil{
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	pool := NewBackendPool(RoundRobin(), NewBackend(listener.Addr().String(), 1))
+	pool.SetCircuitBreaker(CircuitBreakerSettings{MaxConnections: 2})
+
+	const dials = 20
+	var (
+		wait sync.WaitGroup
+		mu sync.Mutex
+		conns []net.Conn
+		rejected int
+	)
+	start := make(chan struct{})
+	for i := 0; i < dials; i++{
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			<-start
+			conn, err := pool.Dial(nil)
+
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == nil:
+				conns = append(conns, conn)
+			case err == errTooManyConns:
+				rejected++
+			default:
+				t.Errorf("unexpected error %v", err)
+			}
+		}()
+	}//for
+	close(start)
+	wait.Wait()
+
+	if len(conns) != 2 || rejected != dials - 2{
+		t.Fatalf("expect 2 connections and %d rejected, got %d and %d", dials - 2, len(conns), rejected)
+	}
+
+	//关闭之后释放连接数,失败的连接不占用
+	for _, conn := range conns{
+		_ = conn.Close()
+	}
+	if active := pool.backends[0].Active(); active != 0{
+		t.Fatalf("expect 0 active, got %d", active)
+	}
+}
@@ -0,0 +1,295 @@
+//vhost按照Host/SNI把连接转发到不同的后端
+//
+//用法:
+//
+//  vhost run -config vhost.json [-watch 5s]
+//  vhost run -listen :80 -mode keepalive -route example.com=127.0.0.1:8080 -route *.example.com/api/=127.0.0.1:8081
+//  vhost validate-config vhost.json
+//  vhost routes vhost.json
+//  vhost sniff capture.pcap
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	vhost "github.com/coderwf/go-virtual-host"
+)
+
+var commands = map[string]func(args []string) error{
+	"run": run,
+	"validate-config": validateConfig,
+	"routes": routes,
+	"sniff": sniff,
+}
+
+func usage(){
+	fmt.Fprintf(os.Stderr, `usage: vhost <command> [arguments]
+
+commands:
+  run              run proxies from a config file or from flags
+  validate-config  check a config file and report every error
+  routes           print the effective routing table of a config file
+  sniff            print the Host/SNI of each connection in a capture
+
+run "vhost <command> -h" for the arguments of a command
+`)
+}
+
+func main(){
+	if len(os.Args) < 2{
+		usage()
+		os.Exit(2)
+	}
+
+	command, ok := commands[os.Args[1]]
+	if !ok{
+		usage()
+		os.Exit(2)
+	}
+
+	if err := command(os.Args[2: ]); err != nil{
+		fmt.Fprintf(os.Stderr, "vhost %s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+//可以重复指定的参数
+type stringList []string
+
+func (s *stringList) String() string{
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(value string) error{
+	*s = append(*s, value)
+	return nil
+}
+
+//配置文件可以通过-config或者第一个参数指定
+func configPath(fs *flag.FlagSet, path string) (string, error){
+	if path == "" && fs.NArg() > 0{
+		path = fs.Arg(0)
+	}
+
+	if path == ""{
+		return "", fmt.Errorf("config file is required")
+	}
+	return path, nil
+}
+
+func run(args []string) error{
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	path := fs.String("config", "", "config file, other flags are ignored when set")
+	watch := fs.Duration("watch", 0, "reload the config file when it changes, checked at this interval")
+	listen := fs.String("listen", ":80", "listen address")
+	mode := fs.String("mode", vhost.ModeKeepAlive, "http, crack, keepalive or tls")
+	dial := fs.Duration("dial-timeout", 5 * time.Second, "backend dial timeout")
+	header := fs.Duration("header-timeout", 10 * time.Second, "timeout for reading the request header or client hello, 0 disables it")
+	idle := fs.Duration("idle-timeout", 5 * time.Minute, "close connections without traffic in either direction for this long, 0 disables it")
+	lifetime := fs.Duration("lifetime", 0, "maximum connection lifetime, 0 means unlimited")
+	proxyProtocol := fs.Int("proxy-protocol", 0, "send PROXY protocol header of this version to backends")
+	accessLog := fs.String("access-log", "", "write access log to this file, - for stdout, empty disables it")
+	accessLogFormat := fs.String("access-log-format", vhost.AccessLogJSON, "json, common, combined or a text/template")
+	var routeFlags stringList
+	fs.Var(&routeFlags, "route", "host[/path-prefix]=backend-address, can be repeated, host * matches any host")
+	_ = fs.Parse(args)
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+
+	if *path != "" || fs.NArg() > 0{
+		p, err := configPath(fs, *path)
+		if err != nil{
+			return err
+		}
+
+		m, err := vhost.NewManager(p)
+		if err != nil{
+			return err
+		}
+
+		if err = m.Start(); err != nil{
+			return err
+		}
+
+		defer m.WatchSignals()()
+		if *watch > 0{
+			defer m.WatchFile(*watch)()
+		}
+
+		<-stop
+		m.Stop()
+		return nil
+	}
+
+	timeouts := vhost.TimeoutConfig{
+		Dial: vhost.Duration(*dial),
+		Header: vhost.Duration(*header),
+		Idle: vhost.Duration(*idle),
+		Lifetime: vhost.Duration(*lifetime),
+	}
+
+	cfg, err := flagsConfig(*listen, *mode, timeouts, *proxyProtocol, routeFlags)
+	if err != nil{
+		return err
+	}
+
+	if *accessLog != ""{
+		cfg.AccessLog = &vhost.AccessLogConfig{Path: *accessLog, Format: *accessLogFormat}
+	}
+
+	servers, stopServers, err := vhost.NewServersFromConfig(cfg)
+	if err != nil{
+		return err
+	}
+	defer stopServers()
+
+	for _, server := range servers{
+		server.AsyncStart()
+	}
+
+	<-stop
+	return nil
+}
+
+//由命令行参数生成配置,每个-route对应一个后端
+func flagsConfig(listen string, mode string, timeouts vhost.TimeoutConfig, proxyProtocol int, routeFlags []string) (*vhost.Config, error){
+	if len(routeFlags) == 0{
+		return nil, fmt.Errorf("at least one -route is required")
+	}
+
+	l := &vhost.ListenerConfig{Listen: listen, Mode: mode, ProxyProtocol: proxyProtocol}
+	cfg := &vhost.Config{
+		Listeners: []*vhost.ListenerConfig{l},
+		Backends: make(map[string]*vhost.BackendConfig),
+		Timeouts: timeouts,
+	}
+
+	hosts := make(map[string]*vhost.VirtualHostConfig)
+
+	for i, r := range routeFlags{
+		eq := strings.LastIndex(r, "=")
+		if eq <= 0{
+			return nil, fmt.Errorf("invalid -route %q, expect host[/path-prefix]=backend-address", r)
+		}
+
+		target, addr := r[: eq], r[eq + 1: ]
+		host, prefix := target, ""
+		if slash := strings.Index(target, "/"); slash >= 0{
+			host, prefix = target[: slash], target[slash: ]
+		}
+
+		if host == "*"{
+			host = ""
+		}
+
+		backend := fmt.Sprintf("route-%d", i)
+		cfg.Backends[backend] = &vhost.BackendConfig{Addresses: []string{addr}}
+
+		h, ok := hosts[host]
+		if !ok{
+			h = &vhost.VirtualHostConfig{Host: host}
+			hosts[host] = h
+			l.Hosts = append(l.Hosts, h)
+		}
+
+		if prefix == "" || prefix == "/"{
+			h.Backend = backend
+			continue
+		}
+
+		h.Routes = append(h.Routes, &vhost.RouteConfig{PathPrefix: prefix, Backend: backend})
+	}//for
+
+	if err := cfg.Validate(); err != nil{
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func validateConfig(args []string) error{
+	fs := flag.NewFlagSet("validate-config", flag.ExitOnError)
+	path := fs.String("config", "", "config file")
+	_ = fs.Parse(args)
+
+	p, err := configPath(fs, *path)
+	if err != nil{
+		return err
+	}
+
+	if _, err = vhost.LoadConfig(p); err != nil{
+		return err
+	}
+
+	fmt.Printf("%s: ok\n", p)
+	return nil
+}
+
+func routes(args []string) error{
+	fs := flag.NewFlagSet("routes", flag.ExitOnError)
+	path := fs.String("config", "", "config file")
+	_ = fs.Parse(args)
+
+	p, err := configPath(fs, *path)
+	if err != nil{
+		return err
+	}
+
+	cfg, err := vhost.LoadConfig(p)
+	if err != nil{
+		return err
+	}
+
+	listeners, err := vhost.RoutesFromConfig(cfg)
+	if err != nil{
+		return err
+	}
+
+	for _, l := range listeners{
+		fmt.Printf("%s (%s, %s)\n", l.Name, l.Listen, l.Mode)
+		for _, route := range l.Routes{
+			fmt.Printf("  %s %s\n", route, routeExtra(route, cfg))
+		}
+	}//for
+
+	return nil
+}
+
+//路由的附加条件和后端地址
+func routeExtra(route *vhost.Route, cfg *vhost.Config) string{
+	var extra []string
+
+	if len(route.Methods) > 0{
+		extra = append(extra, "methods=" + strings.Join(route.Methods, ","))
+	}
+
+	keys := make([]string, 0, len(route.Headers))
+	for key := range route.Headers{
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys{
+		extra = append(extra, fmt.Sprintf("header[%s]=%s", key, route.Headers[key]))
+	}
+
+	if route.WebSocket{
+		extra = append(extra, "websocket")
+	}
+
+	if route.StripPrefix{
+		extra = append(extra, "strip-prefix")
+	}
+
+	if backend, ok := cfg.Backends[route.Backend]; ok{
+		extra = append(extra, "[" + strings.Join(backend.Addresses, " ") + "]")
+	}
+
+	return strings.Join(extra, " ")
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	vhost "github.com/coderwf/go-virtual-host"
+)
+
+//按host[/prefix]=backend:address的形式描述生成的路由
+func describeRoutes(cfg *vhost.Config) string{
+	address := func(backend string) string {
+		return backend + ":" + strings.Join(cfg.Backends[backend].Addresses, ",")
+	}
+
+	var parts []string
+	for _, h := range cfg.Listeners[0].Hosts{
+		if h.Backend != ""{
+			parts = append(parts, fmt.Sprintf("%s=%s", h.Host, address(h.Backend)))
+		}
+		for _, r := range h.Routes{
+			parts = append(parts, fmt.Sprintf("%s%s=%s", h.Host, r.PathPrefix, address(r.Backend)))
+		}
+	}//for
+	return strings.Join(parts, " ")
+}
+
+func TestFlagsConfig(t *testing.T) {
+	cases := []struct{
+		routes []string
+		//为空表示应该返回错误
+		expect string
+		//同一host的路由共用一个VirtualHostConfig
+		hosts int
+	}{
+		{[]string{"example.com=127.0.0.1:8080"}, "example.com=route-0:127.0.0.1:8080", 1},
+		{[]string{"*=127.0.0.1:8080"}, "=route-0:127.0.0.1:8080", 1},
+		{[]string{"example.com/api/=127.0.0.1:8081"}, "example.com/api/=route-0:127.0.0.1:8081", 1},
+		{[]string{"example.com/=127.0.0.1:8080"}, "example.com=route-0:127.0.0.1:8080", 1},
+		{
+			[]string{"example.com=127.0.0.1:8080", "*.example.com=127.0.0.1:8082", "example.com/api/=127.0.0.1:8081"},
+			"example.com=route-0:127.0.0.1:8080 example.com/api/=route-2:127.0.0.1:8081 *.example.com=route-1:127.0.0.1:8082",
+			2,
+		},
+		{[]string{"example.com"}, "", 0},
+		{[]string{"=127.0.0.1:8080"}, "", 0},
+		{[]string{"example.com=nohost"}, "", 0},
+		{nil, "", 0},
+	}
+
+	for i, c := range cases{
+		cfg, err := flagsConfig(":80", vhost.ModeKeepAlive, vhost.TimeoutConfig{}, 0, c.routes)
+		if c.expect == ""{
+			if err == nil{
+				t.Fatalf("case %d: expect error for %v", i, c.routes)
+			}
+			continue
+		}
+
+		if err != nil{
+			t.Fatalf("case %d: %v", i, err)
+		}
+		if got := describeRoutes(cfg); got != c.expect || len(cfg.Listeners[0].Hosts) != c.hosts{
+			t.Fatalf("case %d: expect %q with %d hosts, got %q with %d hosts", i, c.expect, c.hosts, got, len(cfg.Listeners[0].Hosts))
+		}
+	}//for
+}
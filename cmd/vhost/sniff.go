@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sort"
+
+	vhost "github.com/coderwf/go-virtual-host"
+)
+
+//读取抓包文件,打印每个连接的Host或者SNI
+//支持pcap格式(Ethernet、Linux cooked、raw IP),其他文件当作单个连接客户端发送的原始字节
+func sniff(args []string) error{
+	fs := flag.NewFlagSet("sniff", flag.ExitOnError)
+	_ = fs.Parse(args)
+
+	if fs.NArg() == 0{
+		return errors.New("capture file is required")
+	}
+
+	data, err := ioutil.ReadFile(fs.Arg(0))
+	if err != nil{
+		return err
+	}
+
+	flows, err := readPcap(data)
+	if err == errNotPcap{
+		kind, host, err := sniffStream(data)
+		if err != nil{
+			return err
+		}
+		fmt.Printf("%s %s\n", kind, host)
+		return nil
+	}
+
+	if err != nil{
+		return err
+	}
+
+	for _, flow := range flows{
+		kind, host, err := sniffStream(flow.payload.Bytes())
+		if err != nil{
+			//不是http或tls的连接直接跳过
+			continue
+		}
+		fmt.Printf("%s -> %s %s %s\n", flow.src, flow.dst, kind, host)
+	}
+
+	return nil
+}
+
+//tls记录以0x16开头,其他的按http解析
+func sniffStream(data []byte) (kind string, host string, err error){
+	if len(data) > 0 && data[0] == 0x16{
+		hello, err := vhost.ReadClientHello(bytes.NewReader(data))
+		if err != nil{
+			return "", "", err
+		}
+		return "tls", hello.ServerName, nil
+	}
+
+	request, err := vhost.ReadRequest(bytes.NewReader(data))
+	if err != nil{
+		return "", "", err
+	}
+	return "http", request.Header("Host"), nil
+}
+
+var errNotPcap = errors.New("not a pcap file")
+
+const (
+	linkEthernet = 1
+	linkRaw = 101
+	linkLinuxSLL = 113
+)
+
+//一个TCP连接中一个方向的数据
+type flow struct {
+	src string
+	dst string
+	first int
+	seqs map[uint32]bool
+	payload bytes.Buffer
+}
+
+func readPcap(data []byte) ([]*flow, error){
+	if len(data) < 24{
+		return nil, errNotPcap
+	}
+
+	var order binary.ByteOrder
+	switch binary.LittleEndian.Uint32(data[: 4]) {
+	case 0xa1b2c3d4, 0xa1b23c4d:
+		order = binary.LittleEndian
+	case 0xd4c3b2a1, 0x4d3cb2a1:
+		order = binary.BigEndian
+	default:
+		return nil, errNotPcap
+	}
+
+	link := order.Uint32(data[20: 24])
+	data = data[24: ]
+
+	flows := make(map[string]*flow)
+	index := 0
+
+	for len(data) >= 16{
+		capLen := int(order.Uint32(data[8: 12]))
+		if len(data) < 16 + capLen{
+			return nil, errors.New("truncated pcap record")
+		}
+
+		packet := data[16: 16 + capLen]
+		data = data[16 + capLen: ]
+		index++
+
+		ip, ok := linkPayload(link, packet)
+		if !ok{
+			continue
+		}
+
+		src, dst, seq, payload, ok := tcpPayload(ip)
+		if !ok || len(payload) == 0{
+			continue
+		}
+
+		key := src + "->" + dst
+		f, ok := flows[key]
+		if !ok{
+			f = &flow{src: src, dst: dst, first: index, seqs: make(map[uint32]bool)}
+			flows[key] = f
+		}
+
+		//丢弃重传的数据
+		if f.seqs[seq]{
+			continue
+		}
+		f.seqs[seq] = true
+		f.payload.Write(payload)
+	}//for
+
+	result := make([]*flow, 0, len(flows))
+	for _, f := range flows{
+		result = append(result, f)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].first < result[j].first
+	})
+
+	return result, nil
+}
+
+//去掉链路层头部,返回IP包
+func linkPayload(link uint32, packet []byte) ([]byte, bool){
+	var etherType uint16
+
+	switch link {
+	case linkRaw:
+		return packet, true
+	case linkEthernet:
+		if len(packet) < 14{
+			return nil, false
+		}
+		etherType, packet = binary.BigEndian.Uint16(packet[12: 14]), packet[14: ]
+		//802.1Q
+		if etherType == 0x8100 && len(packet) >= 4{
+			etherType, packet = binary.BigEndian.Uint16(packet[2: 4]), packet[4: ]
+		}
+	case linkLinuxSLL:
+		if len(packet) < 16{
+			return nil, false
+		}
+		etherType, packet = binary.BigEndian.Uint16(packet[14: 16]), packet[16: ]
+	default:
+		return nil, false
+	}
+
+	return packet, etherType == 0x0800 || etherType == 0x86dd
+}
+
+//解析IPv4/IPv6中的TCP数据
+func tcpPayload(ip []byte) (src string, dst string, seq uint32, payload []byte, ok bool){
+	if len(ip) < 1{
+		return
+	}
+
+	var (
+		srcIP net.IP
+		dstIP net.IP
+		tcp []byte
+	)
+
+	switch ip[0] >> 4 {
+	case 4:
+		if len(ip) < 20 || ip[9] != 6{
+			return
+		}
+		ihl := int(ip[0] & 0x0f) * 4
+		total := int(binary.BigEndian.Uint16(ip[2: 4]))
+		if total > len(ip) || total < ihl{
+			total = len(ip)
+		}
+		srcIP, dstIP, tcp = net.IP(ip[12: 16]), net.IP(ip[16: 20]), ip[ihl: total]
+	case 6:
+		//不处理扩展头
+		if len(ip) < 40 || ip[6] != 6{
+			return
+		}
+		length := int(binary.BigEndian.Uint16(ip[4: 6]))
+		if 40 + length > len(ip){
+			length = len(ip) - 40
+		}
+		srcIP, dstIP, tcp = net.IP(ip[8: 24]), net.IP(ip[24: 40]), ip[40: 40 + length]
+	default:
+		return
+	}
+
+	if len(tcp) < 20{
+		return
+	}
+
+	offset := int(tcp[12] >> 4) * 4
+	if offset < 20 || offset > len(tcp){
+		return
+	}
+
+	src = net.JoinHostPort(srcIP.String(), fmt.Sprint(binary.BigEndian.Uint16(tcp[0: 2])))
+	dst = net.JoinHostPort(dstIP.String(), fmt.Sprint(binary.BigEndian.Uint16(tcp[2: 4])))
+	seq = binary.BigEndian.Uint32(tcp[4: 8])
+	return src, dst, seq, tcp[offset: ], true
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+//内存中构造的小端pcap文件
+type pcapWriter struct {
+	bytes.Buffer
+}
+
+func newPcap(link uint32) *pcapWriter{
+	w := &pcapWriter{}
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0: 4], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(header[4: 6], 2)
+	binary.LittleEndian.PutUint16(header[6: 8], 4)
+	binary.LittleEndian.PutUint32(header[16: 20], 65535)
+	binary.LittleEndian.PutUint32(header[20: 24], link)
+	w.Write(header)
+	return w
+}
+
+func (w *pcapWriter) record(packet []byte){
+	header := make([]byte, 16)
+	binary.LittleEndian.PutUint32(header[8: 12], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(header[12: 16], uint32(len(packet)))
+	w.Write(header)
+	w.Write(packet)
+}
+
+func ethernet(etherType uint16, payload []byte) []byte{
+	frame := make([]byte, 14)
+	binary.BigEndian.PutUint16(frame[12: 14], etherType)
+	return append(frame, payload...)
+}
+
+func ipv4(proto byte, src, dst [4]byte, payload []byte) []byte{
+	ip := make([]byte, 20)
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2: 4], uint16(20 + len(payload)))
+	ip[9] = proto
+	copy(ip[12: 16], src[: ])
+	copy(ip[16: 20], dst[: ])
+	return append(ip, payload...)
+}
+
+func ipv6(src, dst [16]byte, payload []byte) []byte{
+	ip := make([]byte, 40)
+	ip[0] = 0x60
+	binary.BigEndian.PutUint16(ip[4: 6], uint16(len(payload)))
+	ip[6] = 6
+	copy(ip[8: 24], src[: ])
+	copy(ip[24: 40], dst[: ])
+	return append(ip, payload...)
+}
+
+func tcp(srcPort, dstPort uint16, seq uint32, payload string) []byte{
+	segment := make([]byte, 20)
+	binary.BigEndian.PutUint16(segment[0: 2], srcPort)
+	binary.BigEndian.PutUint16(segment[2: 4], dstPort)
+	binary.BigEndian.PutUint32(segment[4: 8], seq)
+	segment[12] = 5 << 4
+	return append(segment, payload...)
+}
+
+func TestReadPcap(t *testing.T) {
+	client, server := [4]byte{10, 0, 0, 1}, [4]byte{10, 0, 0, 2}
+	first, second := "GET / HTTP/1.1\r\nHost: exa", "mple.com\r\n\r\n"
+
+	w := newPcap(linkEthernet)
+	w.record(ethernet(0x0800, ipv4(6, client, server, tcp(40000, 80, 1, first))))
+	//重传的分段只保留一次
+	w.record(ethernet(0x0800, ipv4(6, client, server, tcp(40000, 80, 1, first))))
+	//UDP,ARP和截断的IP包都被跳过
+	w.record(ethernet(0x0800, ipv4(17, client, server, []byte("dns"))))
+	w.record(ethernet(0x0806, make([]byte, 28)))
+	w.record(ethernet(0x0800, []byte{0x45, 0, 0}))
+	//没有数据的ack不产生flow
+	w.record(ethernet(0x0800, ipv4(6, server, client, tcp(80, 40000, 1, ""))))
+	w.record(ethernet(0x0800, ipv4(6, client, server, tcp(40000, 80, uint32(1 + len(first)), second))))
+
+	flows, err := readPcap(w.Bytes())
+	if err != nil{
+		t.Fatal(err)
+	}
+	if len(flows) != 1 || flows[0].src != "10.0.0.1:40000" || flows[0].dst != "10.0.0.2:80"{
+		t.Fatalf("unexpected flows %+v", flows)
+	}
+	if got := flows[0].payload.String(); got != first + second{
+		t.Fatalf("unexpected payload %q", got)
+	}
+
+	kind, host, err := sniffStream(flows[0].payload.Bytes())
+	if err != nil || kind != "http" || host != "example.com"{
+		t.Fatalf("expect http example.com, got %s %s %v", kind, host, err)
+	}
+}
+
+func TestReadPcapRawIPv6(t *testing.T) {
+	var client, server [16]byte
+	client[15], server[15] = 1, 2
+
+	w := newPcap(linkRaw)
+	w.record(ipv6(client, server, tcp(40000, 443, 7, "hello")))
+
+	flows, err := readPcap(w.Bytes())
+	if err != nil{
+		t.Fatal(err)
+	}
+	if len(flows) != 1 || flows[0].src != "[::1]:40000" || flows[0].dst != "[::2]:443" || flows[0].payload.String() != "hello"{
+		t.Fatalf("unexpected flows %+v", flows)
+	}
+}
+
+func TestReadPcapInvalid(t *testing.T) {
+	if _, err := readPcap([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")); err != errNotPcap{
+		t.Fatalf("expect errNotPcap, got %v", err)
+	}
+	if _, err := readPcap(make([]byte, 10)); err != errNotPcap{
+		t.Fatalf("expect errNotPcap for short data, got %v", err)
+	}
+
+	w := newPcap(linkEthernet)
+	w.record(ethernet(0x0800, ipv4(6, [4]byte{10, 0, 0, 1}, [4]byte{10, 0, 0, 2}, tcp(40000, 80, 1, "GET /"))))
+	data := w.Bytes()
+	//最后一条记录声明的长度超过剩余数据
+	if _, err := readPcap(data[: len(data) - 3]); err == nil{
+		t.Fatal("expect error for truncated record")
+	}
+}
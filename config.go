@@ -0,0 +1,826 @@
+package go_virtual_host
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+//配置文件格式为JSON,例如:
+//
+//{
+//  "listeners": [
+//    {
+//      "listen": ":80",
+//      "mode": "keepalive",
+//      "forwarded": {"trusted_proxies": ["10.0.0.0/8"]},
+//      "hosts": [
+//        {"host": "example.com", "backend": "web", "routes": [
+//          {"path_prefix": "/api/", "strip_prefix": true, "backend": "api"}
+//        ]},
+//        {"host": "*.example.com", "backend": "web"}
+//      ]
+//    },
+//    {
+//      "listen": ":8080",
+//      "mode": "crack",
+//      "rewrites": [
+//        {"pattern": "^/old/(.*)$", "replacement": "/new/$1", "redirect": 301},
+//        {"pattern": "^/u/(\\d+)$", "replacement": "/user?id=$1", "last": true}
+//      ],
+//      "hosts": [{"host": "example.com", "backend": "web"}]
+//    },
+//    {"listen": ":443", "mode": "tls", "hosts": [{"host": "example.com", "backend": "web-tls"}]},
+//    {
+//      "listen": ":3128",
+//      "mode": "connect",
+//      "connect": {"users": {"alice": "secret"}, "allow_hosts": ["*.example.com"], "deny_networks": ["10.0.0.0/8"], "allow_sni": ["*.example.com"]}
+//    }
+//  ],
+//  "backends": {
+//    "web": {"addresses": ["10.0.0.1:8080", "10.0.0.2:8080"]},
+//    "api": {"addresses": ["10.0.1.1:8080"]},
+//    "web-tls": {"addresses": ["10.0.0.1:8443"]}
+//  },
+//  "timeouts": {"dial": "3s"},
+//  "access_log": {"path": "/var/log/vhost/access.log", "format": "combined", "max_bytes": 104857600, "max_backups": 5},
+//  "tracing": {"endpoint": "http://localhost:4318/v1/traces", "service_name": "vhost"}
+//}
+
+const (
+	ModeHttp = "http"
+	ModeCrack = "crack"
+	ModeKeepAlive = "keepalive"
+	ModeTls = "tls"
+	ModeConnect = "connect"
+)
+
+//JSON中使用"3s"、"500ms"这样的字符串
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error){
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error{
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil{
+		return fmt.Errorf("duration must be a string like \"3s\"")
+	}
+
+	v, err := time.ParseDuration(s)
+	if err != nil{
+		return err
+	}
+
+	*d = Duration(v)
+	return nil
+}
+
+type Config struct {
+	Listeners []*ListenerConfig `json:"listeners"`
+
+	//后端集群,按名字引用
+	Backends map[string]*BackendConfig `json:"backends"`
+
+	Timeouts TimeoutConfig `json:"timeouts"`
+
+	Limits LimitsConfig `json:"limits"`
+
+	//管理接口,为nil时不监听
+	Admin *AdminConfig `json:"admin,omitempty"`
+
+	//访问日志,为nil时不记录
+	AccessLog *AccessLogConfig `json:"access_log,omitempty"`
+
+	//crack模式下的tracing,为nil时不创建span
+	Tracing *TracingConfig `json:"tracing,omitempty"`
+}
+
+type AdminConfig struct {
+	Listen string `json:"listen"`
+}
+
+type AccessLogConfig struct {
+	//日志文件,为空或者"-"时写入标准输出
+	Path string `json:"path,omitempty"`
+
+	//json、common、combined或者text/template模板,默认为json
+	Format string `json:"format,omitempty"`
+
+	//文件超过MaxBytes时切分,0表示不切分,最多保留MaxBackups个旧文件
+	MaxBytes int64 `json:"max_bytes,omitempty"`
+	MaxBackups int `json:"max_backups,omitempty"`
+}
+
+//通过OTLP/HTTP导出span
+type TracingConfig struct {
+	//例如http://localhost:4318/v1/traces
+	Endpoint string `json:"endpoint"`
+
+	//默认为vhost
+	ServiceName string `json:"service_name,omitempty"`
+
+	//发送请求时附加的header,例如认证信息
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+func (t *TracingConfig) exporter() SpanExporter{
+	service := t.ServiceName
+	if service == ""{
+		service = "vhost"
+	}
+	return NewOTLPExporter(t.Endpoint, service, t.Headers)
+}
+
+//打开日志的输出,写入标准输出时返回的io.Closer为nil
+func (a *AccessLogConfig) open() (io.Writer, io.Closer, error){
+	if a.Path == "" || a.Path == "-"{
+		return os.Stdout, nil, nil
+	}
+
+	file, err := OpenRotatingFile(a.Path, a.MaxBytes, a.MaxBackups)
+	if err != nil{
+		return nil, nil, err
+	}
+	return file, file, nil
+}
+
+type ListenerConfig struct {
+	//为空时使用Listen
+	Name string `json:"name,omitempty"`
+
+	Listen string `json:"listen"`
+
+	//http、crack、keepalive、tls或者connect
+	Mode string `json:"mode"`
+
+	//连接后端后写入的PROXY protocol版本,0表示不写入
+	ProxyProtocol int `json:"proxy_protocol,omitempty"`
+
+	AcceptProxyProtocol bool `json:"accept_proxy_protocol,omitempty"`
+
+	//只用于crack和keepalive
+	Forwarded *ForwardedOptions `json:"forwarded,omitempty"`
+
+	//只用于crack和keepalive,对该listener上的所有请求生效
+	Headers *HeaderRules `json:"headers,omitempty"`
+
+	//只用于crack,在header重写之后按顺序执行
+	Rewrites []*RewriteRule `json:"rewrites,omitempty"`
+
+	//只用于connect,为空时只允许连接443端口
+	Connect *ConnectPolicy `json:"connect,omitempty"`
+
+	//connect模式下不使用
+	Hosts []*VirtualHostConfig `json:"hosts"`
+}
+
+type VirtualHostConfig struct {
+	//为空匹配任意host,支持*.example.com形式的通配
+	//tls模式下匹配SNI
+	Host string `json:"host"`
+
+	//没有匹配到routes时使用的后端
+	Backend string `json:"backend,omitempty"`
+
+	//只用于http、crack和keepalive
+	Routes []*RouteConfig `json:"routes,omitempty"`
+
+	//只用于crack和keepalive
+	Headers *HeaderRules `json:"headers,omitempty"`
+}
+
+type RouteConfig struct {
+	Path string `json:"path,omitempty"`
+	PathPrefix string `json:"path_prefix,omitempty"`
+	PathRegex string `json:"path_regex,omitempty"`
+	Methods []string `json:"methods,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	StripPrefix bool `json:"strip_prefix,omitempty"`
+	//只匹配WebSocket升级请求
+	WebSocket bool `json:"websocket,omitempty"`
+
+	//为空时使用所在VirtualHost的后端
+	Backend string `json:"backend,omitempty"`
+}
+
+const (
+	StrategyRoundRobin = "round_robin"
+	StrategyWeightedRoundRobin = "weighted_round_robin"
+	StrategyLeastConnections = "least_connections"
+	StrategyRandomTwoChoices = "random_two_choices"
+	StrategyConsistentHash = "consistent_hash"
+)
+
+//一致性哈希使用的key,cookie和header需要加上名字,例如"cookie:session"
+const (
+	HashKeyClientIP = "client_ip"
+	HashKeyHost = "host"
+	HashKeyCookie = "cookie:"
+	HashKeyHeader = "header:"
+)
+
+type BackendConfig struct {
+	Addresses []string `json:"addresses"`
+
+	//负载均衡策略,为空时使用round_robin
+	Strategy string `json:"strategy,omitempty"`
+
+	//只用于consistent_hash,为空时使用client_ip
+	HashKey string `json:"hash_key,omitempty"`
+
+	//地址对应的权重,没有设置的为1
+	Weights map[string]int `json:"weights,omitempty"`
+
+	HealthCheck *HealthCheckConfig `json:"health_check,omitempty"`
+
+	Outlier *OutlierConfig `json:"outlier_detection,omitempty"`
+
+	CircuitBreaker *CircuitBreakerConfig `json:"circuit_breaker,omitempty"`
+
+	//所有后端都不可用时使用的后端集群
+	Fallback string `json:"fallback,omitempty"`
+}
+
+type HealthCheckConfig struct {
+	//tcp、http或者tls,默认为tcp
+	Type string `json:"type,omitempty"`
+
+	Interval Duration `json:"interval,omitempty"`
+	Timeout Duration `json:"timeout,omitempty"`
+	Rise int `json:"rise,omitempty"`
+	Fall int `json:"fall,omitempty"`
+
+	Path string `json:"path,omitempty"`
+	Host string `json:"host,omitempty"`
+	ExpectStatus int `json:"expect_status,omitempty"`
+
+	ServerName string `json:"server_name,omitempty"`
+}
+
+func (h *HealthCheckConfig) healthCheck() HealthCheck{
+	return HealthCheck{
+		Type: h.Type,
+		Interval: time.Duration(h.Interval),
+		Timeout: time.Duration(h.Timeout),
+		Rise: h.Rise,
+		Fall: h.Fall,
+		Path: h.Path,
+		Host: h.Host,
+		ExpectStatus: h.ExpectStatus,
+		ServerName: h.ServerName,
+	}
+}
+
+type OutlierConfig struct {
+	//连续连接失败的次数
+	Failures int `json:"failures"`
+
+	//摘除的时间
+	Duration Duration `json:"duration"`
+}
+
+//没有设置的使用默认值,见CircuitBreakerSettings
+type CircuitBreakerConfig struct {
+	ConsecutiveFailures int `json:"consecutive_failures,omitempty"`
+	ErrorRate float64 `json:"error_rate,omitempty"`
+	MinRequests int `json:"min_requests,omitempty"`
+	Window Duration `json:"window,omitempty"`
+	OpenTimeout Duration `json:"open_timeout,omitempty"`
+	HalfOpenRequests int `json:"half_open_requests,omitempty"`
+	MaxConnections int64 `json:"max_connections,omitempty"`
+}
+
+func (c *CircuitBreakerConfig) settings() CircuitBreakerSettings{
+	return CircuitBreakerSettings{
+		ConsecutiveFailures: c.ConsecutiveFailures,
+		ErrorRate: c.ErrorRate,
+		MinRequests: c.MinRequests,
+		Window: time.Duration(c.Window),
+		OpenTimeout: time.Duration(c.OpenTimeout),
+		HalfOpenRequests: c.HalfOpenRequests,
+		MaxConnections: c.MaxConnections,
+	}
+}
+
+//0表示不超时,含义见Timeouts
+type TimeoutConfig struct {
+	//连接后端的超时时间
+	Dial Duration `json:"dial,omitempty"`
+	Header Duration `json:"header,omitempty"`
+	Idle Duration `json:"idle,omitempty"`
+	Lifetime Duration `json:"lifetime,omitempty"`
+}
+
+func (t TimeoutConfig) timeouts() Timeouts{
+	return Timeouts{
+		Header: time.Duration(t.Header),
+		Dial: time.Duration(t.Dial),
+		Idle: time.Duration(t.Idle),
+		Lifetime: time.Duration(t.Lifetime),
+	}
+}
+
+//0表示使用默认值,负数表示不限制,含义见PeekLimits
+type LimitsConfig struct {
+	MaxLineBytes int `json:"max_line_bytes,omitempty"`
+	MaxHeaderBytes int `json:"max_header_bytes,omitempty"`
+	MaxHeaders int `json:"max_headers,omitempty"`
+	MaxPeekBytes int `json:"max_peek_bytes,omitempty"`
+}
+
+func (l LimitsConfig) peekLimits() PeekLimits{
+	return PeekLimits{
+		MaxLineBytes: l.MaxLineBytes,
+		MaxHeaderBytes: l.MaxHeaderBytes,
+		MaxHeaders: l.MaxHeaders,
+		MaxPeekBytes: l.MaxPeekBytes,
+	}.withDefaults()
+}
+
+//请求头重写规则,按Remove、Rename、Set的顺序执行
+type HeaderRules struct {
+	Remove []string `json:"remove,omitempty"`
+	Rename map[string]string `json:"rename,omitempty"`
+	Set map[string]string `json:"set,omitempty"`
+}
+
+func (h *HeaderRules) apply(request *Request){
+	if h == nil{
+		return
+	}
+
+	for _, key := range h.Remove{
+		request.DelHeader(key)
+	}
+
+	for from, to := range h.Rename{
+		if value, ok := headerGet(request.header, from); ok{
+			request.DelHeader(from)
+			request.SetHeader(to, value)
+		}
+	}//for
+
+	for key, value := range h.Set{
+		request.SetHeader(key, value)
+	}
+}
+
+func (l *ListenerConfig) name() string{
+	if l.Name != ""{
+		return l.Name
+	}
+	return l.Listen
+}
+
+//读取并校验配置文件
+func LoadConfig(path string) (*Config, error){
+	data, err := ioutil.ReadFile(path)
+	if err != nil{
+		return nil, err
+	}
+
+	cfg, err := ParseConfig(data)
+	if err != nil{
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	return cfg, nil
+}
+
+//解析并校验配置,不允许出现未知的字段
+func ParseConfig(data []byte) (*Config, error){
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+
+	cfg := new(Config)
+	if err := decoder.Decode(cfg); err != nil{
+		return nil, jsonError(data, err)
+	}
+
+	if err := cfg.Validate(); err != nil{
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+//把json错误中的偏移量转换为行号和列号
+func jsonError(data []byte, err error) error{
+	var offset int64 = -1
+
+	switch e := err.(type) {
+	case *json.SyntaxError:
+		//Offset为读取出错字符之后的位置
+		offset = e.Offset - 1
+	case *json.UnmarshalTypeError:
+		offset = e.Offset
+		if e.Field != ""{
+			err = fmt.Errorf("%s: cannot use %s as %s", e.Field, e.Value, e.Type)
+		}
+	}
+
+	if offset < 0 || offset >= int64(len(data)){
+		return err
+	}
+
+	before := data[: offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	column := int(offset) - bytes.LastIndexByte(before, '\n')
+	return fmt.Errorf("line %d column %d: %v", line, column, err)
+}
+
+//校验时收集所有错误,每条错误带上字段路径
+type configErrors []string
+
+func (c *configErrors) add(path string, format string, values ...interface{}){
+	*c = append(*c, path + ": " + fmt.Sprintf(format, values...))
+}
+
+func (c configErrors) err() error{
+	if len(c) == 0{
+		return nil
+	}
+	return errors.New("invalid config:\n  " + strings.Join(c, "\n  "))
+}
+
+func validAddress(addr string) bool{
+	_, port, err := net.SplitHostPort(addr)
+	return err == nil && port != ""
+}
+
+func validHost(host string) bool{
+	host = strings.TrimPrefix(host, "*.")
+	if host == "" || strings.ContainsAny(host, "*/ :"){
+		return false
+	}
+	return true
+}
+
+func (c *Config) Validate() error{
+	var errs configErrors
+
+	if len(c.Listeners) == 0{
+		errs.add("listeners", "at least one listener is required")
+	}
+
+	//按名字排序,错误信息的顺序保持稳定
+	backendNames := make([]string, 0, len(c.Backends))
+	for name := range c.Backends{
+		backendNames = append(backendNames, name)
+	}
+	sort.Strings(backendNames)
+
+	for _, name := range backendNames{
+		backend := c.Backends[name]
+		path := fmt.Sprintf("backends.%s", name)
+		if backend == nil || len(backend.Addresses) == 0{
+			errs.add(path + ".addresses", "at least one address is required")
+			continue
+		}
+
+		addrs := make(map[string]bool, len(backend.Addresses))
+		for i, addr := range backend.Addresses{
+			if !validAddress(addr){
+				errs.add(fmt.Sprintf("%s.addresses[%d]", path, i), "invalid address %q, expect host:port", addr)
+			}
+			addrs[addr] = true
+		}
+
+		validateBalancer(&errs, path, backend, addrs)
+		validateHealth(&errs, path, backend)
+		validateBreaker(&errs, path, name, backend, c.Backends)
+	}//for
+
+	if c.Timeouts.Dial < 0{
+		errs.add("timeouts.dial", "must not be negative")
+	}
+	if c.Admin != nil && !validAddress(c.Admin.Listen){
+		errs.add("admin.listen", "invalid address %q, expect host:port", c.Admin.Listen)
+	}
+	if c.AccessLog != nil{
+		if _, err := newAccessLogFormatter(c.AccessLog.Format); err != nil{
+			errs.add("access_log.format", "%v", err)
+		}
+		if c.AccessLog.MaxBytes < 0{
+			errs.add("access_log.max_bytes", "must not be negative")
+		}
+		if c.AccessLog.MaxBackups < 0{
+			errs.add("access_log.max_backups", "must not be negative")
+		}
+	}
+	if c.Tracing != nil{
+		if u, err := url.Parse(c.Tracing.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == ""{
+			errs.add("tracing.endpoint", "invalid endpoint %q, expect http(s)://host:port/v1/traces", c.Tracing.Endpoint)
+		}
+	}
+
+	if c.Timeouts.Header < 0{
+		errs.add("timeouts.header", "must not be negative")
+	}
+	if c.Timeouts.Idle < 0{
+		errs.add("timeouts.idle", "must not be negative")
+	}
+	if c.Timeouts.Lifetime < 0{
+		errs.add("timeouts.lifetime", "must not be negative")
+	}
+
+	names := make(map[string]int)
+	addrs := make(map[string]int)
+
+	for i, l := range c.Listeners{
+		path := fmt.Sprintf("listeners[%d]", i)
+		if l == nil{
+			errs.add(path, "listener is empty")
+			continue
+		}
+
+		if prev, ok := names[l.name()]; ok{
+			errs.add(path + ".name", "duplicate name %q, already used by listeners[%d]", l.name(), prev)
+		}
+		names[l.name()] = i
+
+		if !validAddress(l.Listen){
+			errs.add(path + ".listen", "invalid address %q, expect host:port", l.Listen)
+		}else if prev, ok := addrs[l.Listen]; ok{
+			errs.add(path + ".listen", "address %q already used by listeners[%d]", l.Listen, prev)
+		}
+		addrs[l.Listen] = i
+
+		c.validateListener(&errs, path, l)
+	}//for
+
+	return errs.err()
+}
+
+func (c *Config) validateListener(errs *configErrors, path string, l *ListenerConfig){
+	switch l.Mode {
+	case ModeHttp, ModeCrack, ModeKeepAlive, ModeTls, ModeConnect:
+	default:
+		errs.add(path + ".mode", "unknown mode %q, expect one of http, crack, keepalive, tls, connect", l.Mode)
+	}
+
+	rewrite := l.Mode == ModeCrack || l.Mode == ModeKeepAlive
+
+	if l.ProxyProtocol != 0 && l.ProxyProtocol != 1 && l.ProxyProtocol != 2{
+		errs.add(path + ".proxy_protocol", "unsupported version %d, expect 0, 1 or 2", l.ProxyProtocol)
+	}
+
+	if l.Forwarded != nil{
+		if !rewrite{
+			errs.add(path + ".forwarded", "only supported in crack and keepalive mode")
+		}else if _, err := parseCIDRs(l.Forwarded.TrustedProxies); err != nil{
+			errs.add(path + ".forwarded.trusted_proxies", "%v", err)
+		}
+	}
+
+	if l.Headers != nil && !rewrite{
+		errs.add(path + ".headers", "only supported in crack and keepalive mode")
+	}
+
+	if len(l.Rewrites) > 0 && l.Mode != ModeCrack{
+		errs.add(path + ".rewrites", "only supported in crack mode")
+	}
+	for i, r := range l.Rewrites{
+		rPath := fmt.Sprintf("%s.rewrites[%d]", path, i)
+		if r == nil{
+			errs.add(rPath, "rewrite rule is empty")
+			continue
+		}
+		if err := r.compile(); err != nil{
+			errs.add(rPath, "%v", err)
+		}
+	}//for
+
+	if l.Connect != nil{
+		if l.Mode != ModeConnect{
+			errs.add(path + ".connect", "only supported in connect mode")
+		}else if err := l.Connect.compile(); err != nil{
+			errs.add(path + ".connect", "%v", err)
+		}
+	}
+
+	//connect模式下按CONNECT的目的地址连接,不需要hosts
+	if l.Mode == ModeConnect{
+		if len(l.Hosts) > 0{
+			errs.add(path + ".hosts", "not supported in connect mode")
+		}
+		return
+	}
+
+	if len(l.Hosts) == 0{
+		errs.add(path + ".hosts", "at least one host is required")
+	}
+
+	hosts := make(map[string]int)
+	for i, h := range l.Hosts{
+		hPath := fmt.Sprintf("%s.hosts[%d]", path, i)
+		if h == nil{
+			errs.add(hPath, "host is empty")
+			continue
+		}
+
+		if h.Host != "" && !validHost(h.Host){
+			errs.add(hPath + ".host", "invalid host %q", h.Host)
+		}
+
+		key := strings.ToLower(h.Host)
+		if prev, ok := hosts[key]; ok{
+			errs.add(hPath + ".host", "duplicate host %q, already defined in hosts[%d]", h.Host, prev)
+		}
+		hosts[key] = i
+
+		if h.Backend == "" && len(h.Routes) == 0{
+			errs.add(hPath, "backend or routes is required")
+		}
+		c.validateBackendRef(errs, hPath + ".backend", h.Backend)
+
+		if h.Headers != nil && !rewrite{
+			errs.add(hPath + ".headers", "only supported in crack and keepalive mode")
+		}
+
+		if len(h.Routes) > 0 && l.Mode == ModeTls{
+			errs.add(hPath + ".routes", "not supported in tls mode")
+			continue
+		}
+
+		for j, r := range h.Routes{
+			rPath := fmt.Sprintf("%s.routes[%d]", hPath, j)
+			if r == nil{
+				errs.add(rPath, "route is empty")
+				continue
+			}
+			validateRoute(errs, rPath, r)
+
+			if r.Backend == "" && h.Backend == ""{
+				errs.add(rPath + ".backend", "backend is required when host has no default backend")
+			}
+			c.validateBackendRef(errs, rPath + ".backend", r.Backend)
+		}//for
+	}//for
+}
+
+func (c *Config) validateBackendRef(errs *configErrors, path string, name string){
+	if name == ""{
+		return
+	}
+
+	if _, ok := c.Backends[name]; !ok{
+		errs.add(path, "unknown backend %q", name)
+	}
+}
+
+func validateBalancer(errs *configErrors, path string, backend *BackendConfig, addrs map[string]bool){
+	switch backend.Strategy {
+	case "", StrategyRoundRobin, StrategyWeightedRoundRobin, StrategyLeastConnections, StrategyRandomTwoChoices, StrategyConsistentHash:
+	default:
+		errs.add(path + ".strategy", "unknown strategy %q, expect one of round_robin, weighted_round_robin, least_connections, random_two_choices, consistent_hash", backend.Strategy)
+	}
+
+	if backend.HashKey != ""{
+		key := backend.HashKey
+		switch {
+		case backend.Strategy != StrategyConsistentHash:
+			errs.add(path + ".hash_key", "only supported by consistent_hash strategy")
+		case key == HashKeyClientIP || key == HashKeyHost:
+		case (strings.HasPrefix(key, HashKeyCookie) && len(key) > len(HashKeyCookie)) ||
+			(strings.HasPrefix(key, HashKeyHeader) && len(key) > len(HashKeyHeader)):
+		default:
+			errs.add(path + ".hash_key", "unknown hash key %q, expect client_ip, host, cookie:<name> or header:<name>", key)
+		}
+	}
+
+	for addr, weight := range backend.Weights{
+		if !addrs[addr]{
+			errs.add(path + ".weights", "address %q is not in addresses", addr)
+		}
+		if weight <= 0{
+			errs.add(path + ".weights", "weight of %q must be positive", addr)
+		}
+	}//for
+}
+
+func validateHealth(errs *configErrors, path string, backend *BackendConfig){
+	if hc := backend.HealthCheck; hc != nil{
+		hPath := path + ".health_check"
+
+		switch hc.Type {
+		case "", HealthCheckTCP, HealthCheckHTTP, HealthCheckTLS:
+		default:
+			errs.add(hPath + ".type", "unknown type %q, expect one of tcp, http, tls", hc.Type)
+		}
+
+		if hc.Interval < 0{
+			errs.add(hPath + ".interval", "must not be negative")
+		}
+		if hc.Timeout < 0{
+			errs.add(hPath + ".timeout", "must not be negative")
+		}
+		if hc.Rise < 0{
+			errs.add(hPath + ".rise", "must not be negative")
+		}
+		if hc.Fall < 0{
+			errs.add(hPath + ".fall", "must not be negative")
+		}
+
+		if hc.Type != HealthCheckHTTP && (hc.Path != "" || hc.Host != "" || hc.ExpectStatus != 0){
+			errs.add(hPath, "path, host and expect_status are only supported by http check")
+		}
+		if hc.Path != "" && !strings.HasPrefix(hc.Path, "/"){
+			errs.add(hPath + ".path", "must start with /")
+		}
+		if hc.ExpectStatus != 0 && (hc.ExpectStatus < 100 || hc.ExpectStatus > 999){
+			errs.add(hPath + ".expect_status", "invalid status %d", hc.ExpectStatus)
+		}
+		if hc.Type != HealthCheckTLS && hc.ServerName != ""{
+			errs.add(hPath + ".server_name", "only supported by tls check")
+		}
+	}//if
+
+	if o := backend.Outlier; o != nil{
+		if o.Failures <= 0{
+			errs.add(path + ".outlier_detection.failures", "must be positive")
+		}
+		if o.Duration <= 0{
+			errs.add(path + ".outlier_detection.duration", "must be positive")
+		}
+	}
+}
+
+func validateBreaker(errs *configErrors, path string, name string, backend *BackendConfig, backends map[string]*BackendConfig){
+	if cb := backend.CircuitBreaker; cb != nil{
+		cPath := path + ".circuit_breaker"
+
+		if cb.ConsecutiveFailures < 0{
+			errs.add(cPath + ".consecutive_failures", "must not be negative")
+		}
+		if cb.ErrorRate < 0 || cb.ErrorRate > 1{
+			errs.add(cPath + ".error_rate", "must be between 0 and 1")
+		}
+		if cb.MinRequests < 0{
+			errs.add(cPath + ".min_requests", "must not be negative")
+		}
+		if cb.Window < 0{
+			errs.add(cPath + ".window", "must not be negative")
+		}
+		if cb.OpenTimeout < 0{
+			errs.add(cPath + ".open_timeout", "must not be negative")
+		}
+		if cb.HalfOpenRequests < 0{
+			errs.add(cPath + ".half_open_requests", "must not be negative")
+		}
+		if cb.MaxConnections < 0{
+			errs.add(cPath + ".max_connections", "must not be negative")
+		}
+	}//if
+
+	if backend.Fallback != ""{
+		if backend.Fallback == name{
+			errs.add(path + ".fallback", "must not be the backend itself")
+		}else if _, ok := backends[backend.Fallback]; !ok{
+			errs.add(path + ".fallback", "unknown backend %q", backend.Fallback)
+		}
+	}
+}
+
+func validateRoute(errs *configErrors, path string, r *RouteConfig){
+	n := 0
+	for _, p := range []string{r.Path, r.PathPrefix, r.PathRegex}{
+		if p != ""{
+			n++
+		}
+	}
+
+	if n > 1{
+		errs.add(path, "only one of path, path_prefix and path_regex can be set")
+	}
+
+	if r.Path != "" && !strings.HasPrefix(r.Path, "/"){
+		errs.add(path + ".path", "must start with /")
+	}
+
+	if r.PathPrefix != "" && !strings.HasPrefix(r.PathPrefix, "/"){
+		errs.add(path + ".path_prefix", "must start with /")
+	}
+
+	if r.PathRegex != ""{
+		if _, err := regexp.Compile(r.PathRegex); err != nil{
+			errs.add(path + ".path_regex", "%v", err)
+		}
+	}
+
+	if r.StripPrefix && r.PathPrefix == ""{
+		errs.add(path + ".strip_prefix", "requires path_prefix")
+	}
+}
@@ -0,0 +1,480 @@
+package go_virtual_host
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//由配置生成的单个listener的路由
+type listenerRouter struct {
+	cfg *ListenerConfig
+	table *RouteTable
+	pools map[string]*BackendPool
+	//路由所属VirtualHost的header重写规则
+	headers map[*Route]*HeaderRules
+	forwarded func(*Request) *Request
+	//crack模式下的URL重写
+	rewriter Middleware
+	//connect模式下的访问控制
+	connect *ConnectPolicy
+	timeouts Timeouts
+	limits PeekLimits
+	//由Manager设置
+	metrics *Metrics
+	accessLog *AccessLog
+	tracer *Tracer
+}
+
+//由配置生成负载均衡策略
+func newBalancer(backend *BackendConfig) Balancer{
+	switch backend.Strategy {
+	case StrategyWeightedRoundRobin:
+		return WeightedRoundRobin()
+	case StrategyLeastConnections:
+		return LeastConnections()
+	case StrategyRandomTwoChoices:
+		return RandomTwoChoices()
+	case StrategyConsistentHash:
+		return ConsistentHash(newHashKey(backend.HashKey))
+	}
+	return RoundRobin()
+}
+
+func newHashKey(key string) HashKey{
+	switch {
+	case key == HashKeyHost:
+		return HashHost
+	case strings.HasPrefix(key, HashKeyCookie):
+		return HashCookie(strings.TrimPrefix(key, HashKeyCookie))
+	case strings.HasPrefix(key, HashKeyHeader):
+		return HashHeader(strings.TrimPrefix(key, HashKeyHeader))
+	}
+	return HashClientIP
+}
+
+func newConfigPools(cfg *Config) map[string]*BackendPool{
+	pools := make(map[string]*BackendPool, len(cfg.Backends))
+	for name, backend := range cfg.Backends{
+		pool := NewBackendPool(newBalancer(backend))
+		pool.SetDialTimeout(time.Duration(cfg.Timeouts.Dial))
+
+		for _, addr := range backend.Addresses{
+			pool.Add(NewBackend(addr, backend.Weights[addr]))
+		}
+
+		if backend.Outlier != nil{
+			pool.SetOutlierDetection(OutlierDetection{
+				Failures: backend.Outlier.Failures,
+				Duration: time.Duration(backend.Outlier.Duration),
+			})
+		}
+		if backend.CircuitBreaker != nil{
+			pool.SetCircuitBreaker(backend.CircuitBreaker.settings())
+		}
+		pools[name] = pool
+	}
+
+	//所有pool创建之后才能设置fallback
+	for name, backend := range cfg.Backends{
+		if backend.Fallback != ""{
+			pools[name].SetFallback(pools[backend.Fallback])
+		}
+	}
+	return pools
+}
+
+//开始配置中的主动健康检查,返回的函数用于停止所有检查
+func startHealthChecks(cfg *Config, pools map[string]*BackendPool) (stop func()){
+	var stops []func()
+	for name, backend := range cfg.Backends{
+		if backend.HealthCheck != nil{
+			stops = append(stops, pools[name].StartHealthCheck(backend.HealthCheck.healthCheck()))
+		}
+	}
+
+	return func() {
+		for _, s := range stops{
+			s()
+		}
+	}
+}
+
+func newListenerRouter(cfg *Config, l *ListenerConfig, pools map[string]*BackendPool) (*listenerRouter, error){
+	router := &listenerRouter{
+		cfg: l,
+		table: NewRouteTable(),
+		pools: pools,
+		headers: make(map[*Route]*HeaderRules),
+		timeouts: cfg.Timeouts.timeouts(),
+		limits: cfg.Limits.peekLimits(),
+	}
+
+	rewriter, err := NewRewriter(l.Rewrites...)
+	if err != nil{
+		return nil, err
+	}
+	router.rewriter = rewriter
+
+	if l.Mode == ModeConnect{
+		router.connect = l.Connect
+		if router.connect == nil{
+			router.connect = &ConnectPolicy{}
+		}
+		if err := router.connect.compile(); err != nil{
+			return nil, err
+		}
+	}
+
+	if l.Forwarded != nil{
+		handler, err := NewForwardedHandler(*l.Forwarded, nil)
+		if err != nil{
+			return nil, err
+		}
+		router.forwarded = handler
+	}
+
+	for _, h := range l.Hosts{
+		for _, r := range h.Routes{
+			route := &Route{
+				Host: h.Host,
+				Path: r.Path,
+				PathPrefix: r.PathPrefix,
+				PathRegex: r.PathRegex,
+				Methods: r.Methods,
+				Headers: r.Headers,
+				StripPrefix: r.StripPrefix,
+				WebSocket: r.WebSocket,
+				Backend: r.Backend,
+			}
+
+			if route.Backend == ""{
+				route.Backend = h.Backend
+			}
+
+			if err := router.add(route, h.Headers); err != nil{
+				return nil, err
+			}
+		}//for
+
+		//没有匹配到任何路径时使用host的默认后端
+		if h.Backend != ""{
+			if err := router.add(&Route{Host: h.Host, Backend: h.Backend}, h.Headers); err != nil{
+				return nil, err
+			}
+		}
+	}//for
+
+	return router, nil
+}
+
+func (r *listenerRouter) add(route *Route, headers *HeaderRules) error{
+	if err := r.table.Add(route); err != nil{
+		return err
+	}
+
+	r.headers[route] = headers
+	return nil
+}
+
+//匹配路由并从后端集群中选择一个后端,需要时去掉路径前缀
+//keepalive模式下通过选择的后端建立连接,同一地址在不同集群中的连接数分别统计
+func (r *listenerRouter) pick(request *Request) (*Backend, error){
+	route, ok := r.table.Match(request)
+	if !ok{
+		return nil, errNoRoute
+	}
+
+	pool, ok := r.pools[route.Backend]
+	if !ok{
+		return nil, fmt.Errorf("unknown backend %q", route.Backend)
+	}
+
+	b, err := pool.Pick(request)
+	if err != nil{
+		return nil, err
+	}
+
+	if route.StripPrefix{
+		request.stripPathPrefix(route.PathPrefix)
+	}
+
+	return b, nil
+}
+
+func (r *listenerRouter) getProxy(request *Request) (net.Conn, error){
+	route, ok := r.table.Match(request)
+	if !ok{
+		return nil, errNoRoute
+	}
+
+	pool, ok := r.pools[route.Backend]
+	if !ok{
+		return nil, fmt.Errorf("unknown backend %q", route.Backend)
+	}
+
+	return pool.Dial(request)
+}
+
+func (r *listenerRouter) getTlsProxy(hello *ClientHello) (net.Conn, error){
+	return r.getProxy(helloRequest(hello))
+}
+
+//按照配置重写请求头
+//keepalive模式下由route去掉路径前缀,crack模式下由routeMiddleware去掉
+func (r *listenerRouter) requestHandler() func(*Request) *Request{
+	return func(request *Request) *Request {
+		if r.forwarded != nil{
+			request = r.forwarded(request)
+		}
+
+		r.cfg.Headers.apply(request)
+
+		route, ok := r.table.Match(request)
+		if !ok{
+			return request
+		}
+
+		r.headers[route].apply(request)
+		return request
+	}
+}
+
+func (r *listenerRouter) options() []Option{
+	opts := []Option{WithTimeouts(r.timeouts), WithPeekLimits(r.limits)}
+
+	if r.cfg.ProxyProtocol != 0{
+		opts = append(opts, WithProxyProtocol(r.cfg.ProxyProtocol))
+	}
+
+	if r.cfg.AcceptProxyProtocol{
+		opts = append(opts, WithAcceptProxyProtocol())
+	}
+
+	if r.metrics != nil{
+		opts = append(opts, WithMetrics(r.metrics))
+	}
+
+	if r.accessLog != nil{
+		opts = append(opts, WithAccessLog(r.accessLog))
+	}
+
+	if r.tracer != nil{
+		opts = append(opts, WithTracer(r.tracer))
+	}
+
+	return opts
+}
+
+//代理通过routerHolder使用路由,重新加载配置时替换其中的router
+//已经建立的连接不受影响,新的连接使用新的router
+type routerHolder struct {
+	v atomic.Value
+}
+
+func newRouterHolder(r *listenerRouter) *routerHolder{
+	h := &routerHolder{}
+	h.set(r)
+	return h
+}
+
+func (h *routerHolder) router() *listenerRouter{
+	return h.v.Load().(*listenerRouter)
+}
+
+func (h *routerHolder) set(r *listenerRouter){
+	h.v.Store(r)
+}
+
+func (h *routerHolder) getProxy(request *Request) (net.Conn, error){
+	return h.router().getProxy(request)
+}
+
+func (h *routerHolder) getTlsProxy(hello *ClientHello) (net.Conn, error){
+	return h.router().getTlsProxy(hello)
+}
+
+func (h *routerHolder) pick(request *Request) (*Backend, error){
+	return h.router().pick(request)
+}
+
+func (h *routerHolder) requestHandler() func(*Request) *Request{
+	return func(request *Request) *Request {
+		return h.router().requestHandler()(request)
+	}
+}
+
+//crack模式下去掉路径前缀,连接上的请求只能转发到第一个请求选择的后端
+func (h *routerHolder) matchRoute(request *Request) (*Route, bool){
+	return h.router().table.Match(request)
+}
+
+//重写规则随配置重新加载
+func (h *routerHolder) rewrite(next RequestHandler) RequestHandler{
+	return func(ctx *ConnContext, request *Request) (*Request, *DirectResponse, error) {
+		return h.router().rewriter(next)(ctx, request)
+	}
+}
+
+//CONNECT的访问控制随配置重新加载
+func (h *routerHolder) connectPolicy() *ConnectPolicy{
+	return h.router().connect
+}
+
+//listen地址、模式和PROXY protocol设置在代理创建时确定,修改后需要重新监听
+func (h *routerHolder) newProxy(listener net.Listener) *Proxy{
+	r := h.router()
+	opts := r.options()
+
+	switch r.cfg.Mode {
+	case ModeHttp:
+		proxy := newProxy(listener, "http-proxy", opts)
+		proxy.converter = &httpConverter{getProxy: h.getProxy}
+		return proxy
+	case ModeCrack:
+		proxy := newProxy(listener, "crack-proxy", append(opts, WithMiddleware(routeMiddleware(h.matchRoute), h.rewrite)))
+		proxy.converter = &crackConverter{getProxy: h.getProxy, handlerRequest: h.requestHandler()}
+		return proxy
+	case ModeTls:
+		proxy := newProxy(listener, "tls-proxy", opts)
+		proxy.converter = &tlsConverter{getProxy: h.getTlsProxy}
+		return proxy
+	case ModeConnect:
+		proxy := newProxy(listener, "connect-proxy", opts)
+		proxy.converter = &connectConverter{policy: h.connectPolicy}
+		return proxy
+	}
+
+	proxy := newProxy(listener, "keepalive-proxy", opts)
+	proxy.session = &keepAliveServer{
+		pick: h.pick,
+		handlerRequest: h.requestHandler(),
+		dial: defaultDial,
+	}
+	return proxy
+}
+
+//生成配置中所有listener的路由,同一份配置中的后端集群是共享的
+func newListenerRouters(cfg *Config) ([]*listenerRouter, map[string]*BackendPool, error){
+	pools := newConfigPools(cfg)
+	routers := make([]*listenerRouter, 0, len(cfg.Listeners))
+
+	for i, l := range cfg.Listeners{
+		router, err := newListenerRouter(cfg, l, pools)
+		if err != nil{
+			return nil, nil, fmt.Errorf("listeners[%d]: %v", i, err)
+		}
+		routers = append(routers, router)
+	}//for
+
+	return routers, pools, nil
+}
+
+//校验配置并监听所有listener,生成对应的代理
+//stop关闭所有listener,停止健康检查并关闭访问日志文件,已经建立的连接不受影响
+func NewServersFromConfig(cfg *Config) (servers []Server, stop func(), err error){
+	if err = cfg.Validate(); err != nil{
+		return nil, nil, err
+	}
+
+	routers, pools, err := newListenerRouters(cfg)
+	if err != nil{
+		return nil, nil, err
+	}
+
+	var accessFile io.Closer
+	if cfg.AccessLog != nil{
+		w, file, err := cfg.AccessLog.open()
+		if err != nil{
+			return nil, nil, fmt.Errorf("access_log: %v", err)
+		}
+		accessFile = file
+
+		accessLog, err := NewAccessLog(w, cfg.AccessLog.Format)
+		if err != nil{
+			if accessFile != nil{
+				_ = accessFile.Close()
+			}
+			return nil, nil, fmt.Errorf("access_log: %v", err)
+		}
+		for _, router := range routers{
+			router.accessLog = accessLog
+		}
+	}
+
+	if cfg.Tracing != nil{
+		tracer := NewTracer(cfg.Tracing.exporter())
+		for _, router := range routers{
+			router.tracer = tracer
+		}
+	}
+
+	servers = make([]Server, 0, len(routers))
+	listeners := make([]net.Listener, 0, len(routers))
+	closeAll := func() {
+		for _, listener := range listeners{
+			_ = listener.Close()
+		}
+		if accessFile != nil{
+			_ = accessFile.Close()
+		}
+	}
+
+	for i, router := range routers{
+		listener, err := net.Listen("tcp", router.cfg.Listen)
+		if err != nil{
+			closeAll()
+			return nil, nil, fmt.Errorf("listeners[%d].listen: %v", i, err)
+		}
+
+		listeners = append(listeners, listener)
+		servers = append(servers, newRouterHolder(router).newProxy(listener))
+	}//for
+
+	stopHealthChecks := startHealthChecks(cfg, pools)
+	var once sync.Once
+	return servers, func() {
+		once.Do(func() {
+			stopHealthChecks()
+			closeAll()
+		})
+	}, nil
+}
+
+//单个listener生效的路由
+type ListenerRoutes struct {
+	Name string
+	Listen string
+	Mode string
+
+	//按添加顺序排列,匹配时选择优先级最高的
+	Routes []*Route
+}
+
+//配置生成的所有路由,Route.Backend为后端集群的名字
+func RoutesFromConfig(cfg *Config) ([]ListenerRoutes, error){
+	if err := cfg.Validate(); err != nil{
+		return nil, err
+	}
+
+	routers, _, err := newListenerRouters(cfg)
+	if err != nil{
+		return nil, err
+	}
+
+	routes := make([]ListenerRoutes, 0, len(routers))
+	for _, router := range routers{
+		routes = append(routes, ListenerRoutes{
+			Name: router.cfg.name(),
+			Listen: router.cfg.Listen,
+			Mode: router.cfg.Mode,
+			Routes: router.table.Routes(),
+		})
+	}
+
+	return routes, nil
+}
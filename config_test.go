@@ -0,0 +1,121 @@
+package go_virtual_host
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+const testConfig = `{
+  "listeners": [
+    {
+      "listen": "127.0.0.1:0",
+      "mode": "keepalive",
+      "hosts": [
+        {"host": "example.com", "backend": "web", "routes": [
+          {"path_prefix": "/api/", "strip_prefix": true, "backend": "api"}
+        ]}
+      ]
+    }
+  ],
+  "backends": {
+    "web": {"addresses": ["127.0.0.1:8080"]},
+    "api": {"addresses": ["127.0.0.1:8081", "127.0.0.1:8082"]}
+  },
+  "timeouts": {"dial": "3s"}
+}`
+
+func TestParseConfig(t *testing.T) {
+	cfg, err := ParseConfig([]byte(testConfig))
+	if err != nil{
+		t.Fatal(err)
+	}
+
+	router, err := newListenerRouter(cfg, cfg.Listeners[0], newConfigPools(cfg))
+	if err != nil{
+		t.Fatal(err)
+	}
+
+	request := &Request{Method: "GET", URI: "/api/users", Version: "HTTP/1.1"}
+	request.SetHeader("Host", "example.com")
+	b, err := router.pick(request)
+	if err != nil || b.Addr != "127.0.0.1:8081" || request.URI != "/users"{
+		t.Fatalf("unexpected route result %v %s %v", b, request.URI, err)
+	}
+}
+
+//同一地址出现在两个后端集群中,keepalive模式下连接记录在选择的集群的后端上
+func TestKeepAliveDialsPickedPool(t *testing.T) {
+	backend := startBackend(t, "a")
+	defer backend.Close()
+
+	cfg, err := ParseConfig([]byte(`{
+		"listeners": [{"listen": "127.0.0.1:0", "mode": "keepalive", "hosts": [{"backend": "web", "routes": [
+			{"path_prefix": "/api/", "backend": "api"}
+		]}]}],
+		"backends": {
+			"web": {"addresses": ["` + backend.Addr().String() + `"]},
+			"api": {"addresses": ["` + backend.Addr().String() + `"]}
+		}
+	}`))
+	if err != nil{
+		t.Fatal(err)
+	}
+
+	routers, pools, err := newListenerRouters(cfg)
+	if err != nil{
+		t.Fatal(err)
+	}
+	proxy := newRouterHolder(routers[0]).newProxy(getListener("127.0.0.1:0"))
+	defer proxy.Close()
+	proxy.AsyncStart()
+
+	conn, err := net.Dial("tcp", proxy.Addr().String())
+	if err != nil{
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, body := roundTrip(t, conn, NewTextReader(conn), "GET /api/x HTTP/1.1\r\nHost: a\r\n\r\n"); body != "a /api/x"{
+		t.Fatalf("unexpected body %q", body)
+	}
+	if api, web := pools["api"].Backends()[0].Active(), pools["web"].Backends()[0].Active(); api != 1 || web != 0{
+		t.Fatalf("expect the api backend to hold the connection, got api %d web %d", api, web)
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	cases := map[string]string{
+		`{"listeners": [{"listen": ":80", "mode": "ftp", "hosts": [{"backend": "web"}]}], "backends": {"web": {"addresses": [":1"]}}}`:
+			`listeners[0].mode: unknown mode "ftp"`,
+		`{"listeners": [{"listen": ":80", "mode": "http", "hosts": [{"host": "a.com", "routes": [{"path": "/x"}]}]}]}`:
+			`listeners[0].hosts[0].routes[0].backend: backend is required`,
+		`{"listeners": [{"listen": ":80", "mode": "tls", "hosts": [{"host": "a.com", "backend": "nope"}]}]}`:
+			`listeners[0].hosts[0].backend: unknown backend "nope"`,
+		`{"listeners": [{"listen": ":80", "mode": "http", "hosts": [{"backend": "web"}]}], "backends": {"web": {"addresses": ["nohost"]}}}`:
+			`backends.web.addresses[0]: invalid address "nohost"`,
+		"{\n  \"listeners\": [}":
+			`line 2 column 17`,
+		`{"listeners": [], "unknown": 1}`:
+			`unknown field "unknown"`,
+		`{"listeners": [{"listen": ":80", "mode": "http", "hosts": [{"backend": "web"}]}], "backends": {"web": {"addresses": [":1"]}}, "access_log": {"format": "{{.Host"}}`:
+			`access_log.format: invalid access log template`,
+		`{"listeners": [{"listen": ":80", "mode": "crack", "hosts": [{"backend": "web"}]}], "backends": {"web": {"addresses": [":1"]}}, "tracing": {"endpoint": "localhost:4318"}}`:
+			`tracing.endpoint: invalid endpoint "localhost:4318"`,
+		`{"listeners": [{"listen": ":80", "mode": "keepalive", "rewrites": [{"pattern": "^/a", "replacement": "/b"}], "hosts": [{"backend": "web"}]}], "backends": {"web": {"addresses": [":1"]}}}`:
+			`listeners[0].rewrites: only supported in crack mode`,
+		`{"listeners": [{"listen": ":80", "mode": "crack", "rewrites": [{"pattern": "^/a", "replacement": "/b", "redirect": 303}, {"pattern": "(", "replacement": "/b"}], "hosts": [{"backend": "web"}]}], "backends": {"web": {"addresses": [":1"]}}}`:
+			`listeners[0].rewrites[0]: unsupported redirect status 303`,
+		`{"listeners": [{"listen": ":80", "mode": "tls", "connect": {}, "hosts": [{"backend": "web"}]}], "backends": {"web": {"addresses": [":1"]}}}`:
+			`listeners[0].connect: only supported in connect mode`,
+		`{"listeners": [{"listen": ":80", "mode": "connect", "connect": {"deny_networks": ["10.0.0.0/33"]}, "hosts": [{"backend": "web"}]}], "backends": {"web": {"addresses": [":1"]}}}`:
+			`listeners[0].hosts: not supported in connect mode`,
+	}
+
+	for data, expect := range cases{
+		_, err := ParseConfig([]byte(data))
+		if err == nil || !strings.Contains(err.Error(), expect){
+			t.Fatalf("expect error containing %q, got %v", expect, err)
+		}
+	}
+}
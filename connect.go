@@ -0,0 +1,286 @@
+package go_virtual_host
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+//CONNECT隧道的访问控制,各个字段都为空时只允许连接任意host的443端口
+type ConnectPolicy struct {
+	//用户名到密码,不为空时要求Proxy-Authorization使用Basic认证
+	Users map[string]string `json:"users,omitempty"`
+
+	//允许的目的host,支持*.example.com形式的通配,为空时允许任意host
+	AllowHosts []string `json:"allow_hosts,omitempty"`
+
+	//拒绝的目的host,优先于AllowHosts
+	DenyHosts []string `json:"deny_hosts,omitempty"`
+
+	//拒绝连接的IP或者CIDR,按域名解析之后实际连接的地址判断
+	DenyNetworks []string `json:"deny_networks,omitempty"`
+
+	//允许的目的端口,为空时只允许443
+	AllowPorts []int `json:"allow_ports,omitempty"`
+
+	//按隧道中ClientHello的SNI过滤,规则同AllowHosts和DenyHosts
+	//设置了SNI规则时隧道中必须是带SNI的TLS,否则连接会被关闭
+	AllowSNI []string `json:"allow_sni,omitempty"`
+	DenySNI []string `json:"deny_sni,omitempty"`
+
+	//SNI必须和CONNECT的host相同
+	MatchSNI bool `json:"match_sni,omitempty"`
+
+	networks []*net.IPNet
+}
+
+var (
+	errConnectAuth = errors.New("proxy authentication required")
+	errConnectDenied = errors.New("connect destination denied")
+	errSNIDenied = errors.New("tunneled server name denied")
+)
+
+func (cp *ConnectPolicy) compile() (err error){
+	for _, patterns := range [][]string{cp.AllowHosts, cp.DenyHosts, cp.AllowSNI, cp.DenySNI}{
+		for _, pattern := range patterns{
+			if !validHost(pattern){
+				return fmt.Errorf("invalid host pattern %q", pattern)
+			}
+		}
+	}//for
+
+	for _, port := range cp.AllowPorts{
+		if port <= 0 || port > 65535{
+			return fmt.Errorf("invalid port %d", port)
+		}
+	}
+
+	cp.networks, err = parseCIDRs(cp.DenyNetworks)
+	return
+}
+
+//host匹配任意一个pattern,pattern支持*.example.com形式的通配
+func matchHostPatterns(patterns []string, host string) bool{
+	for _, pattern := range patterns{
+		if (&Route{Host: pattern}).hostScore(host) >= 0{
+			return true
+		}
+	}
+	return false
+}
+
+//检查Proxy-Authorization中的用户名和密码,没有设置Users时总是通过
+func (cp *ConnectPolicy) authorize(request *Request) bool{
+	if len(cp.Users) == 0{
+		return true
+	}
+
+	const prefix = "Basic "
+	auth := request.Header("Proxy-Authorization")
+	if len(auth) <= len(prefix) || !strings.EqualFold(auth[: len(prefix)], prefix){
+		return false
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(auth[len(prefix): ]))
+	if err != nil{
+		return false
+	}
+
+	i := strings.IndexByte(string(decoded), ':')
+	if i < 0{
+		return false
+	}
+
+	password, ok := cp.Users[string(decoded[: i])]
+	return ok && subtle.ConstantTimeCompare(decoded[i + 1: ], []byte(password)) == 1
+}
+
+func (cp *ConnectPolicy) allowDestination(host string, port int) bool{
+	if len(cp.AllowPorts) == 0{
+		if port != 443{
+			return false
+		}
+	}else{
+		allowed := false
+		for _, p := range cp.AllowPorts{
+			allowed = allowed || p == port
+		}
+		if !allowed{
+			return false
+		}
+	}
+
+	if matchHostPatterns(cp.DenyHosts, host){
+		return false
+	}
+	return len(cp.AllowHosts) == 0 || matchHostPatterns(cp.AllowHosts, host)
+}
+
+//是否需要读取隧道中的ClientHello
+func (cp *ConnectPolicy) peekSNI() bool{
+	return len(cp.AllowSNI) > 0 || len(cp.DenySNI) > 0 || cp.MatchSNI
+}
+
+func (cp *ConnectPolicy) allowSNI(serverName string, host string) bool{
+	if serverName == "" || matchHostPatterns(cp.DenySNI, serverName){
+		return false
+	}
+	if len(cp.AllowSNI) > 0 && !matchHostPatterns(cp.AllowSNI, serverName){
+		return false
+	}
+	return !cp.MatchSNI || strings.EqualFold(serverName, host)
+}
+
+//连接之前按实际的IP检查DenyNetworks,避免通过域名访问被拒绝的网络
+func (cp *ConnectPolicy) control(network string, address string, _ syscall.RawConn) error{
+	host, _, err := net.SplitHostPort(address)
+	if err != nil{
+		return err
+	}
+
+	ip := net.ParseIP(host)
+	for _, n := range cp.networks{
+		if ip != nil && n.Contains(ip){
+			return errConnectDenied
+		}
+	}
+	return nil
+}
+
+func (cp *ConnectPolicy) dial(address string) (net.Conn, error){
+	dialer := &net.Dialer{}
+	if len(cp.networks) > 0{
+		dialer.Control = cp.control
+	}
+	return dialer.Dial("tcp", address)
+}
+
+//解析CONNECT的host:port
+func splitConnectTarget(target string) (string, int, error){
+	host, p, err := net.SplitHostPort(target)
+	if err != nil{
+		return "", 0, err
+	}
+
+	port, err := strconv.Atoi(p)
+	if err != nil || port <= 0 || port > 65535 || host == ""{
+		return "", 0, fmt.Errorf("invalid connect target %q", target)
+	}
+	return strings.ToLower(host), port, nil
+}
+
+//CONNECT建立的隧道,读取时先返回解析请求时多读的数据
+type ConnectConn struct {
+	net.Conn
+	//CONNECT请求,URI为host:port
+	Request *Request
+	clientHello *ClientHello
+}
+
+//隧道中的ClientHello,没有设置SNI规则时为nil
+func (c *ConnectConn) ClientHello() *ClientHello{
+	return c.clientHello
+}
+
+type connectConverter struct {
+	//重新加载配置时返回新的策略
+	policy func() *ConnectPolicy
+}
+
+func (c *connectConverter) convert(p *Proxy, conn net.Conn) (net.Conn, net.Conn, error){
+	tr := newLimitedTextReader(conn, p.PeekLimits())
+	request, err := tr.ReadRequest()
+	if err != nil{
+		p.metrics.parseError(p.label(), err)
+		status := writeParseError(conn, err)
+		return nil, nil, responded(status, fmt.Errorf("parse connect request from %s error: %w", conn.RemoteAddr().String(), err))
+	}
+
+	policy := c.policy()
+
+	if request.Method != "CONNECT"{
+		response := Respond(405, "only CONNECT is supported\n")
+		response.Header["Allow"] = "CONNECT"
+		_ = response.write(conn)
+		return nil, nil, responded(405, fmt.Errorf("unsupported method %s from %s", request.Method, conn.RemoteAddr().String()))
+	}
+
+	host, port, err := splitConnectTarget(request.URI)
+	if err != nil{
+		_ = Respond(400, "invalid connect target\n").write(conn)
+		return nil, nil, responded(400, err)
+	}
+
+	if !policy.authorize(request){
+		response := Respond(407, "proxy authentication required\n")
+		response.Header["Proxy-Authenticate"] = `Basic realm="proxy"`
+		_ = response.write(conn)
+		return nil, nil, responded(407, errConnectAuth)
+	}
+
+	if !policy.allowDestination(host, port){
+		_ = Respond(403, "destination not allowed\n").write(conn)
+		return nil, nil, responded(403, fmt.Errorf("%w: %s", errConnectDenied, request.URI))
+	}
+
+	proxy, err := p.dialBackend(func() (net.Conn, error) {
+		return policy.dial(request.URI)
+	})
+	if errors.Is(err, errConnectDenied){
+		_ = Respond(403, "destination not allowed\n").write(conn)
+		return nil, nil, responded(403, fmt.Errorf("%w: %s", errConnectDenied, request.URI))
+	}
+	if err != nil{
+		return nil, nil, responded(writeBackendError(conn, err), err)
+	}
+
+	if _, err = io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil{
+		_ = proxy.Close()
+		return nil, nil, err
+	}
+
+	tunnel := &ConnectConn{Conn: &bufioConn{Conn: conn, tr: tr}, Request: request}
+	if !policy.peekSNI(){
+		return tunnel, proxy, nil
+	}
+
+	//已经响应了200,SNI不符合时只能关闭连接
+	tlsConn, err := newTlsConn(tunnel.Conn, p.PeekLimits())
+	if err != nil{
+		_ = proxy.Close()
+		p.metrics.parseError(p.label(), err)
+		return nil, nil, responded(200, fmt.Errorf("parse tunneled client hello from %s error: %w", conn.RemoteAddr().String(), err))
+	}
+
+	if !policy.allowSNI(tlsConn.clientHello.ServerName, host){
+		_ = proxy.Close()
+		return nil, nil, responded(200, fmt.Errorf("%w: %q for %s", errSNIDenied, tlsConn.clientHello.ServerName, request.URI))
+	}
+
+	tunnel.Conn, tunnel.clientHello = tlsConn, tlsConn.clientHello
+	return tunnel, proxy, nil
+}
+
+//正向代理,只处理CONNECT请求,响应200之后透传隧道中的数据
+//policy为nil时只允许连接443端口,policy不合法时panic
+func NewConnectProxy(listen string, policy *ConnectPolicy, opts ...Option) Server{
+	if policy == nil{
+		policy = &ConnectPolicy{}
+	}
+	if err := policy.compile(); err != nil{
+		panic(err)
+	}
+
+	proxy := newProxy(getListener(listen), "connect-proxy", opts)
+	proxy.converter = &connectConverter{policy: func() *ConnectPolicy {
+		return policy
+	}}
+
+	return proxy
+}
@@ -0,0 +1,226 @@
+package go_virtual_host
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestConnectPolicy(t *testing.T) {
+	policy := &ConnectPolicy{
+		Users: map[string]string{"alice": "secret"},
+		AllowHosts: []string{"*.example.com", "example.org"},
+		DenyHosts: []string{"admin.example.com"},
+		AllowPorts: []int{443, 8443},
+		AllowSNI: []string{"*.example.com"},
+		MatchSNI: true,
+	}
+	if err := policy.compile(); err != nil{
+		t.Fatal(err)
+	}
+
+	auth := func(value string) *Request {
+		request := &Request{Method: "CONNECT", URI: "a.example.com:443"}
+		if value != ""{
+			request.SetHeader("Proxy-Authorization", value)
+		}
+		return request
+	}
+	basic := func(credentials string) string {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(credentials))
+	}
+
+	for value, expect := range map[string]bool{
+		basic("alice:secret"): true,
+		"basic " + base64.StdEncoding.EncodeToString([]byte("alice:secret")): true,
+		basic("alice:wrong"): false,
+		basic("bob:secret"): false,
+		basic("alice"): false,
+		"Bearer token": false,
+		"": false,
+	}{
+		if policy.authorize(auth(value)) != expect{
+			t.Fatalf("authorize %q: expect %v", value, expect)
+		}
+	}//for
+
+	destinations := []struct{
+		host string
+		port int
+		expect bool
+	}{
+		{"a.example.com", 443, true},
+		{"a.example.com", 8443, true},
+		{"a.example.com", 22, false},
+		{"admin.example.com", 443, false},
+		{"example.org", 443, true},
+		{"example.net", 443, false},
+	}
+	for _, d := range destinations{
+		if policy.allowDestination(d.host, d.port) != d.expect{
+			t.Fatalf("destination %s:%d: expect %v", d.host, d.port, d.expect)
+		}
+	}//for
+
+	if !policy.allowSNI("a.example.com", "a.example.com") || policy.allowSNI("b.example.com", "a.example.com") ||
+		policy.allowSNI("", "a.example.com"){
+		t.Fatal("unexpected sni policy")
+	}
+
+	//默认只允许443端口
+	if !(&ConnectPolicy{}).allowDestination("example.com", 443) || (&ConnectPolicy{}).allowDestination("example.com", 80){
+		t.Fatal("unexpected default policy")
+	}
+
+	for _, p := range []*ConnectPolicy{
+		{AllowHosts: []string{"a b"}},
+		{AllowPorts: []int{70000}},
+		{DenyNetworks: []string{"10.0.0.0/33"}},
+	}{
+		if err := p.compile(); err == nil{
+			t.Fatalf("expect error for %+v", p)
+		}
+	}
+}
+
+//TLS握手之后按行回显
+func startTlsEchoBackend(t *testing.T) net.Listener{
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{selfSignedCert(t)}})
+	if err != nil{
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil{
+				return
+			}
+
+			go func(conn net.Conn) {
+				defer conn.Close()
+				line, err := bufio.NewReader(conn).ReadString('\n')
+				if err != nil{
+					return
+				}
+				_, _ = io.WriteString(conn, "echo " + line)
+			}(conn)
+		}
+	}()
+
+	return listener
+}
+
+//发送CONNECT请求并返回响应
+func connectTo(t *testing.T, proxy *Proxy, request string) (net.Conn, *Response){
+	conn, err := net.Dial("tcp", proxy.Addr().String())
+	if err != nil{
+		t.Fatal(err)
+	}
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err = io.WriteString(conn, request); err != nil{
+		t.Fatal(err)
+	}
+	response, err := NewTextReader(conn).ReadResponse()
+	if err != nil{
+		t.Fatal(err)
+	}
+	return conn, response
+}
+
+func TestConnectTunnel(t *testing.T) {
+	backend := startTlsEchoBackend(t)
+	defer backend.Close()
+	_, port, _ := net.SplitHostPort(backend.Addr().String())
+
+	p, _ := strconv.Atoi(port)
+	proxy := NewConnectProxy("127.0.0.1:0", &ConnectPolicy{
+		Users: map[string]string{"alice": "secret"},
+		AllowPorts: []int{p},
+		AllowSNI: []string{"*.example.com"},
+	}).(*Proxy)
+	defer proxy.Close()
+	proxy.AsyncStart()
+
+	auth := "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte("alice:secret")) + "\r\n"
+	target := backend.Addr().String()
+
+	cases := []struct{
+		request string
+		status int
+	}{
+		{"CONNECT " + target + " HTTP/1.1\r\nHost: " + target + "\r\n\r\n", 407},
+		{"GET / HTTP/1.1\r\nHost: a\r\n" + auth + "\r\n", 405},
+		{"CONNECT 127.0.0.1:1 HTTP/1.1\r\n" + auth + "\r\n", 403},
+		{"CONNECT nohost HTTP/1.1\r\n" + auth + "\r\n", 400},
+	}
+	for i, c := range cases{
+		conn, response := connectTo(t, proxy, c.request)
+		conn.Close()
+		if response.StatusCode != c.status{
+			t.Fatalf("case %d: expect %d, got %d", i, c.status, response.StatusCode)
+		}
+		if c.status == 407 && response.Header("Proxy-Authenticate") == ""{
+			t.Fatalf("case %d: missing Proxy-Authenticate", i)
+		}
+	}//for
+
+	tunnel := func(serverName string) (string, error) {
+		conn, response := connectTo(t, proxy, "CONNECT " + target + " HTTP/1.1\r\n" + auth + "\r\n")
+		defer conn.Close()
+		if response.StatusCode != 200{
+			t.Fatalf("expect 200, got %d", response.StatusCode)
+		}
+
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+		if _, err := io.WriteString(tlsConn, "hello\n"); err != nil{
+			return "", err
+		}
+		return bufio.NewReader(tlsConn).ReadString('\n')
+	}
+
+	if line, err := tunnel("a.example.com"); err != nil || line != "echo hello\n"{
+		t.Fatalf("unexpected tunnel response %q %v", line, err)
+	}
+
+	//SNI不允许时关闭隧道,握手失败
+	if _, err := tunnel("other.com"); err == nil{
+		t.Fatal("expect handshake error for denied sni")
+	}
+}
+
+func TestConnectConfig(t *testing.T) {
+	backend := startTlsEchoBackend(t)
+	defer backend.Close()
+	_, port, _ := net.SplitHostPort(backend.Addr().String())
+
+	cfg, err := ParseConfig([]byte(`{
+		"listeners": [{"listen": "127.0.0.1:0", "mode": "connect",
+			"connect": {"allow_ports": [` + port + `], "deny_networks": ["127.0.0.0/8", "::1"]}}]
+	}`))
+	if err != nil{
+		t.Fatal(err)
+	}
+
+	servers, stop, err := NewServersFromConfig(cfg)
+	if err != nil{
+		t.Fatal(err)
+	}
+	defer stop()
+	proxy := servers[0].(*Proxy)
+	defer proxy.Close()
+	proxy.AsyncStart()
+
+	//域名解析之后按实际地址拒绝
+	conn, response := connectTo(t, proxy, "CONNECT localhost:" + port + " HTTP/1.1\r\n\r\n")
+	conn.Close()
+	if response.StatusCode != 403{
+		t.Fatalf("expect 403, got %d", response.StatusCode)
+	}
+}
@@ -0,0 +1,128 @@
+package go_virtual_host
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//进程内唯一的连接id
+var connIDs uint64
+
+//正在处理的连接
+type connEntry struct {
+	id uint64
+	//accept得到的连接,关闭时结束整个代理过程
+	conn net.Conn
+	started time.Time
+
+	mu sync.Mutex
+	client string
+	host string
+	backend string
+
+	//客户端到后端和后端到客户端的字节数
+	bytesIn int64
+	bytesOut int64
+}
+
+//连接的信息,由管理接口输出
+type ConnInfo struct {
+	ID uint64 `json:"id"`
+	Listener string `json:"listener,omitempty"`
+	Client string `json:"client"`
+	Host string `json:"host"`
+	Backend string `json:"backend"`
+
+	//使用splice转发的方向在结束后才计入
+	BytesIn int64 `json:"bytes_in"`
+	BytesOut int64 `json:"bytes_out"`
+
+	Started time.Time `json:"started"`
+	Age Duration `json:"age"`
+}
+
+func (e *connEntry) setClient(client string){
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.client = client
+}
+
+//keepalive模式下每个请求都会更新
+func (e *connEntry) setRoute(host string, backend string){
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.host, e.backend = host, backend
+}
+
+func (e *connEntry) info() ConnInfo{
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return ConnInfo{
+		ID: e.id,
+		Client: e.client,
+		Host: e.host,
+		Backend: e.backend,
+		BytesIn: atomic.LoadInt64(&e.bytesIn),
+		BytesOut: atomic.LoadInt64(&e.bytesOut),
+		Started: e.started,
+		Age: Duration(time.Since(e.started).Truncate(time.Millisecond)),
+	}
+}
+
+func (p *Proxy) register(conn net.Conn) *connEntry{
+	e := &connEntry{
+		id: atomic.AddUint64(&connIDs, 1),
+		conn: conn,
+		started: time.Now(),
+		client: conn.RemoteAddr().String(),
+	}
+
+	p.activeMu.Lock()
+	defer p.activeMu.Unlock()
+	p.active[e.id] = e
+	return e
+}
+
+func (p *Proxy) unregister(e *connEntry){
+	p.activeMu.Lock()
+	defer p.activeMu.Unlock()
+	delete(p.active, e.id)
+}
+
+//正在处理的连接,按id排序
+func (p *Proxy) Connections() []ConnInfo{
+	p.activeMu.Lock()
+	entries := make([]*connEntry, 0, len(p.active))
+	for _, e := range p.active{
+		entries = append(entries, e)
+	}
+	p.activeMu.Unlock()
+
+	infos := make([]ConnInfo, 0, len(entries))
+	for _, e := range entries{
+		infos = append(infos, e.info())
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ID < infos[j].ID
+	})
+	return infos
+}
+
+//关闭客户端连接,后端连接随之关闭,连接不存在时返回false
+func (p *Proxy) CloseConnection(id uint64) bool{
+	p.activeMu.Lock()
+	e, ok := p.active[id]
+	p.activeMu.Unlock()
+
+	if !ok{
+		return false
+	}
+
+	p.logLn("close conn %d from %s", id, e.info().Client)
+	_ = e.conn.Close()
+	return true
+}
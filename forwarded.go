@@ -0,0 +1,182 @@
+package go_virtual_host
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+//代理转发时需要处理的header
+var forwardedHeaders = []string{
+	"X-Forwarded-For",
+	"X-Forwarded-Proto",
+	"X-Forwarded-Host",
+	"X-Real-IP",
+	"Forwarded",
+}
+
+type ForwardedOptions struct {
+	//客户端访问代理使用的协议,为空时为http
+	Proto string `json:"proto,omitempty"`
+
+	//受信任的上游代理网段(CIDR或者单个IP)
+	//直连的客户端在其中时保留并追加已有的转发信息,否则先删除客户端伪造的转发头
+	TrustedProxies []string `json:"trusted_proxies,omitempty"`
+}
+
+type forwarded struct {
+	proto string
+	trusted []*net.IPNet
+}
+
+//解析CIDR列表,单个IP按/32或/128处理
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error){
+	nets := make([]*net.IPNet, 0, len(cidrs))
+
+	for _, cidr := range cidrs{
+		if !strings.Contains(cidr, "/"){
+			ip := net.ParseIP(cidr)
+			if ip == nil{
+				return nil, fmt.Errorf("invalid ip %q", cidr)
+			}
+
+			bits := 128
+			if ip.To4() != nil{
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil{
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}//for
+
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool{
+	if ip == nil{
+		return false
+	}
+
+	for _, ipNet := range nets{
+		if ipNet.Contains(ip){
+			return true
+		}
+	}
+	return false
+}
+
+//RemoteAddr中的ip部分
+func remoteIP(remoteAddr string) string{
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil{
+		return remoteAddr
+	}
+	return host
+}
+
+//RFC 7239中node的格式,IPv6需要加上中括号和引号
+func forwardedNode(ip string) string{
+	if strings.Contains(ip, ":"){
+		return fmt.Sprintf("\"[%s]\"", ip)
+	}
+	return ip
+}
+
+//RFC 7239中value包含特殊字符时需要使用quoted-string
+//按RFC 7230只转义\和",控制字符不能出现在header中直接去掉
+func forwardedValue(value string) string{
+	token := true
+	for _, c := range value{
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("!#$%&'*+-.^_`|~", c)){
+			token = false
+			break
+		}
+	}
+	if token{
+		return value
+	}
+
+	var quoted strings.Builder
+	quoted.WriteByte('"')
+	for i := 0; i < len(value); i++{
+		c := value[i]
+		switch {
+		case c == '\\' || c == '"':
+			quoted.WriteByte('\\')
+		case c < 0x20 && c != '\t' || c == 0x7f:
+			continue
+		}
+		quoted.WriteByte(c)
+	}//for
+	quoted.WriteByte('"')
+	return quoted.String()
+}
+
+func appendHeader(request *Request, key string, value string){
+	if old := request.Header(key); old != ""{
+		value = old + ", " + value
+	}
+	request.SetHeader(key, value)
+}
+
+func (f *forwarded) handle(request *Request){
+	ip := remoteIP(request.RemoteAddr)
+	trusted := containsIP(f.trusted, net.ParseIP(ip))
+
+	if !trusted{
+		for _, key := range forwardedHeaders{
+			request.DelHeader(key)
+		}
+	}
+
+	host := request.Header("Host")
+
+	appendHeader(request, "X-Forwarded-For", ip)
+
+	if request.Header("X-Forwarded-Proto") == ""{
+		request.SetHeader("X-Forwarded-Proto", f.proto)
+	}
+
+	if request.Header("X-Forwarded-Host") == "" && host != ""{
+		request.SetHeader("X-Forwarded-Host", host)
+	}
+
+	if request.Header("X-Real-IP") == ""{
+		request.SetHeader("X-Real-IP", ip)
+	}
+
+	element := fmt.Sprintf("for=%s;proto=%s", forwardedNode(ip), f.proto)
+	if host != ""{
+		element = fmt.Sprintf("%s;host=%s", element, forwardedValue(host))
+	}
+	appendHeader(request, "Forwarded", element)
+}
+
+//生成添加X-Forwarded-For/X-Forwarded-Proto/X-Forwarded-Host/X-Real-IP/Forwarded的请求处理函数
+//可以作为NewCrackProxy或NewKeepAliveProxy的handlerRequest,next可以为nil
+func NewForwardedHandler(opts ForwardedOptions, next func(*Request) *Request) (func(*Request) *Request, error){
+	trusted, err := parseCIDRs(opts.TrustedProxies)
+	if err != nil{
+		return nil, err
+	}
+
+	f := &forwarded{proto: opts.Proto, trusted: trusted}
+	if f.proto == ""{
+		f.proto = "http"
+	}
+
+	return func(request *Request) *Request {
+		f.handle(request)
+
+		if next != nil{
+			request = next(request)
+		}
+		return request
+	}, nil
+}
@@ -0,0 +1,70 @@
+package go_virtual_host
+
+import "testing"
+
+func TestForwardedHandler(t *testing.T) {
+	handler, err := NewForwardedHandler(ForwardedOptions{Proto: "https", TrustedProxies: []string{"10.0.0.0/8"}}, nil)
+	if err != nil{
+		t.Fatal(err)
+	}
+
+	//不受信任的客户端伪造的转发头被删除
+	request := &Request{Method: "GET", URI: "/", Version: "HTTP/1.1", RemoteAddr: "1.2.3.4:5678"}
+	request.SetHeader("Host", "example.com")
+	request.SetHeader("X-Forwarded-For", "6.6.6.6")
+	request.SetHeader("x-real-ip", "6.6.6.6")
+	request = handler(request)
+
+	expect := map[string]string{
+		"X-Forwarded-For": "1.2.3.4",
+		"X-Forwarded-Proto": "https",
+		"X-Forwarded-Host": "example.com",
+		"X-Real-IP": "1.2.3.4",
+		"Forwarded": "for=1.2.3.4;proto=https;host=example.com",
+	}
+	for key, value := range expect{
+		if got := request.Header(key); got != value{
+			t.Fatalf("%s: expect %q, got %q", key, value, got)
+		}
+	}
+
+	//不在10.0.0.0/8中的IPv6客户端同样重置转发头,Forwarded中的地址加上引号和方括号
+	request = &Request{Method: "GET", URI: "/", Version: "HTTP/1.1", RemoteAddr: "[2001:db8::1]:80"}
+	request.SetHeader("Host", "example.com")
+	request.SetHeader("X-Forwarded-For", "6.6.6.6")
+	request = handler(request)
+	if got := request.Header("X-Forwarded-For"); got != "2001:db8::1"{
+		t.Fatalf("expect peer outside trusted proxies to reset X-Forwarded-For, got %q", got)
+	}
+	if got := request.Header("Forwarded"); got != `for="[2001:db8::1]";proto=https;host=example.com`{
+		t.Fatalf("unexpected Forwarded %q", got)
+	}
+
+	//10.0.0.0/8中受信任的代理保留已有的转发信息
+	request = &Request{Method: "GET", URI: "/", Version: "HTTP/1.1", RemoteAddr: "10.1.1.1:80"}
+	request.SetHeader("X-Forwarded-For", "6.6.6.6")
+	request.SetHeader("X-Forwarded-Proto", "http")
+	request = handler(request)
+	if got := request.Header("X-Forwarded-For"); got != "6.6.6.6, 10.1.1.1"{
+		t.Fatalf("expect appended X-Forwarded-For, got %q", got)
+	}
+	if got := request.Header("X-Forwarded-Proto"); got != "http"{
+		t.Fatalf("expect kept X-Forwarded-Proto, got %q", got)
+	}
+}
+
+func TestForwardedValue(t *testing.T) {
+	cases := map[string]string{
+		"example.com": "example.com",
+		"example.com:8080": `"example.com:8080"`,
+		`a"b\c`: `"a\"b\\c"`,
+		//%q会把非ASCII和制表符转义成Go的写法,quoted-string中应原样保留
+		"例子.com\t": "\"例子.com\t\"",
+		"a\r\nb\x00\x7f:1": `"ab:1"`,
+	}
+	for value, expect := range cases{
+		if got := forwardedValue(value); got != expect{
+			t.Fatalf("%q: expect %s, got %s", value, expect, got)
+		}
+	}
+}
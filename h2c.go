@@ -0,0 +1,204 @@
+package go_virtual_host
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+)
+
+//HTTP/2 prior knowledge的连接前言,按HTTP/1读取时得到请求行PRI * HTTP/2.0和空的header
+const h2Preface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+const (
+	h2FrameHeaders = 0x1
+	h2FramePriority = 0x2
+	h2FrameSettings = 0x4
+	h2FrameWindowUpdate = 0x8
+	h2FrameContinuation = 0x9
+
+	h2FlagEndHeaders = 0x4
+	h2FlagPadded = 0x8
+	h2FlagPriority = 0x20
+
+	//对端没有通过SETTINGS修改时帧的最大长度
+	h2MaxFrameSize = 16384
+	//HEADERS之前最多跳过的帧数
+	h2MaxLeadingFrames = 16
+)
+
+var errH2Frame = errors.New("unexpected http2 frame")
+
+//是否为prior knowledge连接前言的前半部分
+func isH2Preface(request *Request) bool{
+	return request.Method == "PRI" && request.URI == "*" && request.Version == "HTTP/2.0"
+}
+
+type h2Frame struct {
+	typ byte
+	flags byte
+	stream uint32
+	payload []byte
+}
+
+func (tr *TextReader) readH2Frame() (*h2Frame, error){
+	var head [9]byte
+	if _, err := io.ReadFull(tr.br, head[: ]); err != nil{
+		return nil, err
+	}
+
+	length := int(head[0]) << 16 | int(head[1]) << 8 | int(head[2])
+	if length > h2MaxFrameSize{
+		return nil, errH2Frame
+	}
+
+	frame := &h2Frame{
+		typ: head[3],
+		flags: head[4],
+		stream: binary.BigEndian.Uint32(head[5: ]) & 0x7fffffff,
+		payload: make([]byte, length),
+	}
+	if _, err := io.ReadFull(tr.br, frame.payload); err != nil{
+		return nil, err
+	}
+	return frame, nil
+}
+
+//在PRI * HTTP/2.0之后读取连接前言剩余的部分、SETTINGS和第一个请求的HEADERS
+//把伪header转换为HTTP/1的请求行,:authority作为Host,字节仍然原样转发
+func (tr *TextReader) readH2Request() (*Request, error){
+	for _, expect := range []string{"SM", ""}{
+		line, err := tr.Readline()
+		if err != nil{
+			return nil, err
+		}
+		if line != expect{
+			return nil, unexpectHttpMsg
+		}
+	}//for
+
+	//客户端的第一帧必须是SETTINGS
+	frame, err := tr.readH2Frame()
+	if err != nil{
+		return nil, err
+	}
+	if frame.typ != h2FrameSettings || frame.stream != 0{
+		return nil, errH2Frame
+	}
+
+	for i := 0; ; i++{
+		if i >= h2MaxLeadingFrames{
+			return nil, errH2Frame
+		}
+		if frame, err = tr.readH2Frame(); err != nil{
+			return nil, err
+		}
+
+		switch frame.typ {
+		case h2FrameSettings, h2FrameWindowUpdate, h2FramePriority:
+			continue
+		case h2FrameHeaders:
+			return tr.readH2Headers(frame)
+		}
+		return nil, errH2Frame
+	}//for
+}
+
+//读取HEADERS和之后的CONTINUATION,解码得到请求
+func (tr *TextReader) readH2Headers(frame *h2Frame) (*Request, error){
+	block, err := h2HeaderBlockFragment(frame)
+	if err != nil{
+		return nil, err
+	}
+
+	for frame.flags & h2FlagEndHeaders == 0{
+		stream := frame.stream
+		if frame, err = tr.readH2Frame(); err != nil{
+			return nil, err
+		}
+		if frame.typ != h2FrameContinuation || frame.stream != stream{
+			return nil, errH2Frame
+		}
+
+		block = append(block, frame.payload...)
+		if err = exceeded(LimitHeaderBytes, tr.limits.MaxHeaderBytes, len(block)); err != nil{
+			return nil, err
+		}
+	}//for
+
+	fields, err := newHpackDecoder().decode(block)
+	if err != nil{
+		return nil, err
+	}
+	if err = exceeded(LimitHeaders, tr.limits.MaxHeaders, len(fields)); err != nil{
+		return nil, err
+	}
+
+	return h2Request(fields)
+}
+
+//去掉HEADERS中的填充和优先级
+func h2HeaderBlockFragment(frame *h2Frame) ([]byte, error){
+	payload := frame.payload
+	if frame.stream == 0{
+		return nil, errH2Frame
+	}
+
+	padding := 0
+	if frame.flags & h2FlagPadded != 0{
+		if len(payload) < 1{
+			return nil, errH2Frame
+		}
+		padding = int(payload[0])
+		payload = payload[1: ]
+	}
+
+	if frame.flags & h2FlagPriority != 0{
+		if len(payload) < 5{
+			return nil, errH2Frame
+		}
+		payload = payload[5: ]
+	}
+
+	if padding > len(payload){
+		return nil, errH2Frame
+	}
+	return append([]byte(nil), payload[: len(payload) - padding]...), nil
+}
+
+func h2Request(fields []hpackField) (*Request, error){
+	request := &Request{Version: "HTTP/2.0", ContentLength: -1, header: make(map[string]string)}
+
+	var cookies []string
+	for _, f := range fields{
+		switch f.name {
+		case ":method":
+			request.Method = f.value
+		case ":path":
+			request.URI = f.value
+		case ":authority":
+			request.SetHeader("Host", f.value)
+		case ":scheme":
+		case "cookie":
+			cookies = append(cookies, f.value)
+		case "host":
+			//:authority优先
+			if request.Header("Host") == ""{
+				request.SetHeader("Host", f.value)
+			}
+		default:
+			if strings.HasPrefix(f.name, ":"){
+				return nil, unexpectHttpMsg
+			}
+			request.SetHeader(f.name, f.value)
+		}
+	}//for
+
+	if request.Method == ""{
+		return nil, unexpectHttpMsg
+	}
+	if len(cookies) > 0{
+		request.SetHeader("cookie", strings.Join(cookies, "; "))
+	}
+	return request, nil
+}
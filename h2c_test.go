@@ -0,0 +1,134 @@
+package go_virtual_host
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestHpackDecode(t *testing.T) {
+	//RFC 7541附录C.4,三个请求共用一个动态表
+	blocks := []string{
+		"828684418cf1e3c2e5f23a6ba0ab90f4ff",
+		"828684be5886a8eb10649cbf",
+		"828785bf408825a849e95ba97d7f8925a849e95bb8e8b4bf",
+	}
+	expects := []string{
+		"[:method=GET :scheme=http :path=/ :authority=www.example.com]",
+		"[:method=GET :scheme=http :path=/ :authority=www.example.com cache-control=no-cache]",
+		"[:method=GET :scheme=https :path=/index.html :authority=www.example.com custom-key=custom-value]",
+	}
+
+	d := newHpackDecoder()
+	for i, block := range blocks{
+		data, _ := hex.DecodeString(block)
+		fields, err := d.decode(data)
+		if err != nil{
+			t.Fatalf("block %d: %v", i, err)
+		}
+
+		var pairs []string
+		for _, f := range fields{
+			pairs = append(pairs, f.name + "=" + f.value)
+		}
+		if got := fmt.Sprint(pairs); got != expects[i]{
+			t.Fatalf("block %d: expect %s, got %s", i, expects[i], got)
+		}
+	}//for
+
+	//C.3.1,不使用Huffman编码
+	data, _ := hex.DecodeString("828684410f7777772e6578616d706c652e636f6d")
+	if fields, err := newHpackDecoder().decode(data); err != nil || fields[3].value != "www.example.com"{
+		t.Fatalf("unexpected fields %v %v", fields, err)
+	}
+
+	for _, bad := range []string{"80", "ff", "4185", "be"}{
+		data, _ := hex.DecodeString(bad)
+		if _, err := newHpackDecoder().decode(data); err == nil{
+			t.Fatalf("expect error for %s", bad)
+		}
+	}
+}
+
+func TestH2cPriorKnowledge(t *testing.T) {
+	//SETTINGS、WINDOW_UPDATE、带填充和优先级的HEADERS以及CONTINUATION
+	block, _ := hex.DecodeString("828684418cf1e3c2e5f23a6ba0ab90f4ff")
+	headers := append([]byte{2}, append([]byte{0, 0, 0, 0, 16}, block[: 4]...)...)
+	headers = append(headers, 0, 0)
+	stream := h2Preface +
+		h2TestFrame(h2FrameSettings, 0, 0, "\x00\x03\x00\x00\x00\x64") +
+		h2TestFrame(h2FrameWindowUpdate, 0, 0, "\x00\x01\x00\x00") +
+		h2TestFrame(h2FrameHeaders, h2FlagPadded | h2FlagPriority, 1, string(headers)) +
+		h2TestFrame(h2FrameContinuation, h2FlagEndHeaders, 1, string(block[4: ]))
+
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil{
+		t.Fatal(err)
+	}
+	defer backend.Close()
+
+	received := make(chan string, 1)
+	go func() {
+		conn, err := backend.Accept()
+		if err != nil{
+			return
+		}
+		defer conn.Close()
+		data := make([]byte, len(stream))
+		_, _ = io.ReadFull(conn, data)
+		received <- string(data)
+	}()
+
+	routed := make(chan string, 1)
+	proxy := NewCommonProxy("127.0.0.1:0", func(request *Request) (net.Conn, error) {
+		routed <- request.Header("Host") + " " + request.Method + " " + request.URI + " " + request.Version
+		return net.Dial("tcp", backend.Addr().String())
+	}).(*Proxy)
+	defer proxy.Close()
+	proxy.AsyncStart()
+
+	conn, err := net.Dial("tcp", proxy.Addr().String())
+	if err != nil{
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err = io.WriteString(conn, stream); err != nil{
+		t.Fatal(err)
+	}
+
+	if r := <-routed; r != "www.example.com GET / HTTP/2.0"{
+		t.Fatalf("unexpected routed request %q", r)
+	}
+	if data := <-received; data != stream{
+		t.Fatalf("backend should receive the original bytes, got %q", data)
+	}
+}
+
+func h2TestFrame(typ byte, flags byte, stream uint32, payload string) string{
+	n := len(payload)
+	head := []byte{byte(n >> 16), byte(n >> 8), byte(n), typ, flags,
+		byte(stream >> 24), byte(stream >> 16), byte(stream >> 8), byte(stream)}
+	return string(head) + payload
+}
+
+func TestH2cBadPreface(t *testing.T) {
+	for _, data := range []string{
+		"PRI * HTTP/2.0\r\n\r\nXX\r\n\r\n",
+		//第一帧不是SETTINGS
+		h2Preface + "\x00\x00\x00\x01\x05\x00\x00\x00\x01",
+		//帧长度超过16384
+		h2Preface + "\x01\x00\x00\x04\x00\x00\x00\x00\x00",
+	}{
+		tr := NewTextReader(strings.NewReader(data))
+		request, err := tr.ReadRequest()
+		if err != nil || !isH2Preface(request){
+			t.Fatalf("expect preface, got %v %v", request, err)
+		}
+		if _, err = tr.readH2Request(); err == nil{
+			t.Fatalf("expect error for %q", data)
+		}
+	}//for
+}
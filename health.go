@@ -0,0 +1,351 @@
+package go_virtual_host
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	HealthCheckTCP = "tcp"
+	HealthCheckHTTP = "http"
+	HealthCheckTLS = "tls"
+)
+
+//主动健康检查
+type HealthCheck struct {
+	//tcp、http或者tls
+	Type string
+
+	Interval time.Duration
+	Timeout time.Duration
+
+	//连续成功Rise次后恢复,连续失败Fall次后摘除
+	Rise int
+	Fall int
+
+	//只用于http,Host为空时使用后端地址
+	Path string
+	Host string
+	//为0时要求2xx和3xx
+	ExpectStatus int
+
+	//只用于tls,握手时使用的SNI,后端证书必须与其匹配
+	ServerName string
+}
+
+func (hc *HealthCheck) setDefaults(){
+	if hc.Type == ""{
+		hc.Type = HealthCheckTCP
+	}
+	if hc.Interval <= 0{
+		hc.Interval = 5 * time.Second
+	}
+	if hc.Timeout <= 0{
+		hc.Timeout = 2 * time.Second
+	}
+	if hc.Rise <= 0{
+		hc.Rise = 2
+	}
+	if hc.Fall <= 0{
+		hc.Fall = 3
+	}
+	if hc.Path == ""{
+		hc.Path = "/"
+	}
+}
+
+//被动检查,连续连接失败Failures次后摘除Duration时间
+type OutlierDetection struct {
+	Failures int
+	Duration time.Duration
+}
+
+//后端的健康状态
+type backendHealth struct {
+	//主动检查的结果
+	unhealthy int32
+
+	//被动检查连续连接失败的次数和摘除的截止时间(UnixNano)
+	dialFailures int32
+	ejectedUntil int64
+
+	mu sync.Mutex
+	rises int
+	falls int
+	lastCheck time.Time
+	lastError error
+}
+
+//后端的状态
+type BackendStatus struct {
+	Addr string `json:"addr"`
+	Weight int `json:"weight"`
+	Active int64 `json:"active"`
+
+	Healthy bool `json:"healthy"`
+	Ejected bool `json:"ejected"`
+	EjectedUntil time.Time `json:"ejected_until"`
+
+	//熔断状态,没有设置熔断时为closed
+	Circuit string `json:"circuit"`
+
+	//不再接受新的连接,已经建立的连接不受影响
+	Drained bool `json:"drained"`
+
+	LastCheck time.Time `json:"last_check"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+func (b *Backend) Healthy() bool{
+	return atomic.LoadInt32(&b.health.unhealthy) == 0
+}
+
+func (b *Backend) ejected(now time.Time) bool{
+	return atomic.LoadInt64(&b.health.ejectedUntil) > now.UnixNano()
+}
+
+func (b *Backend) Drained() bool{
+	return atomic.LoadInt32(&b.drained) == 1
+}
+
+//drained为true时不再选择该后端,已经建立的连接不受影响
+func (b *Backend) SetDrained(drained bool){
+	var v int32
+	if drained{
+		v = 1
+	}
+	atomic.StoreInt32(&b.drained, v)
+}
+
+//健康、没有被摘除、没有熔断并且没有被drain
+func (b *Backend) available(now time.Time) bool{
+	return b.Healthy() && !b.ejected(now) && !b.Drained() && (b.breaker == nil || b.breaker.ready())
+}
+
+//连接数已经达到MaxConnections
+func (b *Backend) saturated() bool{
+	return b.breaker != nil && b.breaker.saturated(b.Active())
+}
+
+//连接之前占用一个连接数,已经达到MaxConnections时返回false
+//先占用再连接,同时进行的连接不会超过MaxConnections,连接失败时调用release
+func (b *Backend) reserve() bool{
+	for {
+		active := atomic.LoadInt64(&b.active)
+		if b.breaker != nil && b.breaker.saturated(active){
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&b.active, active, active + 1){
+			return true
+		}
+	}//for
+}
+
+func (b *Backend) release(){
+	atomic.AddInt64(&b.active, -1)
+}
+
+func (b *Backend) Status() BackendStatus{
+	b.health.mu.Lock()
+	defer b.health.mu.Unlock()
+
+	now := time.Now()
+	status := BackendStatus{
+		Addr: b.Addr,
+		Weight: b.Weight,
+		Active: b.Active(),
+		Healthy: b.Healthy(),
+		Ejected: b.ejected(now),
+		LastCheck: b.health.lastCheck,
+		Circuit: CircuitClosed,
+		Drained: b.Drained(),
+	}
+
+	if b.breaker != nil{
+		status.Circuit = b.breaker.State()
+	}
+
+	if status.Ejected{
+		status.EjectedUntil = time.Unix(0, atomic.LoadInt64(&b.health.ejectedUntil))
+	}
+
+	if b.health.lastError != nil{
+		status.LastError = b.health.lastError.Error()
+	}
+	return status
+}
+
+//记录一次主动检查的结果,达到阈值时改变状态
+func (b *Backend) recordCheck(err error, check *HealthCheck) (changed bool){
+	b.health.mu.Lock()
+	defer b.health.mu.Unlock()
+
+	b.health.lastCheck = time.Now()
+	b.health.lastError = err
+
+	if err == nil{
+		b.health.falls = 0
+		b.health.rises++
+		if !b.Healthy() && b.health.rises >= check.Rise{
+			atomic.StoreInt32(&b.health.unhealthy, 0)
+			return true
+		}
+		return false
+	}
+
+	b.health.rises = 0
+	b.health.falls++
+	if b.Healthy() && b.health.falls >= check.Fall{
+		atomic.StoreInt32(&b.health.unhealthy, 1)
+		return true
+	}
+	return false
+}
+
+//记录连接后端的结果,连续失败达到阈值时摘除
+func (b *Backend) recordDial(err error, outlier *OutlierDetection) (ejected bool){
+	if err == nil{
+		atomic.StoreInt32(&b.health.dialFailures, 0)
+		return false
+	}
+
+	b.health.mu.Lock()
+	b.health.lastError = err
+	b.health.mu.Unlock()
+
+	if outlier == nil || outlier.Failures <= 0{
+		return false
+	}
+
+	if atomic.AddInt32(&b.health.dialFailures, 1) < int32(outlier.Failures){
+		return false
+	}
+
+	atomic.StoreInt32(&b.health.dialFailures, 0)
+	atomic.StoreInt64(&b.health.ejectedUntil, time.Now().Add(outlier.Duration).UnixNano())
+	return true
+}
+
+//执行一次主动检查
+func (b *Backend) check(hc *HealthCheck) error{
+	conn, err := net.DialTimeout("tcp", b.Addr, hc.Timeout)
+	if err != nil{
+		return err
+	}
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(hc.Timeout))
+
+	switch hc.Type {
+	case HealthCheckHTTP:
+		return b.checkHttp(conn, hc)
+	case HealthCheckTLS:
+		return checkTls(conn, hc)
+	}
+	return nil
+}
+
+func (b *Backend) checkHttp(conn net.Conn, hc *HealthCheck) error{
+	host := hc.Host
+	if host == ""{
+		host = b.Addr
+	}
+
+	request := fmt.Sprintf("GET %s HTTP/1.1\r\nHost: %s\r\nUser-Agent: go-virtual-host-health-check\r\nConnection: close\r\n\r\n", hc.Path, host)
+	if _, err := conn.Write([]byte(request)); err != nil{
+		return err
+	}
+
+	response, err := ReadResponse(conn)
+	if err != nil{
+		return err
+	}
+
+	if hc.ExpectStatus != 0{
+		if response.StatusCode != hc.ExpectStatus{
+			return fmt.Errorf("unexpected status %d, expect %d", response.StatusCode, hc.ExpectStatus)
+		}
+		return nil
+	}
+
+	if response.StatusCode < 200 || response.StatusCode >= 400{
+		return fmt.Errorf("unexpected status %d", response.StatusCode)
+	}
+	return nil
+}
+
+//后端证书一般不是公共CA签发的,只校验证书是否与SNI匹配
+func checkTls(conn net.Conn, hc *HealthCheck) error{
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: hc.ServerName, InsecureSkipVerify: true})
+	if err := tlsConn.Handshake(); err != nil{
+		return err
+	}
+
+	if hc.ServerName == ""{
+		return nil
+	}
+
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0{
+		return errors.New("no certificate received")
+	}
+	return certs[0].VerifyHostname(hc.ServerName)
+}
+
+//开始对pool中的所有后端进行主动检查,返回的函数用于停止检查
+func (p *BackendPool) StartHealthCheck(check HealthCheck) (stop func()){
+	check.setDefaults()
+	done := make(chan struct{})
+
+	for _, b := range p.Backends(){
+		go func(b *Backend) {
+			ticker := time.NewTicker(check.Interval)
+			defer ticker.Stop()
+
+			for {
+				err := b.check(&check)
+				if b.recordCheck(err, &check){
+					if err != nil{
+						fmt.Printf("[health-check]: backend %s is unhealthy: %v\n", b.Addr, err)
+					}else{
+						fmt.Printf("[health-check]: backend %s is healthy\n", b.Addr)
+					}
+				}
+
+				select {
+				case <-ticker.C:
+				case <-done:
+					return
+				}
+			}//for
+		}(b)
+	}//for
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+		})
+	}
+}
+
+//被动检查,连接后端连续失败后在一段时间内不再使用
+func (p *BackendPool) SetOutlierDetection(outlier OutlierDetection){
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.outlier = &outlier
+}
+
+func (p *BackendPool) Status() []BackendStatus{
+	backends := p.Backends()
+	status := make([]BackendStatus, 0, len(backends))
+	for _, b := range backends{
+		status = append(status, b.Status())
+	}
+	return status
+}
@@ -0,0 +1,112 @@
+package go_virtual_host
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//返回一个没有监听的地址
+func closedAddr(t *testing.T) string{
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil{
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	_ = listener.Close()
+	return addr
+}
+
+func TestHealthCheckMarksUnhealthy(t *testing.T) {
+	up := startBackend(t, "up")
+	defer up.Close()
+
+	good, bad := NewBackend(up.Addr().String(), 1), NewBackend(closedAddr(t), 1)
+	pool := NewBackendPool(RoundRobin(), good, bad)
+
+	stop := pool.StartHealthCheck(HealthCheck{Type: HealthCheckHTTP, Interval: 10 * time.Millisecond, Timeout: time.Second, Fall: 2, ExpectStatus: 200})
+	defer stop()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for bad.Healthy() && time.Now().Before(deadline){
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if bad.Healthy() || !good.Healthy(){
+		t.Fatalf("unexpected status %+v %+v", good.Status(), bad.Status())
+	}
+
+	for i := 0; i < 4; i++{
+		if b, _ := pool.Pick(nil); b != good{
+			t.Fatalf("expect healthy backend, got %s", b.Addr)
+		}
+	}
+}
+
+func TestOutlierDetection(t *testing.T) {
+	bad := NewBackend(closedAddr(t), 1)
+	pool := NewBackendPool(RoundRobin(), bad)
+	pool.SetOutlierDetection(OutlierDetection{Failures: 2, Duration: time.Minute})
+
+	for i := 0; i < 2; i++{
+		if _, err := pool.Dial(nil); err == nil{
+			t.Fatal("expect dial error")
+		}
+	}
+
+	if !bad.Status().Ejected{
+		t.Fatal("expect backend to be ejected")
+	}
+	if _, err := pool.Dial(nil); err != errNoBackend{
+		t.Fatalf("expect errNoBackend, got %v", err)
+	}
+}
+
+func TestServersStopHealthChecks(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil{
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	var checks int32
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil{
+				return
+			}
+			atomic.AddInt32(&checks, 1)
+			_ = conn.Close()
+		}
+	}()
+
+	cfg, err := ParseConfig([]byte(fmt.Sprintf(`{
+		"listeners": [{"listen": "127.0.0.1:0", "mode": "tls", "hosts": [{"backend": "web"}]}],
+		"backends": {"web": {"addresses": [%q], "health_check": {"interval": "10ms", "timeout": "1s"}}}
+	}`, listener.Addr().String())))
+	if err != nil{
+		t.Fatal(err)
+	}
+
+	_, stop, err := NewServersFromConfig(cfg)
+	if err != nil{
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt32(&checks) < 2 && time.Now().Before(deadline){
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	//停止之后不再有新的检查
+	stop()
+	time.Sleep(50 * time.Millisecond)
+	n := atomic.LoadInt32(&checks)
+	time.Sleep(100 * time.Millisecond)
+	if n < 2 || atomic.LoadInt32(&checks) != n{
+		t.Fatalf("expect health checks stopped, got %d then %d", n, atomic.LoadInt32(&checks))
+	}
+}
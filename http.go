@@ -3,8 +3,11 @@ package go_virtual_host
 import (
 	"bytes"
 	"io"
+	"io/ioutil"
 	"net"
 	"strconv"
+	"strings"
+	"time"
 )
 
 const (
@@ -17,16 +20,31 @@ type HttpConn struct {
 	Request *Request
 }
 
+//读取第一个请求的请求头,h2c prior knowledge的连接读取第一个HEADERS,
+//Request.Version为HTTP/2.0,Host为:authority
 func HTTP(conn net.Conn) (* HttpConn, error){
-    sc, tee := newSharedConn(conn)
+	return newHttpConn(conn, DefaultPeekLimits)
+}
+
+func newHttpConn(conn net.Conn, limits PeekLimits) (*HttpConn, error){
+    sc, tee := newSharedConn(conn, limits.MaxPeekBytes)
 
     var err error
-    request, err := ReadRequest(tee)
+    tr := newLimitedTextReader(tee, limits)
+    request, err := tr.ReadRequest()
 
     if err != nil{
     	return nil, err
 	}
 
+	//h2c prior knowledge,从第一个HEADERS中得到Host
+	if isH2Preface(request){
+		if request, err = tr.readH2Request(); err != nil{
+			return nil, err
+		}
+	}
+	request.RemoteAddr = conn.RemoteAddr().String()
+
 	return &HttpConn{sharedConn:sc, Request:request}, nil
 }
 
@@ -41,21 +59,48 @@ func (hc *HttpConn) Free(){
 
 
 type HttpCrack struct {
+	//是否已经开始被读取
+	started bool
 	bodyLen int
+	//正在原样转发chunked编码的body,bodyLen为当前chunk剩余的字节数
+	chunked bool
 	readErr error
 	operation int
 	txReader *TextReader
 	vbuff *bytes.Buffer
 	net.Conn
-	requestHandler func (*Request) *Request
+	//每个请求都经过handler处理,ctx在同一连接的请求之间共用
+	handler RequestHandler
+	ctx *ConnContext
 	Request *Request
+	//不为nil时为每个请求创建span并注入traceparent
+	tracing *crackTracing
+	//不为nil时改写匹配的请求的body
+	bodyTransformer *BodyTransformer
+	//等待改写body的请求,在读取时才读取body,bodyKind为原始请求的body类型
+	pending *Request
+	bodyKind int
+	//流式改写后的body,读完之前不读取下一个请求
+	bodyStream io.Reader
+	//由代理设置,为nil时升级请求之后总是认为升级成功
+	upgrade *crackUpgrade
+	onUpgrade UpgradeHook
+	//已经转发的升级请求的协议,body转发完之后等待后端的响应
+	upgrading string
+	//升级成功之后的协议,之后的数据原样转发
+	Upgraded string
 }
 
 
 func HTTPCRACK(conn net.Conn) (*HttpCrack, error){
+	return newHttpCrack(conn, DefaultPeekLimits)
+}
+
+//每个请求的请求头都受limits限制,body不受限制
+func newHttpCrack(conn net.Conn, limits PeekLimits) (*HttpCrack, error){
 	crack := &HttpCrack{
 		Conn:conn,
-		txReader:NewTextReader(conn),
+		txReader:newLimitedTextReader(conn, limits),
 		vbuff:bytes.NewBuffer(make([]byte, 0, 1024)),
 	}
 	crack.readRequest()
@@ -65,14 +110,101 @@ func HTTPCRACK(conn net.Conn) (*HttpCrack, error){
 	return crack, nil
 }
 
+//第一个请求在创建时已经写入缓冲区,还没有开始读取时按新的handler重写
 func (hCrack *HttpCrack) SetRequestHandler(handler func(*Request) *Request){
-	hCrack.requestHandler = handler
+	_, _ = hCrack.SetHandler(nil, Chain(RequestFunc(handler)))
+}
+
+//设置改写请求body的transformer,需要在SetHandler之前设置才对第一个请求生效
+func (hCrack *HttpCrack) SetBodyTransformer(t *BodyTransformer){
+	hCrack.bodyTransformer = t
+}
+
+//设置处理每个请求的handler,ctx为nil时由连接生成
+//还没有开始读取时第一个请求立即按handler处理,短路或者失败时返回需要写给客户端的响应,
+//由调用者写入后关闭连接
+func (hCrack *HttpCrack) SetHandler(ctx *ConnContext, handler RequestHandler) (*DirectResponse, error){
+	if ctx == nil{
+		ctx = newConnContext(hCrack.Conn)
+	}
+	hCrack.handler, hCrack.ctx = handler, ctx
+
+	if hCrack.started || hCrack.Request == nil{
+		return nil, nil
+	}
+
+	kind := requestBodyKind(hCrack.Request)
+	request, response, err := hCrack.handle(hCrack.Request)
+	if response != nil{
+		hCrack.readErr = io.EOF
+		return response, err
+	}
+
+	hCrack.vbuff.Reset()
+	hCrack.forward(request, kind)
+	return nil, nil
+}
+
+//把请求写入缓冲区,需要改写body时等到读取时再写入
+func (hCrack *HttpCrack) forward(request *Request, kind int){
+	hCrack.Request = request
+	hCrack.upgrading = request.UpgradeProtocol()
+	hCrack.upgrade.forwarded(request)
+	if kind != bodyNone && hCrack.bodyTransformer.match(hCrack.ctx, request){
+		hCrack.bodyLen, hCrack.chunked = 0, false
+		hCrack.pending, hCrack.bodyKind = request, kind
+		return
+	}
+
+	if _, err := WriteRequest(request, hCrack.vbuff); err != nil{
+		hCrack.readErr = err
+	}
+}
+
+//请求不再转发,写入响应后以EOF结束客户端到后端的方向
+//pipeline发送的请求可能和后端之前的响应交错
+func (hCrack *HttpCrack) answer(response *DirectResponse){
+	hCrack.bodyLen, hCrack.chunked = 0, false
+	hCrack.readErr = io.EOF
+	_ = response.write(hCrack.Conn)
+}
+
+//由handler处理请求并注入traceparent,Content-Length和Transfer-Encoding不能被修改
+func (hCrack *HttpCrack) handle(request *Request) (*Request, *DirectResponse, error){
+	if hCrack.handler != nil{
+		contentLen, te := request.ContentLength, request.Header("Transfer-Encoding")
+		handled, response, err := hCrack.handler(hCrack.ctx, request)
+		hCrack.ctx.Index++
+
+		if err != nil{
+			response = errorResponse(err)
+		}
+		if response != nil{
+			hCrack.tracing.answered(response.StatusCode)
+			return nil, response, err
+		}
+
+		request = handled
+		if te != ""{
+			request.DelHeader("Content-Length")
+			request.SetHeader("Transfer-Encoding", te)
+		}else{
+			request.DelHeader("Transfer-Encoding")
+			if contentLen >= 0{
+				request.SetHeader("Content-Length", strconv.Itoa(contentLen))
+			}
+		}
+	}//if
+
+	hCrack.tracing.inject(request)
+	return request, nil, nil
 }
 
 
 func (hCrack *HttpCrack) Read(p []byte) (n int, err error){
 	//先从缓冲区中读取
 	//再去读取request信息并更改存入缓冲区
+	hCrack.started = true
 	n, err = hCrack.vbuff.Read(p)
 
 	if err != io.EOF{
@@ -84,7 +216,7 @@ func (hCrack *HttpCrack) Read(p []byte) (n int, err error){
     	return
 	}//if
 
-	hCrack.readRequest()
+	hCrack.readFullRequest()
 
 	return hCrack.readBuffer(p)
 }
@@ -99,10 +231,37 @@ func (hCrack *HttpCrack) readBuffer(p []byte) (n int, err error){
 }
 
 
+//上一个请求的body没有读完则继续读body,否则读取下一个请求
+//升级请求之后等到后端响应再决定是否继续解析
 func (hCrack *HttpCrack) readFullRequest(){
+	if hCrack.Upgraded != ""{
+		hCrack.readRaw()
+		return
+	}
+
+	//改写body
+	if hCrack.pending != nil{
+		hCrack.transformBody()
+		return
+	}
+	if hCrack.bodyStream != nil{
+		hCrack.readBodyStream()
+		return
+	}
+	if hCrack.chunked{
+		hCrack.readChunkedBody()
+		return
+	}
+
 	//read body
 	if hCrack.bodyLen > 0{
 		hCrack.readRequestBody()
+		return
+	}
+
+	if hCrack.upgrading != ""{
+		hCrack.waitUpgrade()
+		return
 	}
 
 	//read header
@@ -120,28 +279,164 @@ func (hCrack *HttpCrack) readRequest(){
 
     if err != nil{
     	hCrack.readErr = err
+    	//第一个请求由调用者响应
+    	if hCrack.Request != nil{
+    		_ = writeParseError(hCrack.Conn, err)
+		}
 		return
 	}
+	request.RemoteAddr = hCrack.Conn.RemoteAddr().String()
+
+	//按照body的类型转发body,chunked的body按chunk原样转发
+	kind := requestBodyKind(request)
+	switch kind {
+	case bodyLength:
+		hCrack.bodyLen = request.ContentLength
+	case bodyChunked:
+		hCrack.chunked = true
+	}
+    //span使用原始请求中的traceparent,之后注入到重写后的请求中
+	hCrack.tracing.startSpan(request, time.Now())
 
-    contentLen := request.ContentLength
     //将新的request写入到buff中
+	request, response, _ := hCrack.handle(request)
+	if response != nil{
+		hCrack.answer(response)
+		return
+	}
+
+	hCrack.forward(request, kind)
+}
+
+//读取等待改写的请求的body,缓冲模式下写入改写后的完整请求,流式模式下只写入请求头
+func (hCrack *HttpCrack) transformBody(){
+	request, t := hCrack.pending, hCrack.bodyTransformer
+	hCrack.pending = nil
+	body := t.limit(hCrack.txReader.bodyReader(hCrack.bodyKind, request.ContentLength))
 
-    if hCrack.requestHandler != nil{
-    	request = hCrack.requestHandler(request)
+	if t.Stream != nil{
+		request.DelHeader("Content-Length")
+		request.SetHeader("Transfer-Encoding", "chunked")
+		request.ContentLength = -1
+		hCrack.bodyStream = t.Stream(hCrack.ctx, request, body)
 
-    	if contentLen >= 0{
-    		hCrack.bodyLen = contentLen
-    		request.SetHeader("Content-Length", strconv.Itoa(contentLen))
+		if _, err := WriteRequest(request, hCrack.vbuff); err != nil{
+			hCrack.readErr = err
 		}
+		return
+	}
 
-	}//if
-	_, err = WriteRequest(request, hCrack.vbuff)
+	//客户端等到100 Continue之后才发送body,后端收到请求时body已经读完
+	if strings.EqualFold(request.Header("Expect"), "100-continue"){
+		request.DelHeader("Expect")
+		if _, err := io.WriteString(hCrack.Conn, "HTTP/1.1 100 Continue\r\n\r\n"); err != nil{
+			hCrack.readErr = err
+			return
+		}
+	}
+
+	data, err := ioutil.ReadAll(body)
+	if err != nil && err != errBodyTooLarge{
+		hCrack.readErr = err
+		return
+	}
+	if err == nil{
+		data, err = t.Buffered(hCrack.ctx, request, data)
+	}
 	if err != nil{
+		response := errorResponse(err)
+		hCrack.tracing.answered(response.StatusCode)
+		hCrack.answer(response)
+		return
+	}
+
+	request.DelHeader("Transfer-Encoding")
+	request.SetHeader("Content-Length", strconv.Itoa(len(data)))
+	request.ContentLength = len(data)
+
+	if _, err = WriteRequest(request, hCrack.vbuff); err != nil{
 		hCrack.readErr = err
 		return
-	}//if
-	hCrack.Request = request
-	return
+	}
+	hCrack.vbuff.Write(data)
+}
+
+//从改写后的body中读取一块,按chunked编码写入缓冲区,读完时写入最后的空chunk
+func (hCrack *HttpCrack) readBodyStream(){
+	buf := make([]byte, maxReadBlock)
+	n, err := hCrack.bodyStream.Read(buf)
+	if werr := writeChunk(hCrack.vbuff, buf[: n]); werr != nil{
+		hCrack.readErr = werr
+		return
+	}
+
+	if err == io.EOF{
+		hCrack.bodyStream = nil
+		hCrack.vbuff.WriteString("0\r\n\r\n")
+		return
+	}
+	if err != nil{
+		hCrack.bodyStream = nil
+		hCrack.readErr = err
+	}
+}
+
+func (hCrack *HttpCrack) waitUpgrade(){
+	protocol := hCrack.upgrading
+	hCrack.upgrading = ""
+	if !hCrack.upgrade.wait(){
+		return
+	}
+
+	hCrack.Upgraded = protocol
+	if hCrack.onUpgrade != nil{
+		hCrack.onUpgrade(hCrack.ctx, hCrack.Request, protocol)
+	}
+}
+
+//升级之后原样读取,先读取TextReader中已经缓存的数据
+func (hCrack *HttpCrack) readRaw(){
+	if hCrack.readErr != nil{
+		return
+	}
+
+	line := make([]byte, maxReadBlock)
+	n, err := hCrack.txReader.br.Read(line)
+	hCrack.vbuff.Write(line[: n])
+	if err != nil{
+		hCrack.readErr = err
+	}
+}
+
+//原样转发一个chunk的长度行,chunk的数据和结尾的\r\n由readRequestBody转发
+//最后的空chunk之后转发trailer
+func (hCrack *HttpCrack) readChunkedBody(){
+	if hCrack.bodyLen > 0{
+		hCrack.readRequestBody()
+		return
+	}
+
+	line, err := hCrack.txReader.Readline()
+	if err != nil{
+		hCrack.readErr = err
+		return
+	}
+	size, err := parseChunkSize(line)
+	if err != nil{
+		hCrack.readErr = err
+		return
+	}
+	hCrack.vbuff.WriteString(line + "\r\n")
+
+	if size > 0{
+		hCrack.bodyLen = int(size) + 2
+		return
+	}
+
+	hCrack.chunked = false
+	if _, err = hCrack.txReader.copyTrailer(hCrack.vbuff); err != nil{
+		hCrack.readErr = err
+	}
 }
 
 func (hCrack *HttpCrack) readRequestBody() {
@@ -0,0 +1,428 @@
+package go_virtual_host
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+//keep-alive连接上的一次请求/响应
+//按照HTTP/1.1的规定,同一连接上响应的顺序和请求的顺序一致,
+//所以逐个读取请求、转发、再读取对应的响应即可完成配对,
+//pipeline发送的后续请求会留在客户端连接的缓冲中等待处理
+type Exchange struct {
+	//连接上的第几个请求,从0开始
+	Index int
+
+	Request *Request
+
+	Response *Response
+
+	//本次请求被转发到的后端地址
+	Backend string
+
+	//请求和响应body的字节数
+	RequestBytes int64
+	ResponseBytes int64
+
+	Err error
+
+	//开始处理请求的时间,用于访问日志
+	started time.Time
+	//没有得到后端响应时写给客户端的错误状态码
+	status int
+}
+
+//后端连接,按地址缓存以便同一后端的后续请求复用
+type backendConn struct {
+	net.Conn
+	key backendKey
+	txReader *TextReader
+	writer *bufio.Writer
+	//是否已经转发过请求
+	used bool
+}
+
+//同一地址可能属于多个后端集群,按集群中的后端区分连接,连接数等记录在对应的后端上
+type backendKey struct {
+	addr string
+	//不是从后端集群中选择时为nil
+	backend *Backend
+}
+
+type keepAliveServer struct {
+	route func(*Request) (string, error)
+	//不为nil时代替route,从后端集群中选择后端并通过后端所在的集群建立连接
+	pick func(*Request) (*Backend, error)
+	handlerRequest func(*Request) *Request
+	onExchange func(*Exchange)
+	dial func(addr string) (net.Conn, error)
+}
+
+//单个客户端连接上的状态
+type keepAliveSession struct {
+	*keepAliveServer
+	p *Proxy
+	conn net.Conn
+	txReader *TextReader
+	writer *bufio.Writer
+	backends map[backendKey]*backendConn
+	index int
+	timeouts Timeouts
+	entry *connEntry
+}
+
+func (k *keepAliveServer) serve(p *Proxy, conn net.Conn, entry *connEntry){
+	s := &keepAliveSession{
+		keepAliveServer: k,
+		p: p,
+		conn: conn,
+		txReader: newLimitedTextReader(conn, p.PeekLimits()),
+		writer: bufio.NewWriter(conn),
+		backends: make(map[backendKey]*backendConn),
+		timeouts: p.Timeouts(),
+		entry: entry,
+	}
+
+	defer s.close()
+
+	for {
+		exchange, keepAlive := s.serveOne()
+		if exchange != nil{
+			host := strings.ToLower(hostWithoutPort(exchange.Request.Header("Host")))
+			entry.setRoute(host, exchange.Backend)
+			addCount(&entry.bytesIn, exchange.RequestBytes)
+			addCount(&entry.bytesOut, exchange.ResponseBytes)
+			s.p.metrics.addBytes(s.p.label(), host, exchange.Backend, exchange.RequestBytes, exchange.ResponseBytes)
+		}
+		if exchange != nil{
+			s.logExchange(exchange)
+		}
+		if exchange != nil && s.onExchange != nil{
+			s.onExchange(exchange)
+		}
+
+		if !keepAlive{
+			return
+		}
+	}//for
+}
+
+//每个请求记录一行访问日志
+func (s *keepAliveSession) logExchange(exchange *Exchange){
+	access := s.p.accessEntry(s.entry, nil)
+	if access == nil{
+		return
+	}
+
+	access.Time = exchange.started
+	access.setRequest(exchange.Request)
+	access.Backend = exchange.Backend
+	access.Status = exchange.status
+	if exchange.Response != nil{
+		access.Status = exchange.Response.StatusCode
+	}
+	access.BytesIn, access.BytesOut = exchange.RequestBytes, exchange.ResponseBytes
+	s.p.logAccess(access, exchange.Err)
+}
+
+//读取请求失败并返回了错误响应
+func (s *keepAliveSession) logFailed(started time.Time, status int, err error){
+	access := s.p.accessEntry(s.entry, nil)
+	if access == nil{
+		return
+	}
+
+	access.Time, access.Status = started, status
+	s.p.logAccess(access, err)
+}
+
+func (s *keepAliveSession) close(){
+	for _, bc := range s.backends{
+		_ = bc.Close()
+	}
+	_ = s.conn.Close()
+}
+
+//处理一个请求,返回是否可以继续处理下一个请求
+func (s *keepAliveSession) serveOne() (*Exchange, bool){
+	//等待后续请求时使用idle超时,body的转发不受限制
+	fired, timeout := timeoutHeader, s.timeouts.Header
+	if s.index > 0 && s.timeouts.Idle > 0{
+		fired, timeout = timeoutIdle, s.timeouts.Idle
+	}
+	if timeout > 0{
+		_ = s.conn.SetReadDeadline(time.Now().Add(timeout))
+	}
+
+	started := time.Now()
+	request, err := s.txReader.ReadRequest()
+	if err != nil{
+		status := 0
+		switch {
+		case err == io.EOF:
+		case isTimeout(err):
+			s.p.logLn("%s timeout fired for conn %s", fired, s.conn.RemoteAddr().String())
+			if fired == timeoutHeader{
+				s.p.metrics.parseError(s.p.label(), err)
+				status = 408
+				_ = writeErrorResponse(s.conn, 408, "Request Timeout")
+			}
+		case isLimitError(err):
+			s.p.metrics.parseError(s.p.label(), err)
+			s.p.logLn("read request from %s error: %v", s.conn.RemoteAddr().String(), err)
+			status = 431
+			_ = writeErrorResponse(s.conn, 431, "Request Header Fields Too Large")
+		default:
+			s.p.metrics.parseError(s.p.label(), err)
+			s.p.logLn("read request from %s error: %v", s.conn.RemoteAddr().String(), err)
+			status = 400
+			_ = writeErrorResponse(s.conn, 400, "Bad Request")
+		}
+
+		//只记录返回了错误响应的请求
+		if status != 0{
+			s.logFailed(started, status, err)
+		}
+		return nil, false
+	}
+
+	if timeout > 0{
+		_ = s.conn.SetReadDeadline(time.Time{})
+	}
+	request.RemoteAddr = s.conn.RemoteAddr().String()
+
+	exchange := &Exchange{Index: s.index, started: started}
+	s.index++
+
+	//body长度需要在handler修改请求之前确定
+	kind, length := requestBodyKind(request), request.ContentLength
+
+	if s.handlerRequest != nil{
+		request = s.handlerRequest(request)
+	}
+	exchange.Request = request
+
+	//body已经交给代理转发,客户端不需要再等待100 Continue
+	if expect := request.Header("Expect"); strings.EqualFold(expect, "100-continue"){
+		request.DelHeader("Expect")
+		if _, err = io.WriteString(s.conn, "HTTP/1.1 100 Continue\r\n\r\n"); err != nil{
+			exchange.Err = err
+			return exchange, false
+		}
+	}
+
+	key, err := s.target(request)
+	addr := key.addr
+	if err != nil{
+		exchange.Err = err
+		s.p.logLn("route request %s %s error: %v", request.Method, request.URI, err)
+		exchange.status = writeBackendError(s.conn, err)
+		return exchange, false
+	}
+	exchange.Backend = addr
+
+	bc, response, err := s.forward(key, request, kind, length, exchange)
+	if err != nil{
+		exchange.Err = err
+		s.p.logTimeout(s.conn, err)
+		s.p.logLn("forward request %s %s to %s error: %v", request.Method, request.URI, addr, err)
+		if response == nil{
+			exchange.status = writeBackendError(s.conn, err)
+		}
+		return exchange, false
+	}
+	exchange.Response = response
+
+	//升级之后连接上不再是HTTP/1的请求
+	if response.StatusCode == 101 && request.UpgradeProtocol() != ""{
+		s.tunnel(bc, exchange)
+		return exchange, false
+	}
+
+	respKind := responseBodyKind(request, response)
+	if exchange.ResponseBytes, err = bc.txReader.copyBody(s.writer, respKind, response.ContentLength); err != nil{
+		exchange.Err = err
+		_ = s.writer.Flush()
+		return exchange, false
+	}
+
+	if err = s.writer.Flush(); err != nil{
+		exchange.Err = err
+		return exchange, false
+	}
+
+	if respKind == bodyUntilClose || !responseKeepAlive(response){
+		s.dropBackend(bc)
+	}
+
+	return exchange, requestKeepAlive(request) && respKind != bodyUntilClose && responseKeepAlive(response)
+}
+
+//后端返回101之后在客户端和后端之间原样双向转发,两端读取时缓存的数据先转发
+func (s *keepAliveSession) tunnel(bc *backendConn, exchange *Exchange){
+	if err := s.writer.Flush(); err != nil{
+		exchange.Err = err
+		return
+	}
+
+	//pipeConns结束时会关闭后端连接
+	delete(s.backends, bc.key)
+	upstream, downstream := pipeConns(&bufioConn{Conn: s.conn, tr: s.txReader}, &bufioConn{Conn: bc.Conn, tr: bc.txReader}, nil, nil, nil)
+
+	exchange.RequestBytes += upstream.Bytes
+	exchange.ResponseBytes += downstream.Bytes
+	if upstream.Err != nil{
+		exchange.Err = upstream.Err
+	}else{
+		exchange.Err = downstream.Err
+	}
+}
+
+//转发请求到后端并读取响应头,响应头已经写入客户端的writer中
+//复用的连接可能已经被后端关闭,没有body的请求重新建立连接再试一次
+func (s *keepAliveSession) forward(key backendKey, request *Request, kind int, length int, exchange *Exchange) (bc *backendConn, response *Response, err error){
+	for retry := 0; ; retry++{
+		if bc, err = s.backend(key); err != nil{
+			return
+		}
+
+		reused := bc.used
+		bc.used = true
+
+		if err = s.writeRequest(bc, request, kind, length, exchange); err == nil{
+			response, err = s.readResponse(bc, request)
+		}
+
+		if err == nil{
+			return bc, response, nil
+		}
+
+		s.dropBackend(bc)
+
+		if !reused || kind != bodyNone || retry > 0 || response != nil{
+			return
+		}
+	}//for
+}
+
+func (s *keepAliveSession) writeRequest(bc *backendConn, request *Request, kind int, length int, exchange *Exchange) (err error){
+	//和HttpCrack一样先写入bytes.Buffer
+	var b bytes.Buffer
+	if _, err = WriteRequest(request, &b); err != nil{
+		return
+	}
+
+	if _, err = bc.writer.Write(b.Bytes()); err != nil{
+		return
+	}
+
+	if exchange.RequestBytes, err = s.txReader.copyBody(bc.writer, kind, length); err != nil{
+		return
+	}
+
+	return bc.writer.Flush()
+}
+
+//读取最终响应,1xx的中间响应直接转发给客户端
+func (s *keepAliveSession) readResponse(bc *backendConn, request *Request) (response *Response, err error){
+	for {
+		if response, err = bc.txReader.ReadResponse(); err != nil{
+			return nil, err
+		}
+
+		if _, err = WriteResponse(response, s.writer); err != nil{
+			return response, err
+		}
+
+		if response.StatusCode >= 200 || response.StatusCode == 101{
+			return response, nil
+		}
+
+		if err = s.writer.Flush(); err != nil{
+			return response, err
+		}
+	}//for
+}
+
+//选择请求转发的后端
+func (s *keepAliveSession) target(request *Request) (backendKey, error){
+	if s.pick == nil{
+		addr, err := s.route(request)
+		return backendKey{addr: addr}, err
+	}
+
+	b, err := s.pick(request)
+	if err != nil{
+		return backendKey{}, err
+	}
+	return backendKey{addr: b.Addr, backend: b}, nil
+}
+
+func (s *keepAliveSession) backend(key backendKey) (*backendConn, error){
+	if bc, ok := s.backends[key]; ok{
+		return bc, nil
+	}
+
+	conn, err := dialTimeout(s.timeouts.Dial, func() (net.Conn, error) {
+		return s.p.observeDial(func() (net.Conn, error) {
+			if key.backend != nil{
+				return key.backend.pool.dialBackend(key.backend)
+			}
+			return s.dial(key.addr)
+		})
+	})
+	if err != nil{
+		return nil, err
+	}
+
+	if err = s.p.writeProxyHeader(s.conn, conn); err != nil{
+		_ = conn.Close()
+		return nil, err
+	}
+
+	bc := &backendConn{
+		Conn: conn,
+		key: key,
+		txReader: NewTextReader(conn),
+		writer: bufio.NewWriter(conn),
+	}
+	s.backends[key] = bc
+	s.p.logLn("Join conn %s and %s", s.conn.RemoteAddr().String(), conn.RemoteAddr().String())
+	return bc, nil
+}
+
+func (s *keepAliveSession) dropBackend(bc *backendConn){
+	if s.backends[bc.key] == bc{
+		delete(s.backends, bc.key)
+	}
+	_ = bc.Close()
+}
+
+//HTTP/1.1默认keep-alive,HTTP/1.0需要显式声明
+func isKeepAlive(version string, connection string) bool{
+	if headerHasToken(connection, "close"){
+		return false
+	}
+
+	if version == "HTTP/1.0"{
+		return headerHasToken(connection, "keep-alive")
+	}
+
+	return true
+}
+
+func requestKeepAlive(request *Request) bool{
+	return isKeepAlive(request.Version, request.Header("Connection"))
+}
+
+func responseKeepAlive(response *Response) bool{
+	return isKeepAlive(response.Version, response.Header("Connection"))
+}
+
+func defaultDial(addr string) (net.Conn, error){
+	return net.Dial("tcp", addr)
+}
@@ -0,0 +1,146 @@
+package go_virtual_host
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+//测试用的后端,逐个读取请求并交给respond响应,respond返回false时关闭连接
+func startHttpBackend(t *testing.T, respond func(conn net.Conn, tr *TextReader, request *Request) bool) net.Listener{
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil{
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil{
+				return
+			}
+
+			go func(conn net.Conn) {
+				defer conn.Close()
+				tr := NewTextReader(conn)
+				for {
+					request, err := tr.ReadRequest()
+					if err != nil{
+						return
+					}
+					if !respond(conn, tr, request){
+						return
+					}
+				}//for
+			}(conn)
+		}
+	}()
+
+	return listener
+}
+
+//返回200和body
+func writeOK(conn net.Conn, body string){
+	_, _ = fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+}
+
+//简单的后端,对每个请求返回固定内容
+func startBackend(t *testing.T, name string) net.Listener{
+	return startHttpBackend(t, func(conn net.Conn, tr *TextReader, request *Request) bool {
+		writeOK(conn, fmt.Sprintf("%s %s", name, request.URI))
+		return true
+	})
+}
+
+func TestKeepAliveProxyRoutesEachRequest(t *testing.T) {
+	a := startBackend(t, "a")
+	defer a.Close()
+	b := startBackend(t, "b")
+	defer b.Close()
+
+	route := func(request *Request) (string, error){
+		if request.Header("Host") == "a.example.com"{
+			return a.Addr().String(), nil
+		}
+		return b.Addr().String(), nil
+	}
+
+	server := NewKeepAliveProxy("127.0.0.1:0", route, nil, nil)
+	proxy := server.(*Proxy)
+	defer proxy.Close()
+	server.AsyncStart()
+
+	conn, err := net.Dial("tcp", proxy.Addr().String())
+	if err != nil{
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	//pipeline发送两个请求
+	_, _ = io.WriteString(conn, "GET /x HTTP/1.1\r\nHost: a.example.com\r\n\r\nGET /y HTTP/1.1\r\nHost: b.example.com\r\n\r\n")
+
+	tr := NewTextReader(bufio.NewReader(conn))
+	for _, expect := range []string{"a /x", "b /y"}{
+		response, err := tr.ReadResponse()
+		if err != nil{
+			t.Fatal(err)
+		}
+		body, err := tr.ReadUntilN(response.ContentLength)
+		if err != nil{
+			t.Fatal(err)
+		}
+		if string(body) != expect{
+			t.Fatalf("expect %q, got %q", expect, body)
+		}
+	}
+}
+
+func TestCopyChunked(t *testing.T) {
+	raw := "4\r\nwiki\r\n5;ext=1\r\npedia\r\n0\r\nTrailer: x\r\n\r\n"
+	tr := NewTextReader(strings.NewReader(raw + "GET / HTTP/1.1\r\n"))
+
+	var out bytes.Buffer
+	n, err := tr.copyChunked(&out)
+	if err != nil{
+		t.Fatal(err)
+	}
+	if int(n) != len(raw) || out.String() != raw{
+		t.Fatalf("expect %q, got %q", raw, out.String())
+	}
+}
+
+func TestWriteResponseKeepsFields(t *testing.T) {
+	raw := "HTTP/1.1 200 OK\r\n" +
+		"Set-Cookie: a=1\r\n" +
+		"content-type: text/plain\r\n" +
+		"Set-Cookie: b=2\r\n" +
+		"Content-Length: 0\r\n" +
+		"\r\n"
+	response, err := ReadResponse(strings.NewReader(raw))
+	if err != nil{
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if _, err = WriteResponse(response, &out); err != nil || out.String() != raw{
+		t.Fatalf("expect %q, got %q %v", raw, out.String(), err)
+	}
+
+	response.SetHeader("X-Added", "1")
+	response.SetHeader("Content-Type", "text/html")
+	expect := "HTTP/1.1 200 OK\r\n" +
+		"Set-Cookie: a=1\r\n" +
+		"content-type: text/html\r\n" +
+		"Set-Cookie: b=2\r\n" +
+		"Content-Length: 0\r\n" +
+		"X-Added: 1\r\n" +
+		"\r\n"
+	out.Reset()
+	if _, err = WriteResponse(response, &out); err != nil || out.String() != expect{
+		t.Fatalf("expect %q, got %q %v", expect, out.String(), err)
+	}
+}
@@ -7,12 +7,16 @@ import (
 	"fmt"
 	"io"
 	"net/url"
-	"strconv"
+	"sort"
 	"strings"
 )
 
 var unexpectHttpMsg = errors.New("unexpected http message")
 
+//请求同时有Content-Length和Transfer-Encoding,或者Transfer-Encoding不是chunked时无法确定body的长度
+//代理和后端可能按不同的方式确定body,从而在body中夹带请求
+var errAmbiguousBody = errors.New("ambiguous request body length")
+
 
 type Request struct {
 	Method string
@@ -27,22 +31,149 @@ type Request struct {
 	ContentLength int
 
 	Query map[string][]string
+
+	//客户端地址,由读取请求的连接设置
+	RemoteAddr string
+
+	//读取时的请求行和URI,URI为解码前的形式
+	rawLine string
+	rawURI string
+	//解码后的URI,和URI相同时说明URI没有被修改
+	uri string
+
+	//读取时header的顺序,包括重复的header
+	fields []headerField
+	//之后通过SetHeader新增的key,按新增的顺序写入
+	added []string
 }
 
-func (r *Request) Header(key string) string{
-    if r.header == nil{
-    	return ""
-	}
+type headerField struct {
+	key string
+	value string
+}
 
-    return r.header[key]
+func (r *Request) Header(key string) string{
+	value, _ := headerGet(r.header, key)
+	return value
 }
 
 func (r *Request) SetHeader(key string, value string){
 	if r.header == nil{
-		r.header = map[string]string{key: value}
+		r.header = make(map[string]string)
+	}
+
+	if _, ok := headerGet(r.header, key); !ok{
+		r.added = append(r.added, key)
+	}
+	headerSet(r.header, key, value)
+}
+
+func (r *Request) DelHeader(key string){
+	headerDel(r.header, key)
+}
+
+//复制请求,修改副本的header和query不影响原来的请求
+func (r *Request) clone() *Request{
+	c := *r
+	c.added = append([]string(nil), r.added...)
+	if r.header != nil{
+		c.header = make(map[string]string, len(r.header))
+		for key, value := range r.header{
+			c.header[key] = value
+		}
+	}
+	if r.Query != nil{
+		c.Query = make(map[string][]string, len(r.Query))
+		for key, values := range r.Query{
+			c.Query[key] = append([]string(nil), values...)
+		}
+	}
+	return &c
+}
+
+//读取时的请求行,不是读取得到的请求时为空
+func (r *Request) RawRequestLine() string{
+	return r.rawLine
+}
+
+//读取时解码前的URI,不是读取得到的请求时为空
+func (r *Request) RawURI() string{
+	return r.rawURI
+}
+
+//写入请求行的URI,URI没有被修改时使用原始的URI,否则按URI重新编码
+func (r *Request) RequestURI() string{
+	if r.rawURI != "" && r.URI == r.uri{
+		return r.rawURI
+	}
+	return r.encodeURI(r.URI)
+}
+
+//编码由请求的URI修改得到的uri,query没有修改时使用原始的query
+//解码之后的query无法区分%26和&,重新编码会改变参数
+func (r *Request) encodeURI(uri string) string{
+	i, j := strings.IndexByte(uri, '?'), strings.IndexByte(r.uri, '?')
+	k := strings.IndexByte(r.rawURI, '?')
+	if i < 0 || j < 0 || k < 0 || uri[i: ] != r.uri[j: ]{
+		return escapeURI(uri)
+	}
+
+	//路径中包含%3F时解码之后的?位置不同,这时无法对应原始的query
+	rawQuery := r.rawURI[k + 1: ]
+	if query, err := url.PathUnescape(rawQuery); err != nil || query != uri[i + 1: ]{
+		return escapeURI(uri)
+	}
+	return escapeURI(uri[: i]) + "?" + rawQuery
+}
+
+//编码path中需要编码的字符,query只编码请求行中不能出现的字符
+func escapeURI(uri string) string{
+	path, query, hasQuery := uri, "", false
+	if i := strings.IndexByte(uri, '?'); i >= 0{
+		path, query, hasQuery = uri[: i], uri[i + 1: ], true
+	}
+
+	escaped := (&url.URL{Path: path}).EscapedPath()
+	if !hasQuery{
+		return escaped
+	}
+
+	var b strings.Builder
+	b.WriteString(escaped)
+	b.WriteByte('?')
+	for i := 0; i < len(query); i++{
+		c := query[i]
+		if c <= ' ' || c >= 0x7f || c == '#' || c == '%'{
+			fmt.Fprintf(&b, "%%%02X", c)
+			continue
+		}
+		b.WriteByte(c)
+	}//for
+	return b.String()
+}
+
+//URI中?之前的部分
+func (r *Request) Path() string{
+	if i := strings.IndexByte(r.URI, '?'); i >= 0{
+		return r.URI[: i]
+	}
+	return r.URI
+}
+
+//去掉路径前缀,结果始终以/开头
+func (r *Request) stripPathPrefix(prefix string){
+	path := r.Path()
+	if !strings.HasPrefix(path, prefix){
+		return
 	}
 
-	r.header[key] = value
+	rest := r.URI[len(path): ]
+	path = strings.TrimPrefix(path, prefix)
+	if !strings.HasPrefix(path, "/"){
+		path = "/" + path
+	}
+
+	r.URI = path + rest
 }
 
 //解析请求行
@@ -79,28 +210,37 @@ func parseHeader(headerLine string) (key string ,value string, success bool){
 //读取http协议
 type TextReader struct {
 	br *bufio.Reader
+	limits PeekLimits
 }
 
+//使用DefaultPeekLimits限制行长度和header
 func NewTextReader(reader io.Reader) *TextReader{
-	return &TextReader{br: bufio.NewReader(reader)}
+	return newLimitedTextReader(reader, DefaultPeekLimits)
+}
+
+func newLimitedTextReader(reader io.Reader, limits PeekLimits) *TextReader{
+	return &TextReader{br: bufio.NewReader(reader), limits: limits}
 }
 
 
-//直到读取到delimiter或者error才返回
+//直到读取到delimiter或者error才返回,超过MaxLineBytes时返回LimitError
 func (tr *TextReader) readBytes(delimiter byte) (line []byte, err error){
 	var readline []byte
 
 	for {
-		readline, err = tr.br.ReadBytes(delimiter)
+		readline, err = tr.br.ReadSlice(delimiter)
+		if e := exceeded(LimitLine, tr.limits.MaxLineBytes, len(line) + len(readline)); e != nil{
+			return nil, e
+		}
+
 		line = append(line, readline...)
-		if len(line) > 0 && line[len(line)-1] == delimiter{
-			return line, nil
+		if err == bufio.ErrBufferFull{
+			continue
 		}
 		if err != nil{
-			line = nil
-			readline = nil
-			return
+			return nil, err
 		}
+		return line, nil
 	}//for
 }
 
@@ -164,58 +304,81 @@ func (tr *TextReader) ReadRequest() (request *Request, err error){
 		err = unexpectHttpMsg
 		return
 	}
-    //将uri解析为URL
-    var URL *url.URL
-    if URL, err = url.Parse(request.URI); err != nil{
-    	return nil, err
-	}
-    request.Query = URL.Query()
+	request.rawLine, request.rawURI = line, request.URI
+	//CONNECT的uri是host:port形式,不按URL解析
+	if request.Method == "CONNECT"{
+		request.Query = make(url.Values)
+	}else{
+		//将uri解析为URL
+		var URL *url.URL
+		if URL, err = url.Parse(request.URI); err != nil{
+			return nil, err
+		}
+		request.Query = URL.Query()
 
-    if request.URI, err = url.PathUnescape(request.URI); err != nil{
-    	return nil, err
+		if request.URI, err = url.PathUnescape(request.URI); err != nil{
+			return nil, err
+		}
 	}
+	request.uri = request.URI
 
-    //
 	//读header
-	request.header = make(map[string] string)
+	if request.header, request.fields, err = tr.readHeader(len(line)); err != nil{
+		return
+	}
+
+	if request.ContentLength, err = parseContentLength(request.header); err != nil{
+		return
+	}
+
+	if _, ok := headerGet(request.header, "Transfer-Encoding"); ok && (request.ContentLength >= 0 || !isChunked(request.header)){
+		return nil, errAmbiguousBody
+	}
+
+	return request, nil
+}
+
+//读取header直到空行,size为起始行的字节数
+//fields按读取的顺序保存所有header,header中重复的key只保留最后一个
+func (tr *TextReader) readHeader(size int) (header map[string]string, fields []headerField, err error){
+	header = make(map[string] string)
 	var (
+		line string
 		key string
 		value string
+		success bool
+		count int
 	)
 
 	for {
 		line, err = tr.Readline()
 		if err != nil{
-			return
+			return nil, nil, err
 		}//if
 
 		if line == ""{
 			break
 		}//if
 
+		size += len(line)
+		if err = exceeded(LimitHeaderBytes, tr.limits.MaxHeaderBytes, size); err != nil{
+			return nil, nil, err
+		}
+
+		count++
+		if err = exceeded(LimitHeaders, tr.limits.MaxHeaders, count); err != nil{
+			return nil, nil, err
+		}
+
 		if key, value, success = parseHeader(line); ! success{
-			err = unexpectHttpMsg
-			return
+			return nil, nil, unexpectHttpMsg
 		}//if
 
-		request.header[key] = value
+		header[key] = value
+		fields = append(fields, headerField{key: key, value: value})
 	}//for
 
-    contentLenStr, ok := request.header["Content-Length"]
-    if !ok{
-    	request.ContentLength = -1
-    	return
-	}
-
-    iNt64, err := strconv.ParseInt(contentLenStr, 10, 32)
-
-    if err != nil{
-    	err = unexpectHttpMsg
-    	return
-	}//if
-
-    request.ContentLength = int(iNt64)
-	return request, err
+	return header, fields, nil
 }
 
 
@@ -225,62 +388,95 @@ func ReadRequest(reader io.Reader) (*Request, error){
 }
 
 
+//没有修改过的请求按读取时的请求行和header原样写入
 func WriteRequest(request *Request, writer io.Writer) (int, error){
-    //先写请求行
 	switch w := writer.(type) {
 	case *bytes.Buffer:
 		return writeRequestIntoBytesBuffer(w, request)
 	}
-	//
-	// escape uri
 
-	baseURL, err := url.Parse(request.URI)
-	if err != nil{
+	var b bytes.Buffer
+	if _, err := writeRequestIntoBytesBuffer(&b, request); err != nil{
 		return 0, err
 	}
-	baseURL.RawQuery = baseURL.Query().Encode()
-	escapeURL := baseURL.String()
-    bytesStr := fmt.Sprintf("%s %s %s\r\n", request.Method, escapeURL, request.Version)
-
-    //写header
+	return writer.Write(b.Bytes())
+}
 
-    for key, value := range request.header{
-    	bytesStr = fmt.Sprintf("%s%s: %s\r\n", bytesStr, key, value)
-	}//for
 
-	//\r\n
-	bytesStr = fmt.Sprintf("%s\r\n", bytesStr)
+func writeRequestIntoBytesBuffer(b *bytes.Buffer, request *Request) (n int, err error){
+	start := b.Len()
 
-	line := []byte(bytesStr)
+	b.WriteString(request.Method + " " + request.RequestURI() + " " + request.Version + "\r\n")
+	request.writeHeader(b)
+	b.WriteString("\r\n")
 
-	return writer.Write(line)
+	return b.Len() - start, nil
 }
 
+func (r *Request) writeHeader(b *bytes.Buffer){
+	writeOrderedHeader(b, r.header, r.fields, r.added)
+}
 
-func writeRequestIntoBytesBuffer(b *bytes.Buffer, request *Request) (n int, err error){
-	write := 0
-
-	requestLine := fmt.Sprintf("%s %s %s\r\n", request.Method, request.URI, request.Version)
-
-	if write, err = b.WriteString(requestLine); err != nil{
-		return
+//先按读取时的顺序和大小写写入原有的header,值没有被修改的重复header全部保留,
+//被修改的只在第一次出现的位置写入新的值,之后写入新增的header
+func writeOrderedHeader(b *bytes.Buffer, header map[string]string, fields []headerField, added []string){
+	//每个key读取时最后的值,header中保存的就是这个值
+	last := make(map[string]string, len(fields))
+	for _, f := range fields{
+		last[f.key] = f.value
 	}
 
-	n += write
+	written := make(map[string]bool, len(header))
+	for _, f := range fields{
+		value, ok := headerGet(header, f.key)
+		if !ok{
+			continue
+		}
+
+		lower := strings.ToLower(f.key)
+		if value == last[f.key]{
+			writeHeaderLine(b, f.key, f.value)
+			written[lower] = true
+			continue
+		}
 
-	for key, value := range request.header{
-		if write, err = b.WriteString(fmt.Sprintf("%s: %s\r\n", key, value)); err != nil{
-			return
+		if !written[lower]{
+			writeHeaderLine(b, f.key, value)
+			written[lower] = true
 		}
+	}//for
 
-		n += write
+	for _, key := range added{
+		lower := strings.ToLower(key)
+		if value, ok := headerGet(header, key); ok && !written[lower]{
+			writeHeaderLine(b, key, value)
+			written[lower] = true
+		}
 	}//for
 
-	if write, err = b.WriteString("\r\n"); err != nil{
-		return
+	//直接写入map的header,排序之后写入
+	var rest []string
+	for key := range header{
+		if !written[strings.ToLower(key)]{
+			rest = append(rest, key)
+		}
+	}//for
+	sort.Strings(rest)
+	for _, key := range rest{
+		writeHeaderLine(b, key, header[key])
 	}
+}
 
-	n += write
-	return
+//header中的CR和LF会被当作新的一行,写入之前去掉,避免中间件等设置的值拆分出额外的header
+var headerLineBreaks = strings.NewReplacer("\r", "", "\n", "")
 
-}
\ No newline at end of file
+func writeHeaderLine(b *bytes.Buffer, key string, value string){
+	if strings.ContainsAny(key, "\r\n") || strings.ContainsAny(value, "\r\n"){
+		key, value = headerLineBreaks.Replace(key), headerLineBreaks.Replace(value)
+	}
+
+	b.WriteString(key)
+	b.WriteString(": ")
+	b.WriteString(value)
+	b.WriteString("\r\n")
+}
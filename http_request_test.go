@@ -0,0 +1,119 @@
+package go_virtual_host
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+const rawRequest = "POST /a%2Fb/c+d?y=2&x=%26z HTTP/1.1\r\n" +
+	"host: example.com\r\n" +
+	"X-Custom-CASE: 1\r\n" +
+	"Cookie: a=1\r\n" +
+	"Accept: */*\r\n" +
+	"Cookie: b=2\r\n" +
+	"Content-Length: 0\r\n" +
+	"\r\n"
+
+func TestWriteRequestRoundTrip(t *testing.T) {
+	request, err := ReadRequest(strings.NewReader(rawRequest))
+	if err != nil{
+		t.Fatal(err)
+	}
+	if request.URI != "/a/b/c+d?y=2&x=&z" || request.RawURI() != "/a%2Fb/c+d?y=2&x=%26z"{
+		t.Fatalf("unexpected uri %q %q", request.URI, request.RawURI())
+	}
+	if request.RawRequestLine() != "POST /a%2Fb/c+d?y=2&x=%26z HTTP/1.1"{
+		t.Fatalf("unexpected request line %q", request.RawRequestLine())
+	}
+
+	//bytes.Buffer和其他io.Writer都原样写入
+	var b bytes.Buffer
+	if _, err = WriteRequest(request, &b); err != nil || b.String() != rawRequest{
+		t.Fatalf("expect %q, got %q %v", rawRequest, b.String(), err)
+	}
+	var sb strings.Builder
+	if _, err = WriteRequest(request, &sb); err != nil || sb.String() != rawRequest{
+		t.Fatalf("expect %q, got %q %v", rawRequest, sb.String(), err)
+	}
+
+	//设置相同的值不算修改
+	request.SetHeader("Content-Length", "0")
+	request.SetHeader("X-New", "1")
+	request.SetHeader("X-Custom-Case", "2")
+	request.DelHeader("accept")
+	request.SetHeader("X-Another", "3")
+	request.URI = "/new path?q=a b"
+
+	expect := "POST /new%20path?q=a%20b HTTP/1.1\r\n" +
+		"host: example.com\r\n" +
+		"X-Custom-CASE: 2\r\n" +
+		"Cookie: a=1\r\n" +
+		"Cookie: b=2\r\n" +
+		"Content-Length: 0\r\n" +
+		"X-New: 1\r\n" +
+		"X-Another: 3\r\n" +
+		"\r\n"
+	b.Reset()
+	if _, err = WriteRequest(request, &b); err != nil || b.String() != expect{
+		t.Fatalf("expect %q, got %q %v", expect, b.String(), err)
+	}
+
+	//修改重复的header之后只保留一个
+	request.SetHeader("cookie", "c=3")
+	b.Reset()
+	if _, err = WriteRequest(request, &b); err != nil || !strings.Contains(b.String(), "\r\nCookie: c=3\r\nContent-Length"){
+		t.Fatalf("unexpected cookie header %q %v", b.String(), err)
+	}
+}
+
+//修改路径之后query保持原始的编码
+func TestRequestURIKeepsRawQuery(t *testing.T) {
+	request, err := ReadRequest(strings.NewReader("GET /api/x%20y?q=a%26b%3Dc&r=%2B1 HTTP/1.1\r\nHost: a\r\n\r\n"))
+	if err != nil{
+		t.Fatal(err)
+	}
+
+	request.stripPathPrefix("/api")
+	if uri := request.RequestURI(); uri != "/x%20y?q=a%26b%3Dc&r=%2B1"{
+		t.Fatalf("unexpected uri %q", uri)
+	}
+	if q, r := request.Query["q"], request.Query["r"]; len(q) != 1 || q[0] != "a&b=c" || len(r) != 1 || r[0] != "+1"{
+		t.Fatalf("unexpected query %v", request.Query)
+	}
+
+	//query被修改时按修改后的URI编码
+	request.URI = "/x?q=1 2"
+	if uri := request.RequestURI(); uri != "/x?q=1%202"{
+		t.Fatalf("unexpected uri %q", uri)
+	}
+
+	//重定向同样保持原始的query
+	request, _ = ReadRequest(strings.NewReader("GET /docs?q=a%26b HTTP/1.1\r\nHost: a\r\n\r\n"))
+	if _, response, _ := Chain(TrailingSlash(true, 301))(&ConnContext{}, request); response == nil || response.Header["Location"] != "/docs/?q=a%26b"{
+		t.Fatalf("unexpected redirect %+v", response)
+	}
+}
+
+func TestCrackRoundTrip(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	go func() {
+		_, _ = io.WriteString(client, rawRequest)
+	}()
+
+	crack, err := HTTPCRACK(server)
+	if err != nil{
+		t.Fatal(err)
+	}
+	defer crack.Close()
+	crack.SetRequestHandler(nil)
+
+	data := make([]byte, len(rawRequest))
+	if _, err = io.ReadFull(crack, data); err != nil || string(data) != rawRequest{
+		t.Fatalf("expect %q, got %q %v", rawRequest, data, err)
+	}
+}
@@ -0,0 +1,320 @@
+package go_virtual_host
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+type Response struct {
+	Version string
+
+	StatusCode int
+
+	Reason string
+
+	header map[string] string
+
+	//-1表示不存在
+	ContentLength int
+
+	//读取时header的顺序,包括重复的header,例如多个Set-Cookie
+	fields []headerField
+	//之后通过SetHeader新增的key
+	added []string
+}
+
+func (r *Response) Header(key string) string{
+	value, _ := headerGet(r.header, key)
+	return value
+}
+
+func (r *Response) SetHeader(key string, value string){
+	if r.header == nil{
+		r.header = make(map[string]string)
+	}
+
+	if _, ok := headerGet(r.header, key); !ok{
+		r.added = append(r.added, key)
+	}
+	headerSet(r.header, key, value)
+}
+
+//header的key大小写不敏感,优先精确匹配
+func headerGet(header map[string]string, key string) (string, bool){
+	if header == nil{
+		return "", false
+	}
+
+	if value, ok := header[key]; ok{
+		return value, true
+	}
+
+	for k, value := range header{
+		if strings.EqualFold(k, key){
+			return value, true
+		}
+	}//for
+
+	return "", false
+}
+
+//设置header时保留原有key的大小写
+func headerSet(header map[string]string, key string, value string){
+	for k := range header{
+		if k != key && strings.EqualFold(k, key){
+			delete(header, k)
+		}
+	}//for
+
+	header[key] = value
+}
+
+func headerDel(header map[string]string, key string){
+	for k := range header{
+		if strings.EqualFold(k, key){
+			delete(header, k)
+		}
+	}//for
+}
+
+//header中逗号分隔的值是否包含token(大小写不敏感)
+func headerHasToken(value string, token string) bool{
+	for _, v := range strings.Split(value, ","){
+		if strings.EqualFold(strings.TrimSpace(v), token){
+			return true
+		}
+	}
+	return false
+}
+
+//解析状态行
+//返回Version,StatusCode,Reason
+func parseStatusLine(statusLine string) (Version string, StatusCode int, Reason string, success bool){
+	infos := strings.SplitN(statusLine, " ", 3)
+
+	if len(infos) < 2 || !strings.HasPrefix(infos[0], "HTTP/"){
+		return
+	}
+
+	code, err := strconv.Atoi(infos[1])
+	if err != nil || code < 100 || code > 999{
+		return
+	}
+
+	Version = infos[0]
+	StatusCode = code
+	if len(infos) == 3{
+		Reason = infos[2]
+	}
+	success = true
+	return
+}
+
+func (tr *TextReader) ReadResponse() (response *Response, err error){
+	response = new(Response)
+
+	var line string
+	if line, err = tr.Readline(); err != nil{
+		return nil, err
+	}
+
+	var success bool
+	if response.Version, response.StatusCode, response.Reason, success = parseStatusLine(line); !success{
+		return nil, unexpectHttpMsg
+	}
+
+	if response.header, response.fields, err = tr.readHeader(len(line)); err != nil{
+		return nil, err
+	}
+
+	if response.ContentLength, err = parseContentLength(response.header); err != nil{
+		return nil, err
+	}
+
+	return response, nil
+}
+
+func ReadResponse(reader io.Reader) (*Response, error){
+	tr := NewTextReader(reader)
+	return tr.ReadResponse()
+}
+
+//和请求一样按读取时的顺序写入header,重复的header不会被合并
+func WriteResponse(response *Response, writer io.Writer) (int, error){
+	var b bytes.Buffer
+
+	b.WriteString(fmt.Sprintf("%s %d %s\r\n", response.Version, response.StatusCode, response.Reason))
+	writeOrderedHeader(&b, response.header, response.fields, response.added)
+	b.WriteString("\r\n")
+
+	return writer.Write(b.Bytes())
+}
+
+//由代理自己生成的错误响应,发送后需要关闭连接
+func writeErrorResponse(writer io.Writer, code int, reason string) error{
+	body := fmt.Sprintf("%d %s\n", code, reason)
+	response := &Response{
+		Version: "HTTP/1.1",
+		StatusCode: code,
+		Reason: reason,
+		header: map[string]string{
+			"Content-Type": "text/plain; charset=utf-8",
+			"Content-Length": strconv.Itoa(len(body)),
+			"Connection": "close",
+		},
+	}
+
+	if _, err := WriteResponse(response, writer); err != nil{
+		return err
+	}
+
+	_, err := io.WriteString(writer, body)
+	return err
+}
+
+//解析Content-Length,不存在返回-1
+func parseContentLength(header map[string]string) (int, error){
+	contentLenStr, ok := headerGet(header, "Content-Length")
+	if !ok{
+		return -1, nil
+	}
+
+	iNt64, err := strconv.ParseInt(strings.TrimSpace(contentLenStr), 10, 32)
+	if err != nil || iNt64 < 0{
+		return -1, unexpectHttpMsg
+	}
+
+	return int(iNt64), nil
+}
+
+func isChunked(header map[string]string) bool{
+	te, ok := headerGet(header, "Transfer-Encoding")
+	return ok && headerHasToken(te, "chunked")
+}
+
+//body的长度类型
+const (
+	bodyNone = iota
+	bodyLength
+	bodyChunked
+	bodyUntilClose
+)
+
+//请求的body只能由Transfer-Encoding或者Content-Length来确定
+func requestBodyKind(request *Request) int{
+	if isChunked(request.header){
+		return bodyChunked
+	}
+
+	if request.ContentLength > 0{
+		return bodyLength
+	}
+
+	return bodyNone
+}
+
+//响应的body由请求方法、状态码和header共同确定
+func responseBodyKind(request *Request, response *Response) int{
+	if request != nil && request.Method == "HEAD"{
+		return bodyNone
+	}
+
+	code := response.StatusCode
+	if (code >= 100 && code < 200) || code == 204 || code == 304{
+		return bodyNone
+	}
+
+	if isChunked(response.header){
+		return bodyChunked
+	}
+
+	if response.ContentLength >= 0{
+		if response.ContentLength == 0{
+			return bodyNone
+		}
+		return bodyLength
+	}
+
+	return bodyUntilClose
+}
+
+//按照body类型原样拷贝body
+func (tr *TextReader) copyBody(dst io.Writer, kind int, length int) (int64, error){
+	switch kind {
+	case bodyLength:
+		return tr.CopyN(dst, int64(length))
+	case bodyChunked:
+		return tr.copyChunked(dst)
+	case bodyUntilClose:
+		return io.Copy(dst, tr.br)
+	}
+
+	return 0, nil
+}
+
+//一直拷贝n个字节
+func (tr *TextReader) CopyN(dst io.Writer, n int64) (int64, error){
+	return io.CopyN(dst, tr.br, n)
+}
+
+//原样拷贝chunked编码的body,包括最后的trailer
+func (tr *TextReader) copyChunked(dst io.Writer) (written int64, err error){
+	var (
+		line string
+		n int
+		copied int64
+	)
+
+	for {
+		if line, err = tr.Readline(); err != nil{
+			return
+		}
+
+		if n, err = io.WriteString(dst, line + "\r\n"); err != nil{
+			return
+		}
+		written += int64(n)
+
+		var size int64
+		if size, err = parseChunkSize(line); err != nil{
+			return
+		}
+
+		if size == 0{
+			break
+		}
+
+		//chunk数据以及结尾的\r\n
+		if copied, err = tr.CopyN(dst, size + 2); err != nil{
+			written += copied
+			return
+		}
+		written += copied
+	}//for
+
+	n64, err := tr.copyTrailer(dst)
+	return written + n64, err
+}
+
+//原样拷贝trailer直到空行
+func (tr *TextReader) copyTrailer(dst io.Writer) (written int64, err error){
+	for {
+		line, err := tr.Readline()
+		if err != nil{
+			return written, err
+		}
+
+		n, err := io.WriteString(dst, line + "\r\n")
+		written += int64(n)
+		if err != nil{
+			return written, err
+		}
+
+		if line == ""{
+			return written, nil
+		}
+	}//for
+}
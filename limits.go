@@ -0,0 +1,125 @@
+package go_virtual_host
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+)
+
+const (
+	LimitLine = "line"
+	LimitHeaderBytes = "header bytes"
+	LimitHeaders = "headers"
+	LimitPeek = "peek"
+)
+
+//读取请求头和ClientHello时的限制,防止客户端发送超长的数据耗尽内存
+//0表示使用默认值,负数表示不限制
+type PeekLimits struct {
+	//单行的最大字节数,包括请求行和每个header
+	MaxLineBytes int
+
+	//请求行和所有header的最大字节数
+	MaxHeaderBytes int
+
+	//header的最大个数
+	MaxHeaders int
+
+	//识别Host或者SNI时最多缓存的字节数
+	MaxPeekBytes int
+}
+
+var DefaultPeekLimits = PeekLimits{
+	MaxLineBytes: 8 << 10,
+	MaxHeaderBytes: 64 << 10,
+	MaxHeaders: 100,
+	MaxPeekBytes: 80 << 10,
+}
+
+func (l PeekLimits) withDefaults() PeekLimits{
+	if l.MaxLineBytes == 0{
+		l.MaxLineBytes = DefaultPeekLimits.MaxLineBytes
+	}
+	if l.MaxHeaderBytes == 0{
+		l.MaxHeaderBytes = DefaultPeekLimits.MaxHeaderBytes
+	}
+	if l.MaxHeaders == 0{
+		l.MaxHeaders = DefaultPeekLimits.MaxHeaders
+	}
+	if l.MaxPeekBytes == 0{
+		l.MaxPeekBytes = DefaultPeekLimits.MaxPeekBytes
+	}
+	return l
+}
+
+//超过PeekLimits中的某个限制
+type LimitError struct {
+	//LimitLine、LimitHeaderBytes、LimitHeaders或者LimitPeek
+	Limit string
+	Max int
+}
+
+func (e *LimitError) Error() string{
+	return fmt.Sprintf("%s limit %d exceeded", e.Limit, e.Max)
+}
+
+func isLimitError(err error) bool{
+	var le *LimitError
+	return errors.As(err, &le)
+}
+
+//超过max时返回LimitError
+func exceeded(limit string, max int, n int) error{
+	if max > 0 && n > max{
+		return &LimitError{Limit: limit, Max: max}
+	}
+	return nil
+}
+
+func WithPeekLimits(limits PeekLimits) Option{
+	return func(p *Proxy) {
+		p.SetPeekLimits(limits)
+	}
+}
+
+//修改读取限制,只影响之后的连接
+func (p *Proxy) SetPeekLimits(limits PeekLimits){
+	p.peekLimits.Store(limits.withDefaults())
+}
+
+func (p *Proxy) PeekLimits() PeekLimits{
+	if limits, ok := p.peekLimits.Load().(PeekLimits); ok{
+		return limits
+	}
+	return DefaultPeekLimits
+}
+
+//缓存peek的字节,超过max时写入失败
+type peekBuffer struct {
+	*bytes.Buffer
+	max int
+}
+
+func (b peekBuffer) Write(p []byte) (int, error){
+	if err := exceeded(LimitPeek, b.max, b.Len() + len(p)); err != nil{
+		return 0, err
+	}
+	return b.Buffer.Write(p)
+}
+
+//超过限制时返回431,读取超时返回408,body长度不明确时返回400,返回写入的状态码,没有写入时为0
+func writeParseError(conn net.Conn, err error) int{
+	switch {
+	case isLimitError(err):
+		_ = writeErrorResponse(conn, 431, "Request Header Fields Too Large")
+		return 431
+	case isTimeout(err):
+		_ = writeErrorResponse(conn, 408, "Request Timeout")
+		return 408
+	case errors.Is(err, errAmbiguousBody):
+		_ = writeErrorResponse(conn, 400, "Bad Request")
+		return 400
+	}
+	return 0
+}
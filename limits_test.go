@@ -0,0 +1,82 @@
+package go_virtual_host
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTextReaderLimits(t *testing.T) {
+	limits := PeekLimits{MaxLineBytes: 64, MaxHeaderBytes: 128, MaxHeaders: 3}
+
+	cases := []struct{
+		name string
+		request string
+		limit string
+	}{
+		{"long line", "GET /" + strings.Repeat("a", 100) + " HTTP/1.1\r\n\r\n", LimitLine},
+		{"header bytes", "GET / HTTP/1.1\r\nA: " + strings.Repeat("a", 50) + "\r\nB: " + strings.Repeat("b", 50) + "\r\nC: " + strings.Repeat("c", 50) + "\r\n\r\n", LimitHeaderBytes},
+		{"header count", "GET / HTTP/1.1\r\nA: 1\r\nB: 2\r\nC: 3\r\nD: 4\r\n\r\n", LimitHeaders},
+	}
+
+	for _, c := range cases{
+		_, err := newLimitedTextReader(strings.NewReader(c.request), limits).ReadRequest()
+		le, ok := err.(*LimitError)
+		if !ok || le.Limit != c.limit{
+			t.Fatalf("%s: expect %s limit error, got %v", c.name, c.limit, err)
+		}
+	}
+
+	request, err := newLimitedTextReader(strings.NewReader("GET / HTTP/1.1\r\nHost: a\r\n\r\n"), limits).ReadRequest()
+	if err != nil || request.Header("Host") != "a"{
+		t.Fatalf("unexpected result %v %v", request, err)
+	}
+}
+
+func TestPeekBufferLimit(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	go func() {
+		//record长度为0x2000的ClientHello
+		_, _ = client.Write([]byte{0x16, 0x03, 0x01, 0x20, 0x00})
+		_, _ = client.Write(make([]byte, 0x2000))
+	}()
+
+	_, err := newTlsConn(server, PeekLimits{MaxPeekBytes: 1024})
+	if !isLimitError(err){
+		t.Fatalf("expect limit error, got %v", err)
+	}
+}
+
+func TestProxyAnswers431(t *testing.T) {
+	backend := startBackend(t, "a")
+	defer backend.Close()
+
+	getProxy := func(request *Request) (net.Conn, error){
+		return net.Dial("tcp", backend.Addr().String())
+	}
+
+	server := NewCrackProxy("127.0.0.1:0", getProxy, nil, WithPeekLimits(PeekLimits{MaxLineBytes: 128}))
+	proxy := server.(*Proxy)
+	defer proxy.Close()
+	server.AsyncStart()
+
+	conn, err := net.Dial("tcp", proxy.Addr().String())
+	if err != nil{
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	_, _ = io.WriteString(conn, "GET / HTTP/1.1\r\nCookie: " + strings.Repeat("a", 1024) + "\r\n\r\n")
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	data, err := ioutil.ReadAll(conn)
+	if !strings.HasPrefix(string(data), "HTTP/1.1 431 "){
+		t.Fatalf("expect 431, got %q %v", data, err)
+	}
+}
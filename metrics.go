@@ -0,0 +1,426 @@
+package go_virtual_host
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//host来自客户端,超过这个数量之后的host统计为other
+const maxHostLabels = 1000
+
+//连接后端耗时的分桶,单位为秒
+var dialBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+//一组相同名字、不同label的值,counter和gauge共用
+type metricVec struct {
+	name string
+	help string
+	typ string
+	labels []string
+
+	mu sync.Mutex
+	values map[string]float64
+}
+
+func newMetricVec(typ string, name string, help string, labels ...string) *metricVec{
+	return &metricVec{name: name, help: help, typ: typ, labels: labels, values: make(map[string]float64)}
+}
+
+//label的值用\xff连接作为key
+func labelKey(values []string) string{
+	return strings.Join(values, "\xff")
+}
+
+func (v *metricVec) add(delta float64, labelValues ...string){
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.values[labelKey(labelValues)] += delta
+}
+
+func (v *metricVec) set(value float64, labelValues ...string){
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.values[labelKey(labelValues)] = value
+}
+
+func (v *metricVec) write(w io.Writer){
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	writeMetricHeader(w, v.name, v.help, v.typ)
+	for _, key := range sortedKeys(v.values){
+		fmt.Fprintf(w, "%s%s %s\n", v.name, formatLabels(v.labels, strings.Split(key, "\xff"), "", ""), formatValue(v.values[key]))
+	}
+}
+
+type histogram struct {
+	counts []uint64
+	sum float64
+	count uint64
+}
+
+type histogramVec struct {
+	name string
+	help string
+	labels []string
+	buckets []float64
+
+	mu sync.Mutex
+	values map[string]*histogram
+}
+
+func newHistogramVec(name string, help string, buckets []float64, labels ...string) *histogramVec{
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, values: make(map[string]*histogram)}
+}
+
+func (v *histogramVec) observe(value float64, labelValues ...string){
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	key := labelKey(labelValues)
+	h, ok := v.values[key]
+	if !ok{
+		h = &histogram{counts: make([]uint64, len(v.buckets))}
+		v.values[key] = h
+	}
+
+	for i, bound := range v.buckets{
+		if value <= bound{
+			h.counts[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+func (v *histogramVec) write(w io.Writer){
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	writeMetricHeader(w, v.name, v.help, "histogram")
+
+	keys := make([]string, 0, len(v.values))
+	for key := range v.values{
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys{
+		h, values := v.values[key], strings.Split(key, "\xff")
+		for i, bound := range v.buckets{
+			fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, formatLabels(v.labels, values, "le", formatValue(bound)), h.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, formatLabels(v.labels, values, "le", "+Inf"), h.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", v.name, formatLabels(v.labels, values, "", ""), formatValue(h.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", v.name, formatLabels(v.labels, values, "", ""), h.count)
+	}//for
+}
+
+func writeMetricHeader(w io.Writer, name string, help string, typ string){
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+//extraName不为空时追加一个label,用于histogram的le
+func formatLabels(names []string, values []string, extraName string, extraValue string) string{
+	if len(names) == 0 && extraName == ""{
+		return ""
+	}
+
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names{
+		if i > 0{
+			b.WriteByte(',')
+		}
+		value := ""
+		if i < len(values){
+			value = values[i]
+		}
+		fmt.Fprintf(&b, "%s=\"%s\"", name, escapeLabel(value))
+	}
+
+	if extraName != ""{
+		if len(names) > 0{
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=\"%s\"", extraName, extraValue)
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var labelEscaper = strings.NewReplacer("\\", `\\`, "\"", `\"`, "\n", `\n`)
+
+func escapeLabel(value string) string{
+	return labelEscaper.Replace(value)
+}
+
+func formatValue(value float64) string{
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func sortedKeys(values map[string]float64) []string{
+	keys := make([]string, 0, len(values))
+	for key := range values{
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+//代理的监控指标,以Prometheus的文本格式输出
+//所有方法都可以在nil上调用,没有设置Metrics的代理不做统计
+type Metrics struct {
+	accepted *metricVec
+	active *metricVec
+	bytes *metricVec
+	parseErrors *metricVec
+	dialRetries *metricVec
+	dialDuration *histogramVec
+
+	mu sync.Mutex
+	hosts map[string]bool
+	//输出时读取的后端状态和重新加载的统计,由Manager设置
+	backendStatus func() map[string][]BackendStatus
+	reloadStats func() ReloadStats
+}
+
+func NewMetrics() *Metrics{
+	return &Metrics{
+		accepted: newMetricVec("counter", "vhost_connections_accepted_total", "Connections accepted.", "listener"),
+		active: newMetricVec("gauge", "vhost_connections_active", "Connections being handled.", "listener"),
+		bytes: newMetricVec("counter", "vhost_bytes_total", "Bytes forwarded, in is client to backend and out is backend to client.", "listener", "host", "backend", "direction"),
+		parseErrors: newMetricVec("counter", "vhost_parse_errors_total", "Errors reading the request header or client hello.", "listener", "type"),
+		dialRetries: newMetricVec("counter", "vhost_dial_retries_total", "Backend dial attempts after the first one.", "listener"),
+		dialDuration: newHistogramVec("vhost_dial_duration_seconds", "Backend dial latency.", dialBuckets, "listener", "backend", "result"),
+		hosts: make(map[string]bool),
+	}
+}
+
+//代理使用m统计,多个代理可以共用一个Metrics
+func WithMetrics(m *Metrics) Option{
+	return func(p *Proxy) {
+		p.metrics = m
+	}
+}
+
+func (m *Metrics) connAccepted(listener string){
+	if m == nil{
+		return
+	}
+	m.accepted.add(1, listener)
+	m.active.add(1, listener)
+}
+
+func (m *Metrics) connClosed(listener string){
+	if m == nil{
+		return
+	}
+	m.active.add(-1, listener)
+}
+
+func (m *Metrics) addBytes(listener string, host string, backend string, in int64, out int64){
+	if m == nil{
+		return
+	}
+	m.mu.Lock()
+	if !m.hosts[host]{
+		if len(m.hosts) < maxHostLabels{
+			m.hosts[host] = true
+		}else{
+			host = "other"
+		}
+	}
+	m.mu.Unlock()
+
+	m.bytes.add(float64(in), listener, host, backend, "in")
+	m.bytes.add(float64(out), listener, host, backend, "out")
+}
+
+func (m *Metrics) parseError(listener string, err error){
+	if m == nil{
+		return
+	}
+	m.parseErrors.add(1, listener, parseErrorType(err))
+}
+
+func (m *Metrics) dialRetry(listener string){
+	if m == nil{
+		return
+	}
+	m.dialRetries.add(1, listener)
+}
+
+func (m *Metrics) observeDial(listener string, conn net.Conn, err error, elapsed time.Duration){
+	if m == nil{
+		return
+	}
+
+	//后端都不可用时没有实际连接
+	if isBackendUnavailable(err){
+		return
+	}
+
+	backend, result := "unknown", "success"
+	if err != nil{
+		result = "error"
+		var oe *net.OpError
+		if errors.As(err, &oe) && oe.Addr != nil{
+			backend = oe.Addr.String()
+		}
+	}else if conn.RemoteAddr() != nil{
+		backend = conn.RemoteAddr().String()
+	}
+	m.dialDuration.observe(elapsed.Seconds(), listener, backend, result)
+}
+
+//输出时读取后端状态和重新加载的统计
+func (m *Metrics) setSources(backendStatus func() map[string][]BackendStatus, reloadStats func() ReloadStats){
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.backendStatus = backendStatus
+	m.reloadStats = reloadStats
+}
+
+var alertTypes = map[alert]string{
+	alertRecordOverflow: "tls_record_overflow",
+	alertInternalError: "tls_internal_error",
+	alertUnexpectedMsg: "tls_unexpected_message",
+	alertUnsupportTls: "tls_unsupported_version",
+}
+
+//解析错误的类型,用作label
+func parseErrorType(err error) string{
+	var (
+		a alert
+		le *LimitError
+	)
+
+	switch {
+	case errors.As(err, &a):
+		if typ, ok := alertTypes[a]; ok{
+			return typ
+		}
+		return "tls_alert"
+	case errors.Is(err, unexpectHttpMsg):
+		return "unexpected_http_message"
+	case errors.As(err, &le):
+		return "limit_" + strings.Replace(le.Limit, " ", "_", -1)
+	case errors.Is(err, errProxyProtocol):
+		return "proxy_protocol"
+	case isTimeout(err):
+		return "timeout"
+	case errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF):
+		return "eof"
+	}
+	return "other"
+}
+
+//按Prometheus的文本格式输出所有指标
+func (m *Metrics) WriteTo(w io.Writer) (int64, error){
+	cw := &countWriter{w: bufio.NewWriter(w)}
+
+	m.accepted.write(cw)
+	m.active.write(cw)
+	m.bytes.write(cw)
+	m.parseErrors.write(cw)
+	m.dialRetries.write(cw)
+	m.dialDuration.write(cw)
+
+	m.mu.Lock()
+	backendStatus, reloadStats := m.backendStatus, m.reloadStats
+	m.mu.Unlock()
+
+	if backendStatus != nil{
+		writeBackendMetrics(cw, backendStatus())
+	}
+	if reloadStats != nil{
+		writeReloadMetrics(cw, reloadStats())
+	}
+
+	if err := cw.w.Flush(); err != nil{
+		return cw.n, err
+	}
+	return cw.n, cw.err
+}
+
+func writeBackendMetrics(w io.Writer, status map[string][]BackendStatus){
+	healthy := newMetricVec("gauge", "vhost_backend_healthy", "Whether the backend passes active health checks.", "pool", "backend")
+	ejected := newMetricVec("gauge", "vhost_backend_ejected", "Whether the backend is ejected by outlier detection.", "pool", "backend")
+	circuit := newMetricVec("gauge", "vhost_backend_circuit_state", "Circuit breaker state of the backend.", "pool", "backend", "state")
+	active := newMetricVec("gauge", "vhost_backend_active_connections", "Connections open to the backend.", "pool", "backend")
+
+	boolValue := func(b bool) float64 {
+		if b{
+			return 1
+		}
+		return 0
+	}
+
+	for pool, backends := range status{
+		for _, s := range backends{
+			healthy.set(boolValue(s.Healthy), pool, s.Addr)
+			ejected.set(boolValue(s.Ejected), pool, s.Addr)
+			active.set(float64(s.Active), pool, s.Addr)
+			for _, state := range []string{CircuitClosed, CircuitOpen, CircuitHalfOpen}{
+				circuit.set(boolValue(s.Circuit == state), pool, s.Addr, state)
+			}
+		}
+	}//for
+
+	healthy.write(w)
+	ejected.write(w)
+	circuit.write(w)
+	active.write(w)
+}
+
+func writeReloadMetrics(w io.Writer, stats ReloadStats){
+	reloads := newMetricVec("counter", "vhost_config_reloads_total", "Config reloads.", "result")
+	reloads.set(float64(stats.Successes), "success")
+	reloads.set(float64(stats.Failures), "failure")
+	reloads.write(w)
+
+	if !stats.LastReload.IsZero(){
+		last := newMetricVec("gauge", "vhost_config_last_reload_timestamp_seconds", "Time of the last config reload.")
+		last.set(float64(stats.LastReload.UnixNano()) / 1e9)
+		last.write(w)
+	}
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request){
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = m.WriteTo(w)
+}
+
+//统计写入的字节数,记录第一个错误
+type countWriter struct {
+	w *bufio.Writer
+	n int64
+	err error
+}
+
+func (cw *countWriter) Write(p []byte) (int, error){
+	if cw.err != nil{
+		return 0, cw.err
+	}
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	cw.err = err
+	return n, err
+}
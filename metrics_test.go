@@ -0,0 +1,141 @@
+package go_virtual_host
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsTextFormat(t *testing.T) {
+	counter := newMetricVec("counter", "test_total", "Test counter.", "host")
+	counter.add(2, `a"b`)
+
+	hist := newHistogramVec("test_seconds", "Test histogram.", []float64{0.1, 1}, "backend")
+	hist.observe(0.5, "x")
+
+	var buf bytes.Buffer
+	counter.write(&buf)
+	hist.write(&buf)
+
+	expect := `# HELP test_total Test counter.
+# TYPE test_total counter
+test_total{host="a\"b"} 2
+# HELP test_seconds Test histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{backend="x",le="0.1"} 0
+test_seconds_bucket{backend="x",le="1"} 1
+test_seconds_bucket{backend="x",le="+Inf"} 1
+test_seconds_sum{backend="x"} 0.5
+test_seconds_count{backend="x"} 1
+`
+	if buf.String() != expect{
+		t.Fatalf("unexpected output:\n%s", buf.String())
+	}
+}
+
+func TestProxyMetrics(t *testing.T) {
+	backend := startBackend(t, "a")
+	defer backend.Close()
+
+	getProxy := func(request *Request) (net.Conn, error){
+		return net.Dial("tcp", backend.Addr().String())
+	}
+
+	metrics := NewMetrics()
+	server := NewCommonProxy("127.0.0.1:0", getProxy, WithMetrics(metrics))
+	proxy := server.(*Proxy)
+	defer proxy.Close()
+	server.AsyncStart()
+
+	good := "GET / HTTP/1.1\r\nHost: A.example.com:80\r\n\r\n"
+	for _, request := range []string{good, "BAD\r\n\r\n"}{
+		conn, err := net.Dial("tcp", proxy.Addr().String())
+		if err != nil{
+			t.Fatal(err)
+		}
+		_, _ = io.WriteString(conn, request)
+		_ = conn.(*net.TCPConn).CloseWrite()
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, _ = ioutil.ReadAll(conn)
+		_ = conn.Close()
+	}
+
+	listener := proxy.Addr().String()
+	expects := []string{
+		`vhost_connections_accepted_total{listener="` + listener + `"} 2`,
+		`vhost_parse_errors_total{listener="` + listener + `",type="unexpected_http_message"} 1`,
+		`vhost_bytes_total{listener="` + listener + `",host="a.example.com",backend="` + backend.Addr().String() + `",direction="in"} ` + strconv.Itoa(len(good)),
+		`vhost_dial_duration_seconds_count{listener="` + listener + `",backend="` + backend.Addr().String() + `",result="success"} 1`,
+	}
+
+	//连接关闭之后才会统计字节数
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		var buf bytes.Buffer
+		_, _ = metrics.WriteTo(&buf)
+
+		missing := ""
+		for _, expect := range expects{
+			if !strings.Contains(buf.String(), expect){
+				missing = expect
+				break
+			}
+		}
+
+		if missing == ""{
+			return
+		}
+		if time.Now().After(deadline){
+			t.Fatalf("missing %s in:\n%s", missing, buf.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}//for
+}
+
+func TestManagerMetricsEndpoint(t *testing.T) {
+	a := startBackend(t, "a")
+	defer a.Close()
+
+	dir, err := ioutil.TempDir("", "vhost")
+	if err != nil{
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config.json")
+	writeConfig(t, path, a.Addr().String())
+
+	m, err := NewManager(path)
+	if err != nil{
+		t.Fatal(err)
+	}
+	if err = m.Start(); err != nil{
+		t.Fatal(err)
+	}
+	defer m.Stop()
+
+	_ = getBody(t, m.Proxies()["web"].Addr().String())
+
+	recorder := httptest.NewRecorder()
+	m.adminHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	body := recorder.Body.String()
+	for _, expect := range []string{
+		`vhost_backend_healthy{pool="web",backend="` + a.Addr().String() + `"} 1`,
+		`vhost_backend_circuit_state{pool="web",backend="` + a.Addr().String() + `",state="closed"} 1`,
+		`vhost_config_reloads_total{result="success"} 0`,
+		`vhost_connections_accepted_total{listener=`,
+	}{
+		if !strings.Contains(body, expect){
+			t.Fatalf("missing %s in:\n%s", expect, body)
+		}
+	}
+}
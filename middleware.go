@@ -0,0 +1,229 @@
+package go_virtual_host
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+//crack模式下一个客户端连接的上下文,同一连接上的请求共用
+type ConnContext struct {
+	//经过PROXY protocol时为真实客户端地址
+	ClientAddr net.Addr
+	LocalAddr net.Addr
+
+	//代理终止TLS时为握手后的状态,否则为nil
+	TLS *tls.ConnectionState
+
+	//当前请求在连接上的序号,从0开始
+	Index int
+
+	//middleware之间共享的数据
+	Values map[string]interface{}
+}
+
+func newConnContext(conn net.Conn) *ConnContext{
+	ctx := &ConnContext{
+		ClientAddr: conn.RemoteAddr(),
+		LocalAddr: conn.LocalAddr(),
+		Values: make(map[string]interface{}),
+	}
+
+	if tc, ok := conn.(*tls.Conn); ok{
+		state := tc.ConnectionState()
+		ctx.TLS = &state
+	}
+	return ctx
+}
+
+//代理接受连接后先完成TLS握手,之后按明文处理,不能用于tls模式
+func WithTLSConfig(config *tls.Config) Option{
+	return func(p *Proxy) {
+		p.tlsConfig = config
+	}
+}
+
+//处理一个请求,返回值有三种情况:
+//  转发: 返回请求,可以是修改后的请求
+//  短路: 返回response,response直接写给客户端,请求不再转发
+//  失败: 返回error,HttpError按其中的状态码响应,其他错误响应500
+//短路和失败之后连接会被关闭
+type RequestHandler func(ctx *ConnContext, request *Request) (*Request, *DirectResponse, error)
+
+//包装next,可以在调用next之前或者之后处理请求,也可以不调用next
+type Middleware func(next RequestHandler) RequestHandler
+
+//按顺序组合middleware,第一个最先处理请求,最后由原样返回请求的handler结束
+func Chain(middlewares ...Middleware) RequestHandler{
+	handler := RequestHandler(func(ctx *ConnContext, request *Request) (*Request, *DirectResponse, error) {
+		return request, nil, nil
+	})
+
+	for i := len(middlewares) - 1; i >= 0; i--{
+		handler = middlewares[i](handler)
+	}//for
+	return handler
+}
+
+//把func(*Request) *Request形式的handler转换为middleware,handler为nil时不做修改
+func RequestFunc(handler func(*Request) *Request) Middleware{
+	return func(next RequestHandler) RequestHandler {
+		if handler == nil{
+			return next
+		}
+
+		return func(ctx *ConnContext, request *Request) (*Request, *DirectResponse, error) {
+			return next(ctx, handler(request))
+		}
+	}
+}
+
+//代理在每个请求的handler之后执行middlewares,目前只有crack模式支持
+func WithMiddleware(middlewares ...Middleware) Option{
+	return func(p *Proxy) {
+		p.middlewares = append(p.middlewares, middlewares...)
+	}
+}
+
+//由middleware直接返回给客户端的响应
+type DirectResponse struct {
+	StatusCode int
+	//为空时使用状态码对应的默认值
+	Reason string
+	Header map[string]string
+	Body []byte
+}
+
+//返回text/plain的响应
+func Respond(status int, body string) *DirectResponse{
+	return &DirectResponse{
+		StatusCode: status,
+		Header: map[string]string{"Content-Type": "text/plain; charset=utf-8"},
+		Body: []byte(body),
+	}
+}
+
+//写入完整的响应,Content-Length按Body设置,写入后连接会被关闭
+func (r *DirectResponse) write(w io.Writer) error{
+	reason := r.Reason
+	if reason == ""{
+		reason = statusText(r.StatusCode)
+	}
+
+	response := &Response{Version: "HTTP/1.1", StatusCode: r.StatusCode, Reason: reason}
+	for key, value := range r.Header{
+		response.SetHeader(key, value)
+	}
+	response.SetHeader("Content-Length", strconv.Itoa(len(r.Body)))
+	response.SetHeader("Connection", "close")
+
+	//响应头和body一起写入,避免和后端的响应交错
+	var b strings.Builder
+	if _, err := WriteResponse(response, &b); err != nil{
+		return err
+	}
+	b.Write(r.Body)
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+var statusTexts = map[int]string{
+	200: "OK",
+	204: "No Content",
+	301: "Moved Permanently",
+	302: "Found",
+	303: "See Other",
+	307: "Temporary Redirect",
+	308: "Permanent Redirect",
+	400: "Bad Request",
+	401: "Unauthorized",
+	403: "Forbidden",
+	404: "Not Found",
+	405: "Method Not Allowed",
+	413: "Payload Too Large",
+	421: "Misdirected Request",
+	429: "Too Many Requests",
+	500: "Internal Server Error",
+	502: "Bad Gateway",
+	503: "Service Unavailable",
+}
+
+func statusText(status int) string{
+	if text, ok := statusTexts[status]; ok{
+		return text
+	}
+	return "Status " + strconv.Itoa(status)
+}
+
+//middleware返回的带状态码的错误
+type HttpError struct {
+	StatusCode int
+	Message string
+}
+
+func (e *HttpError) Error() string{
+	return fmt.Sprintf("%d %s", e.StatusCode, e.Message)
+}
+
+//middleware失败时写给客户端的响应
+func errorResponse(err error) *DirectResponse{
+	var he *HttpError
+	if errors.As(err, &he){
+		return Respond(he.StatusCode, he.Message + "\n")
+	}
+	return Respond(500, statusText(500) + "\n")
+}
+
+//按HeaderRules修改请求头,顺序为Remove、Rename、Set
+func Headers(rules *HeaderRules) Middleware{
+	return RequestFunc(func(request *Request) *Request {
+		rules.apply(request)
+		return request
+	})
+}
+
+func SetHeaders(headers map[string]string) Middleware{
+	return Headers(&HeaderRules{Set: headers})
+}
+
+func RemoveHeaders(keys ...string) Middleware{
+	return Headers(&HeaderRules{Remove: keys})
+}
+
+//key为原来的header,value为新的header
+func RenameHeaders(names map[string]string) Middleware{
+	return Headers(&HeaderRules{Rename: names})
+}
+
+//用rewrite的结果替换URI,包括query
+func RewriteURI(rewrite func(uri string) string) Middleware{
+	return RequestFunc(func(request *Request) *Request {
+		request.URI = rewrite(request.URI)
+		return request
+	})
+}
+
+//把路径前缀from替换为to,路径不以from开头时不修改
+func RewritePathPrefix(from string, to string) Middleware{
+	return RewriteURI(func(uri string) string {
+		if !strings.HasPrefix(uri, from){
+			return uri
+		}
+
+		uri = to + strings.TrimPrefix(uri, from)
+		if !strings.HasPrefix(uri, "/"){
+			uri = "/" + uri
+		}
+		return uri
+	})
+}
+
+//把Host替换为host,转发到后端的请求使用新的Host
+func RewriteHost(host string) Middleware{
+	return SetHeaders(map[string]string{"Host": host})
+}
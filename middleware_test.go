@@ -0,0 +1,203 @@
+package go_virtual_host
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestChain(t *testing.T) {
+	var calls []string
+	record := func(name string) Middleware {
+		return func(next RequestHandler) RequestHandler {
+			return func(ctx *ConnContext, request *Request) (*Request, *DirectResponse, error) {
+				calls = append(calls, name)
+				if request.URI == "/stop/" + name{
+					return nil, Respond(204, ""), nil
+				}
+				return next(ctx, request)
+			}
+		}
+	}
+
+	handler := Chain(record("a"), RewritePathPrefix("/x/", "/stop/"), record("b"), record("c"))
+
+	request, response, err := handler(&ConnContext{}, &Request{URI: "/y"})
+	if request == nil || response != nil || err != nil || fmt.Sprint(calls) != "[a b c]"{
+		t.Fatalf("unexpected result %v %v %v %v", request, response, err, calls)
+	}
+
+	calls = nil
+	request, response, _ = handler(&ConnContext{}, &Request{URI: "/x/b"})
+	if request != nil || response.StatusCode != 204 || fmt.Sprint(calls) != "[a b]"{
+		t.Fatalf("expect short circuit at b, got %v %v", response, calls)
+	}
+}
+
+//返回Host、URI和X-Index
+func startEchoBackend(t *testing.T) net.Listener{
+	return startHttpBackend(t, func(conn net.Conn, tr *TextReader, request *Request) bool {
+		writeOK(conn, fmt.Sprintf("%s %s %s", request.Header("Host"), request.URI, request.Header("X-Index")))
+		return true
+	})
+}
+
+//发送请求并读取响应
+func roundTrip(t *testing.T, conn net.Conn, tr *TextReader, request string) (*Response, string){
+	if _, err := io.WriteString(conn, request); err != nil{
+		t.Fatal(err)
+	}
+
+	response, err := tr.ReadResponse()
+	if err != nil{
+		t.Fatal(err)
+	}
+	body, err := tr.ReadUntilN(response.ContentLength)
+	if err != nil{
+		t.Fatal(err)
+	}
+	return response, string(body)
+}
+
+func TestCrackMiddleware(t *testing.T) {
+	backend := startEchoBackend(t)
+	defer backend.Close()
+
+	var dials int32
+	getProxy := func(request *Request) (net.Conn, error){
+		atomic.AddInt32(&dials, 1)
+		return net.Dial("tcp", backend.Addr().String())
+	}
+
+	guard := func(next RequestHandler) RequestHandler {
+		return func(ctx *ConnContext, request *Request) (*Request, *DirectResponse, error) {
+			switch request.Path() {
+			case "/deny":
+				return nil, Respond(403, "denied\n"), nil
+			case "/fail":
+				return nil, nil, &HttpError{StatusCode: 429, Message: "slow down"}
+			case "/panic":
+				return nil, nil, errors.New("internal")
+			}
+			request.SetHeader("X-Index", strconv.Itoa(ctx.Index))
+			return next(ctx, request)
+		}
+	}
+
+	proxy := NewCrackProxy("127.0.0.1:0", getProxy, nil, WithMiddleware(
+		guard,
+		RewritePathPrefix("/old/", "/new/"),
+		RewriteHost("backend.local"),
+		RemoveHeaders("X-Secret"),
+	)).(*Proxy)
+	defer proxy.Close()
+	proxy.AsyncStart()
+
+	conn, err := net.Dial("tcp", proxy.Addr().String())
+	if err != nil{
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	tr := NewTextReader(conn)
+
+	if _, body := roundTrip(t, conn, tr, "GET /old/x HTTP/1.1\r\nHost: example.com\r\n\r\n"); body != "backend.local /new/x 0"{
+		t.Fatalf("unexpected body %q", body)
+	}
+	if _, body := roundTrip(t, conn, tr, "GET /y HTTP/1.1\r\nHost: example.com\r\n\r\n"); body != "backend.local /y 1"{
+		t.Fatalf("unexpected body %q", body)
+	}
+
+	//之后的请求被短路,连接随之关闭
+	response, body := roundTrip(t, conn, tr, "GET /deny HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	if response.StatusCode != 403 || body != "denied\n" || response.Header("Connection") != "close"{
+		t.Fatalf("unexpected response %+v %q", response, body)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err = conn.Read(make([]byte, 1)); err != io.EOF{
+		t.Fatalf("expect EOF, got %v", err)
+	}
+
+	//第一个请求被短路或者失败时不连接后端
+	before := atomic.LoadInt32(&dials)
+	for path, status := range map[string]int{"/deny": 403, "/fail": 429, "/panic": 500}{
+		c, err := net.Dial("tcp", proxy.Addr().String())
+		if err != nil{
+			t.Fatal(err)
+		}
+
+		response, _ = roundTrip(t, c, NewTextReader(c), "GET " + path + " HTTP/1.1\r\nHost: example.com\r\n\r\n")
+		_ = c.Close()
+		if response.StatusCode != status{
+			t.Fatalf("%s: expect %d, got %d", path, status, response.StatusCode)
+		}
+	}//for
+	if atomic.LoadInt32(&dials) != before{
+		t.Fatal("backend should not be dialed for answered requests")
+	}
+}
+
+func selfSignedCert(t *testing.T) tls.Certificate{
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil{
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject: pkix.Name{CommonName: "example.com"},
+		DNSNames: []string{"example.com"},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter: time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil{
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestMiddlewareTLSContext(t *testing.T) {
+	backend := startEchoBackend(t)
+	defer backend.Close()
+
+	getProxy := func(request *Request) (net.Conn, error){
+		return net.Dial("tcp", backend.Addr().String())
+	}
+
+	sni := func(next RequestHandler) RequestHandler {
+		return func(ctx *ConnContext, request *Request) (*Request, *DirectResponse, error) {
+			if ctx.TLS == nil{
+				return nil, Respond(400, "tls required\n"), nil
+			}
+			request.SetHeader("X-Index", ctx.TLS.ServerName)
+			return next(ctx, request)
+		}
+	}
+
+	config := &tls.Config{Certificates: []tls.Certificate{selfSignedCert(t)}}
+	proxy := NewCrackProxy("127.0.0.1:0", getProxy, nil, WithTLSConfig(config), WithMiddleware(sni)).(*Proxy)
+	defer proxy.Close()
+	proxy.AsyncStart()
+
+	conn, err := tls.Dial("tcp", proxy.Addr().String(), &tls.Config{ServerName: "example.com", InsecureSkipVerify: true})
+	if err != nil{
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, body := roundTrip(t, conn, NewTextReader(conn), "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"); body != "example.com / example.com"{
+		t.Fatalf("unexpected body %q", body)
+	}
+}
@@ -0,0 +1,355 @@
+package go_virtual_host
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var errHalfCloseUnsupported = errors.New("half close not supported")
+
+const copyBufferSize = 32 * 1024
+
+//HttpCrack等无法直接使用内部连接时,复制数据使用的缓冲
+var copyBufferPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, copyBufferSize)
+		return &b
+	},
+}
+
+//包装了其他连接的net.Conn,写入时可以直接使用内部的连接
+type wrappedConn interface {
+	innerConn() net.Conn
+}
+
+//读取时缓存了部分数据的包装,取出缓存的数据之后可以直接从内部的连接读取
+type bufferedConn interface {
+	wrappedConn
+	takeBuffered() []byte
+}
+
+//读取时需要解析数据的包装,例如crack模式下跟踪请求和响应
+//tracking返回false之后不再需要解析,可以直接从内部的连接读取
+type trackingConn interface {
+	net.Conn
+	wrappedConn
+	tracking() bool
+}
+
+func (s *sharedConn) innerConn() net.Conn{
+	return s.Conn
+}
+
+func (s *sharedConn) takeBuffered() []byte{
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.vbuff == nil{
+		return nil
+	}
+
+	data := s.vbuff.Bytes()
+	s.vbuff = nil
+	return data
+}
+
+func (pc *proxyProtoConn) innerConn() net.Conn{
+	return pc.Conn
+}
+
+func (pc *proxyProtoConn) takeBuffered() []byte{
+	data, _ := pc.br.Peek(pc.br.Buffered())
+	data = append([]byte(nil), data...)
+	_, _ = pc.br.Discard(len(data))
+	return data
+}
+
+//解析完HTTP头部之后转为原样转发的连接,TextReader中缓存的数据读完之后从conn读取
+//用于CONNECT隧道和keepalive模式下升级之后的连接
+type bufioConn struct {
+	net.Conn
+	tr *TextReader
+}
+
+func (bc *bufioConn) Read(b []byte) (int, error){
+	return bc.tr.br.Read(b)
+}
+
+func (bc *bufioConn) innerConn() net.Conn{
+	return bc.Conn
+}
+
+func (bc *bufioConn) takeBuffered() []byte{
+	br := bc.tr.br
+	data, _ := br.Peek(br.Buffered())
+	data = append([]byte(nil), data...)
+	_, _ = br.Discard(len(data))
+	return data
+}
+
+//缓存的数据在内部的bufioConn或者TlsConn中
+func (c *ConnectConn) innerConn() net.Conn{
+	return c.Conn
+}
+
+func (c *ConnectConn) takeBuffered() []byte{
+	return nil
+}
+
+//HttpCrack需要逐个解析请求,升级之后才可以直接从内部的连接读取
+func (hCrack *HttpCrack) innerConn() net.Conn{
+	return hCrack.Conn
+}
+
+func (hCrack *HttpCrack) tracking() bool{
+	return hCrack.Upgraded == ""
+}
+
+//升级之后缓冲区中还没有转发的数据,包括TextReader中已经读取的部分
+func (hCrack *HttpCrack) takeBuffered() []byte{
+	data := append([]byte(nil), hCrack.vbuff.Bytes()...)
+	hCrack.vbuff.Reset()
+
+	br := hCrack.txReader.br
+	buffered, _ := br.Peek(br.Buffered())
+	data = append(data, buffered...)
+	_, _ = br.Discard(len(buffered))
+	return data
+}
+
+func (c *backendTrackedConn) innerConn() net.Conn{
+	return c.Conn
+}
+
+func (c *backendTrackedConn) takeBuffered() []byte{
+	return nil
+}
+
+//可以只关闭写方向的连接,例如*net.TCPConn
+type closeWriter interface {
+	CloseWrite() error
+}
+
+//关闭conn的写方向,对端会读到EOF,conn不支持时返回errHalfCloseUnsupported
+func closeWrite(conn net.Conn) error{
+	if cw, ok := conn.(closeWriter); ok{
+		return cw.CloseWrite()
+	}
+	return errHalfCloseUnsupported
+}
+
+//包装的连接把半关闭传递给内部的连接,HttpConn和TlsConn通过sharedConn支持
+func (s *sharedConn) CloseWrite() error{
+	return closeWrite(s.Conn)
+}
+
+func (hCrack *HttpCrack) CloseWrite() error{
+	return closeWrite(hCrack.Conn)
+}
+
+func (pc *proxyProtoConn) CloseWrite() error{
+	return closeWrite(pc.Conn)
+}
+
+func (bc *bufioConn) CloseWrite() error{
+	return closeWrite(bc.Conn)
+}
+
+func (c *ConnectConn) CloseWrite() error{
+	return closeWrite(c.Conn)
+}
+
+func (c *backendTrackedConn) CloseWrite() error{
+	return closeWrite(c.Conn)
+}
+
+//一个方向的转发结果
+type pipeResult struct {
+	Bytes int64
+	Err error
+
+	//读到EOF后是否以半关闭的方式通知了对端
+	HalfClosed bool
+}
+
+//在client和backend之间双向转发,返回客户端到后端和后端到客户端两个方向的结果
+//in和out不为nil时累加两个方向转发的字节数
+//一个方向读到EOF时只关闭对端的写方向,另一个方向继续转发直到结束
+//出错或者不支持半关闭时关闭两个连接,两个方向都结束后关闭两个连接
+func pipeConns(client net.Conn, backend net.Conn, watchdog *connWatchdog, in *int64, out *int64) (upstream pipeResult, downstream pipeResult){
+	var (
+		wait sync.WaitGroup
+		once sync.Once
+	)
+
+	closeBoth := func() {
+		once.Do(func() {
+			_ = client.Close()
+			_ = backend.Close()
+		})
+	}
+
+	half := func(dst net.Conn, src net.Conn, result *pipeResult, counter *int64) {
+		defer wait.Done()
+
+		result.Bytes, result.Err = copyConn(dst, src, watchdog, counter)
+		if result.Err == nil && closeWrite(dst) == nil{
+			result.HalfClosed = true
+			return
+		}
+		closeBoth()
+	}
+
+	wait.Add(2)
+	go half(backend, client, &upstream, in)
+	go half(client, backend, &downstream, out)
+	wait.Wait()
+
+	closeBoth()
+	return upstream, downstream
+}
+
+//把src中的数据写入dst,直到src读完或者出错
+//需要解析数据的包装先通过包装读取,直到不再需要解析
+//再写入各层包装中缓存的数据,之后直接使用内部的连接,两端都是TCP连接时Linux下会使用splice
+//watchdog需要统计idle时间时按块splice,每块之间更新idle计时
+//counter不为nil时累加写入的字节数,使用splice时每块结束后才累加
+func copyConn(dst net.Conn, src net.Conn, watchdog *connWatchdog, counter *int64) (written int64, err error){
+	for {
+		if tc, ok := src.(trackingConn); ok && tc.tracking(){
+			n, err := copyTracking(dst, tc, watchdog, counter)
+			written += n
+			if err == io.EOF{
+				return written, nil
+			}
+			if err != nil{
+				return written, err
+			}
+		}
+
+		bc, ok := src.(bufferedConn)
+		if !ok{
+			if tc, ok := src.(trackingConn); ok{
+				src = tc.innerConn()
+				continue
+			}
+			break
+		}
+
+		if data := bc.takeBuffered(); len(data) > 0{
+			n, err := dst.Write(data)
+			written += int64(n)
+			addCount(counter, int64(n))
+			if err != nil{
+				return written, err
+			}
+			if watchdog != nil{
+				watchdog.touch()
+			}
+		}
+		src = bc.innerConn()
+	}//for
+
+	for {
+		wc, ok := dst.(wrappedConn)
+		if !ok{
+			break
+		}
+		dst = wc.innerConn()
+	}//for
+
+	var n int64
+	if watchdog != nil && !watchdog.tracksIdle(){
+		watchdog = nil
+	}
+
+	//TCPConn.ReadFrom在src也是TCPConn时使用splice
+	if tcp, ok := dst.(*net.TCPConn); ok{
+		if _, ok = src.(*net.TCPConn); ok{
+			if watchdog != nil{
+				n, err = spliceChunks(tcp, src, watchdog, counter)
+				return written + n, err
+			}
+
+			n, err = tcp.ReadFrom(src)
+			addCount(counter, n)
+			return written + n, err
+		}
+	}
+
+	n, err = copyBuffered(dst, activityReader{src, watchdog, counter})
+	return written + n, err
+}
+
+func addCount(counter *int64, n int64){
+	if counter != nil && n > 0{
+		atomic.AddInt64(counter, n)
+	}
+}
+
+//使用池中的缓冲复制,隐藏ReadFrom和WriteTo以免io.CopyBuffer另外分配缓冲
+//通过src读取直到src不再需要解析数据,src读完时返回io.EOF
+func copyTracking(dst net.Conn, src trackingConn, watchdog *connWatchdog, counter *int64) (written int64, err error){
+	buf := copyBufferPool.Get().(*[]byte)
+	defer copyBufferPool.Put(buf)
+
+	for src.tracking(){
+		nr, er := src.Read(*buf)
+		if nr > 0{
+			if watchdog != nil{
+				watchdog.touch()
+			}
+			nw, ew := dst.Write((*buf)[: nr])
+			written += int64(nw)
+			addCount(counter, int64(nw))
+			if ew != nil{
+				return written, ew
+			}
+		}
+		if er != nil{
+			return written, er
+		}
+	}//for
+	return written, nil
+}
+
+//统计idle时每次splice的最大字节数
+const spliceChunk = 256 * 1024
+
+//分块splice,每块结束后更新idle计时
+//splice在块传完或者读超时之前不会返回,所以用读超时限制每块的等待时间,零星的数据也能及时更新idle计时
+func spliceChunks(dst *net.TCPConn, src net.Conn, watchdog *connWatchdog, counter *int64) (written int64, err error){
+	window := watchdog.spliceWindow()
+	defer src.SetReadDeadline(time.Time{})
+
+	for {
+		_ = src.SetReadDeadline(time.Now().Add(window))
+
+		//ReadFrom遇到LimitedReader包装的TCPConn仍然使用splice
+		n, err := dst.ReadFrom(&io.LimitedReader{R: src, N: spliceChunk})
+		written += n
+		addCount(counter, n)
+		if n > 0{
+			watchdog.touch()
+		}
+
+		if errors.Is(err, os.ErrDeadlineExceeded){
+			continue
+		}
+		if err != nil || n < spliceChunk{
+			return written, err
+		}
+	}//for
+}
+
+func copyBuffered(dst io.Writer, src io.Reader) (int64, error){
+	buf := copyBufferPool.Get().(*[]byte)
+	defer copyBufferPool.Put(buf)
+
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, *buf)
+}
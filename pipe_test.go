@@ -0,0 +1,288 @@
+package go_virtual_host
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+//返回一对相互连接的TCP连接
+func tcpPair(t testing.TB) (net.Conn, net.Conn){
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil{
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := listener.Accept()
+		accepted <- conn
+	}()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil{
+		t.Fatal(err)
+	}
+	server := <-accepted
+	if server == nil{
+		t.Fatal("accept failed")
+	}
+	return client, server
+}
+
+func TestCopyConnDrainsBufferedData(t *testing.T) {
+	client, server := tcpPair(t)
+	defer client.Close()
+	backendClient, backendServer := tcpPair(t)
+	defer backendServer.Close()
+
+	_, _ = client.Write([]byte("PROXY TCP4 1.2.3.4 5.6.7.8 1000 80\r\nGET / HTTP/1.1\r\nHost: a\r\n\r\nbody"))
+
+	ppConn, err := newProxyProtoConn(server)
+	if err != nil{
+		t.Fatal(err)
+	}
+	httpConn, err := HTTP(ppConn)
+	if err != nil{
+		t.Fatal(err)
+	}
+
+	done := make(chan []byte)
+	go func() {
+		data, _ := ioutil.ReadAll(backendServer)
+		done <- data
+	}()
+
+	go func() {
+		_, _ = client.Write([]byte(" more"))
+		_ = client.Close()
+	}()
+
+	if _, err = copyConn(backendClient, httpConn, nil, nil); err != nil{
+		t.Fatal(err)
+	}
+	_ = backendClient.Close()
+
+	if data := <-done; string(data) != "GET / HTTP/1.1\r\nHost: a\r\n\r\nbody more"{
+		t.Fatalf("unexpected data %q", data)
+	}
+}
+
+const benchmarkPipeBytes = 64 << 20
+
+//从src的对端先写入head再写入数据,经过copy转发后在dst的对端读出
+func benchmarkPipe(b *testing.B, head string, copy func(dst net.Conn, src net.Conn) (int64, error)){
+	chunk := bytes.Repeat([]byte("x"), 64 << 10)
+	b.SetBytes(benchmarkPipeBytes)
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++{
+		client, server := tcpPair(b)
+		backendClient, backendServer := tcpPair(b)
+
+		go func() {
+			_, _ = io.WriteString(client, head)
+			for written := 0; written < benchmarkPipeBytes; written += len(chunk){
+				_, _ = client.Write(chunk)
+			}
+			_ = client.Close()
+		}()
+
+		done := make(chan struct{})
+		go func() {
+			_, _ = io.Copy(ioutil.Discard, backendServer)
+			close(done)
+		}()
+
+		sc, _ := newSharedConn(server, 0)
+		if _, err := copy(backendClient, sc); err != nil{
+			b.Fatal(err)
+		}
+		_ = backendClient.Close()
+		<-done
+
+		_ = server.Close()
+		_ = backendServer.Close()
+	}
+}
+
+//crack模式下开启tracing和访问日志时后端连接的各层包装,请求为升级请求
+func crackBackendConn(conn net.Conn) (net.Conn, *crackTracing){
+	upgrade := newCrackUpgrade()
+	request := &Request{Method: "GET", URI: "/ws"}
+	request.SetHeader("Connection", "Upgrade")
+	request.SetHeader("Upgrade", "websocket")
+	upgrade.forwarded(request)
+
+	tracing := &crackTracing{tracer: NewTracer(&InMemoryExporter{})}
+	tracing.startSpan(request, time.Now())
+
+	backend := &backendTrackedConn{Conn: conn, backend: NewBackend(conn.RemoteAddr().String(), 1)}
+	traced := &tracedConn{Conn: &upgradeConn{Conn: backend, upgrade: upgrade}, tracing: tracing}
+	return &statusConn{Conn: traced}, tracing
+}
+
+const switchingProtocols = "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n"
+
+//后端返回101之后不再解析,各层包装不影响splice
+func BenchmarkPipeWrapped(b *testing.B) {
+	benchmarkPipe(b, switchingProtocols, func(dst net.Conn, src net.Conn) (int64, error) {
+		backend, _ := crackBackendConn(src)
+		return copyConn(dst, backend, nil, nil)
+	})
+}
+
+func BenchmarkPipeSplice(b *testing.B) {
+	benchmarkPipe(b, "", func(dst net.Conn, src net.Conn) (int64, error) {
+		return copyConn(dst, src, nil, nil)
+	})
+}
+
+//设置了idle超时时按块splice
+func BenchmarkPipeSpliceIdle(b *testing.B) {
+	benchmarkPipe(b, "", func(dst net.Conn, src net.Conn) (int64, error) {
+		return copyConn(dst, src, &connWatchdog{idle: time.Minute}, nil)
+	})
+}
+
+func BenchmarkPipeBuffered(b *testing.B) {
+	benchmarkPipe(b, "", func(dst net.Conn, src net.Conn) (int64, error) {
+		return copyBuffered(dst, src)
+	})
+}
+
+//客户端半关闭之后仍然可以收到后端的响应
+func TestPipeHalfClose(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil{
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	//读到EOF之后才返回收到的字节数
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil{
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				data, _ := ioutil.ReadAll(conn)
+				_, _ = conn.Write([]byte(strconv.Itoa(len(data))))
+			}(conn)
+		}
+	}()
+
+	getProxy := func(request *Request) (net.Conn, error){
+		return net.Dial("tcp", listener.Addr().String())
+	}
+
+	request := "GET / HTTP/1.1\r\nHost: a\r\nContent-Length: 4\r\n\r\nbody"
+	for _, server := range []Server{NewCommonProxy("127.0.0.1:0", getProxy), NewCrackProxy("127.0.0.1:0", getProxy, nil)}{
+		proxy := server.(*Proxy)
+		server.AsyncStart()
+
+		conn, err := net.Dial("tcp", proxy.Addr().String())
+		if err != nil{
+			t.Fatal(err)
+		}
+
+		_, _ = io.WriteString(conn, request)
+		if err = conn.(*net.TCPConn).CloseWrite(); err != nil{
+			t.Fatal(err)
+		}
+
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		data, err := ioutil.ReadAll(conn)
+		if err != nil || string(data) != strconv.Itoa(len(request)){
+			t.Fatalf("%s: unexpected response %q %v", proxy.name, data, err)
+		}
+
+		_ = conn.Close()
+		_ = proxy.Close()
+	}
+}
+
+//按块splice时零星的数据也要更新idle计时,不能等到凑满一块
+func TestCopyConnSpliceIdle(t *testing.T) {
+	proxy := newProxy(getListener("127.0.0.1:0"), "splice-idle", nil)
+	defer proxy.Close()
+
+	client, server := tcpPair(t)
+	backendClient, backendServer := tcpPair(t)
+	defer backendServer.Close()
+
+	watchdog := newConnWatchdog(proxy, server, Timeouts{})
+	watchdog.startIdle(300 * time.Millisecond, server, backendClient)
+	defer watchdog.stop()
+
+	go func() {
+		_, _ = client.Write(bytes.Repeat([]byte("x"), 64 << 10))
+		for i := 0; i < 10; i++{
+			time.Sleep(100 * time.Millisecond)
+			_, _ = client.Write([]byte("y"))
+		}
+		_ = client.Close()
+	}()
+
+	done := make(chan int64)
+	go func() {
+		n, _ := io.Copy(ioutil.Discard, backendServer)
+		done <- n
+	}()
+
+	var counter int64
+	n, err := copyConn(backendClient, server, watchdog, &counter)
+	_ = backendClient.Close()
+	if err != nil{
+		t.Fatal(err)
+	}
+
+	if expect := int64(64 << 10 + 10); n != expect || counter != expect || <-done != expect{
+		t.Fatalf("expect %d bytes, got %d, counter %d", expect, n, counter)
+	}
+	if watchdog.fired != ""{
+		t.Fatalf("unexpected %s timeout", watchdog.fired)
+	}
+}
+
+//crack的后端连接返回101之后不再经过各层包装读取,数据和span都不受影响
+func TestCopyConnUnwrapsCrackBackend(t *testing.T) {
+	backendClient, backendServer := tcpPair(t)
+	client, server := tcpPair(t)
+	defer server.Close()
+
+	payload := strings.Repeat("x", 256 << 10)
+	go func() {
+		_, _ = io.WriteString(backendServer, switchingProtocols + payload)
+		_ = backendServer.Close()
+	}()
+
+	done := make(chan string)
+	go func() {
+		data, _ := ioutil.ReadAll(server)
+		done <- string(data)
+	}()
+
+	backend, tracing := crackBackendConn(backendClient)
+	defer backend.Close()
+	n, err := copyConn(client, backend, nil, nil)
+	_ = client.Close()
+	if err != nil{
+		t.Fatal(err)
+	}
+
+	if data := <-done; int(n) != len(data) || data != switchingProtocols + payload{
+		t.Fatalf("unexpected data, %d bytes copied, %d received", n, len(data))
+	}
+	if tracing.waiting() || backend.(*statusConn).status != 101{
+		t.Fatalf("expect the 101 response traced, status %d", backend.(*statusConn).status)
+	}
+}
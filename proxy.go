@@ -1,60 +1,199 @@
 package go_virtual_host
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
-	"io"
 	"net"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type converter interface {
-	convert(net.Conn) (net.Conn, net.Conn, error)
+	convert(p *Proxy, conn net.Conn) (net.Conn, net.Conn, error)
 }
 
+//连接后端最多尝试的次数
+const maxDialAttempts = 5
+
+//连接失败时重试,后端都不可用或者熔断时立即返回
+func dialWithRetry(dial func() (net.Conn, error)) (conn net.Conn, err error){
+	for i := 0; i < maxDialAttempts; i++{
+		if conn, err = dial(); err == nil{
+			return conn, nil
+		}
+
+		if isBackendUnavailable(err){
+			return nil, err
+		}
+	}//for
+	return nil, err
+}
+
+//按超时设置连接后端,包括重试的时间
+func (p *Proxy) dialBackend(dial func() (net.Conn, error)) (net.Conn, error){
+	attempts := 0
+	return dialTimeout(p.Timeouts().Dial, func() (net.Conn, error) {
+		return dialWithRetry(func() (net.Conn, error) {
+			if attempts++; attempts > 1{
+				p.metrics.dialRetry(p.label())
+			}
+			return p.observeDial(dial)
+		})
+	})
+}
+
+//连接后端并统计耗时
+func (p *Proxy) observeDial(dial func() (net.Conn, error)) (net.Conn, error){
+	start := time.Now()
+	conn, err := dial()
+	p.metrics.observeDial(p.label(), conn, err, time.Since(start))
+	return conn, err
+}
+
+//后端不可用时返回503,连接超时返回504,其他错误返回502,返回写入的状态码
+func writeBackendError(conn net.Conn, err error) int{
+	if isBackendUnavailable(err){
+		_ = writeErrorResponse(conn, 503, "Service Unavailable")
+		return 503
+	}
+
+	if convertTimeout(err) == timeoutDial{
+		_ = writeErrorResponse(conn, 504, "Gateway Timeout")
+		return 504
+	}
+	_ = writeErrorResponse(conn, 502, "Bad Gateway")
+	return 502
+}
+
+//已经向客户端返回了错误响应的错误,用于访问日志
+type respondedError struct {
+	status int
+	err error
+}
+
+func (e *respondedError) Error() string{
+	return e.err.Error()
+}
+
+func (e *respondedError) Unwrap() error{
+	return e.err
+}
+
+//status为0表示没有返回响应
+func responded(status int, err error) error{
+	if status == 0{
+		return err
+	}
+	return &respondedError{status: status, err: err}
+}
+
+func respondedStatus(err error) int{
+	var re *respondedError
+	if errors.As(err, &re){
+		return re.status
+	}
+	return 0
+}
+
+
 type httpConverter struct {
     getProxy func(*Request) (net.Conn, error)
 }
 
-func (h *httpConverter) convert(conn net.Conn) (net.Conn, net.Conn, error){
-    httpConn, err := HTTP(conn)
+func (h *httpConverter) convert(p *Proxy, conn net.Conn) (net.Conn, net.Conn, error){
+    httpConn, err := newHttpConn(conn, p.PeekLimits())
     if err != nil{
-    	fmt.Printf("parset http request from %s error: %v", conn.RemoteAddr().String(), err)
-    	return nil, nil, nil
+    	p.metrics.parseError(p.label(), err)
+    	status := writeParseError(conn, err)
+    	return nil, nil, responded(status, fmt.Errorf("parse http request from %s error: %w", conn.RemoteAddr().String(), err))
 	}
 
-    var e error
-    for i :=0;i < 5;i ++{
-		proxy, e := h.getProxy(httpConn.Request)
-		if e == nil{
-			return httpConn, proxy, e
-		}
+    proxy, err := p.dialBackend(func() (net.Conn, error) {
+    	return h.getProxy(httpConn.Request)
+	})
+    if err != nil{
+    	return nil, nil, responded(writeBackendError(conn, err), err)
 	}
-    return nil, nil, e
+    return httpConn, proxy, nil
 }
 
+//请求被middleware直接响应,没有转发到后端
+var errAnswered = errors.New("request answered by middleware")
+
 type crackConverter struct {
 	getProxy func(*Request) (net.Conn, error)
 	handlerRequest func(*Request) *Request
 }
 
-func (c *crackConverter) convert(conn net.Conn) (net.Conn, net.Conn, error){
-	httpConn, err := HTTPCRACK(conn)
+func (c *crackConverter) convert(p *Proxy, conn net.Conn) (net.Conn, net.Conn, error){
+	start := time.Now()
+	httpConn, err := newHttpCrack(conn, p.PeekLimits())
 
 	if err != nil{
-		fmt.Printf("parset http request from %s error: %v", conn.RemoteAddr().String(), err)
-		return nil, nil, nil
+		p.metrics.parseError(p.label(), err)
+		status := writeParseError(conn, err)
+		return nil, nil, responded(status, fmt.Errorf("parse http request from %s error: %w", conn.RemoteAddr().String(), err))
 	}
 
-	httpConn.SetRequestHandler(c.handlerRequest)
-	var e error
-	for i :=0;i < 5;i ++{
-		proxy, e := c.getProxy(httpConn.Request)
-		if e == nil{
-			return httpConn, proxy, e
+	//第一个请求在创建HttpCrack时已经读取,之后的请求由HttpCrack开始span
+	tracing := newCrackTracing(p, conn.RemoteAddr().String())
+	tracing.startSpan(httpConn.Request, start)
+	httpConn.tracing = tracing
+
+	//按原始请求选择后端,由handler处理之后的请求只用于转发
+	//第一个请求被短路或者失败时不需要连接后端
+	original := httpConn.Request.clone()
+	handler := Chain(append([]Middleware{RequestFunc(c.handlerRequest)}, p.middlewares...)...)
+	httpConn.SetBodyTransformer(p.bodyTransformer)
+	upgrade := newCrackUpgrade()
+	httpConn.upgrade, httpConn.onUpgrade = upgrade, p.upgradeHook
+	if response, err := httpConn.SetHandler(newConnContext(conn), handler); response != nil{
+		_ = response.write(conn)
+		if err == nil{
+			err = errAnswered
 		}
+		return nil, nil, responded(response.StatusCode, fmt.Errorf("request from %s: %w", conn.RemoteAddr().String(), err))
+	}
+
+	dialStart := time.Now()
+	proxy, err := p.dialBackend(func() (net.Conn, error) {
+		return c.getProxy(original)
+	})
+	if err != nil{
+		tracing.dialed("", time.Since(dialStart), err)
+		return nil, nil, responded(writeBackendError(conn, err), err)
+	}
+	tracing.dialed(proxy.RemoteAddr().String(), time.Since(dialStart), nil)
+
+	//解析后端的响应,升级请求得到101之后原样转发
+	proxy = &upgradeConn{Conn: proxy, upgrade: upgrade}
+	if tracing != nil{
+		return httpConn, &tracedConn{Conn: proxy, tracing: tracing}, nil
 	}
-	return nil, nil, e
+	return httpConn, proxy, nil
+}
+
+type tlsConverter struct {
+	getProxy func(*ClientHello) (net.Conn, error)
+}
+
+func (t *tlsConverter) convert(p *Proxy, conn net.Conn) (net.Conn, net.Conn, error){
+	tlsConn, err := newTlsConn(conn, p.PeekLimits())
+	if err != nil{
+		p.metrics.parseError(p.label(), err)
+		return nil, nil, fmt.Errorf("parse client hello from %s error: %w", conn.RemoteAddr().String(), err)
+	}
+
+	proxy, err := p.dialBackend(func() (net.Conn, error) {
+		return t.getProxy(tlsConn.clientHello)
+	})
+	if err != nil{
+		return nil, nil, err
+	}
+	return tlsConn, proxy, nil
 }
 
 
@@ -64,6 +203,64 @@ type Proxy struct {
 	err error
 	name string
 	converter
+	//不为nil时整个连接交由session处理,不再走convert+pipe
+	session sessionServer
+
+	//Timeouts,通过SetTimeouts修改
+	timeouts atomic.Value
+	//PeekLimits,通过SetPeekLimits修改
+	peekLimits atomic.Value
+
+	//为nil时不统计
+	metrics *Metrics
+	//为nil时不记录
+	accessLog *AccessLog
+	//crack模式下为每个请求创建span,为nil时不创建
+	tracer *Tracer
+	//crack模式下在handlerRequest之后执行
+	middlewares []Middleware
+	//crack模式下在middlewares之后改写请求的body
+	bodyTransformer *BodyTransformer
+	//crack模式下升级成功之后调用,为nil时不调用
+	upgradeHook UpgradeHook
+	//不为nil时接受连接后先终止TLS
+	tlsConfig *tls.Config
+
+	//正在处理的连接,key为连接id
+	activeMu sync.Mutex
+	active map[uint64]*connEntry
+
+	//连接后端后写入的PROXY protocol版本,0表示不写入
+	sendProxyProtocol int
+	//接受的连接是否以PROXY protocol头部开始
+	acceptProxyProtocol bool
+}
+
+type Option func(*Proxy)
+
+//连接后端之后先写入PROXY protocol头部,version为1或2
+func WithProxyProtocol(version int) Option{
+	return func(p *Proxy) {
+		p.sendProxyProtocol = version
+	}
+}
+
+//代理位于负载均衡之后时,从接受的连接中解析PROXY protocol头部
+//之后连接的RemoteAddr为真实客户端地址
+func WithAcceptProxyProtocol() Option{
+	return func(p *Proxy) {
+		p.acceptProxyProtocol = true
+	}
+}
+
+//sessionServer自己处理客户端连接的整个生命周期,例如逐个转发keep-alive连接上的请求
+type sessionServer interface {
+	serve(p *Proxy, conn net.Conn, entry *connEntry)
+}
+
+//监控指标中listener的值
+func (p *Proxy) label() string{
+	return p.Addr().String()
 }
 
 func (p *Proxy)logLn(format string ,values ...interface{}){
@@ -71,7 +268,10 @@ func (p *Proxy)logLn(format string ,values ...interface{}){
 	fmt.Printf(format, values...)
 }
 
+//listener关闭后accept退出,同时结束start中的循环
 func (p *Proxy) accept(){
+	defer close(p.conns)
+
 	for {
 
 		if p.err != nil{
@@ -86,6 +286,7 @@ func (p *Proxy) accept(){
 		}
 
 		p.logLn("connection %s come", conn.RemoteAddr().String())
+		p.metrics.connAccepted(p.label())
 		p.conns <- conn
 	}//for
 }
@@ -93,50 +294,152 @@ func (p *Proxy) accept(){
 func (p *Proxy) handle(conn net.Conn){
 	defer func() {
 		if r := recover(); r != nil{
-			p.err = errors.New(fmt.Sprintf("%v", r))
+			p.logLn("handle conn %s panic: %v", conn.RemoteAddr().String(), r)
+			_ = conn.Close()
 		}
 	}()
-	//先获取proxy
-	from, to, err := p.convert(conn)
 
-	if err != nil{
-		p.err = err
+	defer p.metrics.connClosed(p.label())
+
+	entry := p.register(conn)
+	defer p.unregister(entry)
+
+	timeouts := p.Timeouts()
+	watchdog := newConnWatchdog(p, conn, timeouts)
+	defer watchdog.stop()
+
+	//读取PROXY protocol头部和Host/SNI的时间都算在header超时内
+	if timeouts.Header > 0{
+		_ = conn.SetReadDeadline(time.Now().Add(timeouts.Header))
+	}
+
+	if p.acceptProxyProtocol{
+		ppConn, err := newProxyProtoConn(conn)
+		if err != nil{
+			p.logTimeout(conn, err)
+			p.metrics.parseError(p.label(), err)
+			p.logLn("read proxy protocol header from %s error: %v", conn.RemoteAddr().String(), err)
+			p.logAccess(p.accessEntry(entry, nil), err)
+			_ = conn.Close()
+			return
+		}
+		conn = ppConn
+		entry.setClient(conn.RemoteAddr().String())
+	}
+
+	if p.tlsConfig != nil{
+		conn = tls.Server(conn, p.tlsConfig)
+	}
+
+	if p.session != nil{
+		p.session.serve(p, conn, entry)
 		return
 	}
 
-	var wait sync.WaitGroup
-	pipe := func(from net.Conn, to net.Conn) {
-		defer func() {
-			var e error
-			e = from.Close()
-			e = to.Close()
-			if e != nil{
-				//do nothing
-			}
-		}()
+	//先获取proxy
+	from, to, err := p.convert(p, conn)
 
-		n, e := io.Copy(to, from)
+	if err != nil || from == nil || to == nil{
+		p.logTimeout(conn, err)
+		p.logLn("convert conn %s error: %v", conn.RemoteAddr().String(), err)
+		p.logAccess(p.accessEntry(entry, nil), err)
+		_ = conn.Close()
+		return
+	}
 
-		p.logLn("%d bytes copied from %s before broken, err: %v", n, from.RemoteAddr().String(), e)
+	if timeouts.Header > 0{
+		_ = conn.SetReadDeadline(time.Time{})
 	}
-	wait.Add(2)
-	wait.Add(2)
+
+	if err = p.writeProxyHeader(from, to); err != nil{
+		p.logLn("write proxy protocol header to %s error: %v", to.RemoteAddr().String(), err)
+		_ = from.Close()
+		_ = to.Close()
+		return
+	}
+
+	watchdog.startIdle(timeouts.Idle, to)
 
 	p.logLn("Join conn %s and %s", from.RemoteAddr().String(), to.RemoteAddr().String())
-	go pipe(from ,to)
-	go pipe(to, from)
+	host := connHost(from)
+	entry.setRoute(host, to.RemoteAddr().String())
+
+	//请求信息在转发之前记录,HttpCrack转发时会更新Request
+	access := p.accessEntry(entry, from)
+	backend := to
+	switch from.(type) {
+	case *TlsConn, *ConnectConn:
+	default:
+		if access != nil{
+			backend = &statusConn{Conn: to}
+		}
+	}
 
-	wait.Wait()
+	upstream, downstream := pipeConns(from, backend, watchdog, &entry.bytesIn, &entry.bytesOut)
+	p.metrics.addBytes(p.label(), host, to.RemoteAddr().String(), upstream.Bytes, downstream.Bytes)
+
+	if access != nil{
+		if sc, ok := backend.(*statusConn); ok{
+			access.Status = sc.status
+		}
+		if c, ok := from.(*HttpCrack); ok{
+			access.Upgrade = c.Upgraded
+		}
+		access.Backend = to.RemoteAddr().String()
+		access.BytesIn, access.BytesOut = upstream.Bytes, downstream.Bytes
+		if upstream.Err != nil{
+			p.logAccess(access, upstream.Err)
+		}else{
+			p.logAccess(access, downstream.Err)
+		}
+	}
+
+	p.logLn("%d bytes copied from %s to %s, half closed: %v, err: %v",
+		upstream.Bytes, from.RemoteAddr().String(), to.RemoteAddr().String(), upstream.HalfClosed, upstream.Err)
+	p.logLn("%d bytes copied from %s to %s, half closed: %v, err: %v",
+		downstream.Bytes, to.RemoteAddr().String(), from.RemoteAddr().String(), downstream.HalfClosed, downstream.Err)
+}
+
+//convert得到的连接中的Host或者SNI
+func connHost(conn net.Conn) string{
+	var host string
+	switch c := conn.(type) {
+	case *HttpConn:
+		host = c.Request.Header("Host")
+	case *HttpCrack:
+		if c.Request != nil{
+			host = c.Request.Header("Host")
+		}
+	case *TlsConn:
+		host = c.clientHello.ServerName
+	case *ConnectConn:
+		host = c.Request.URI
+	}
+	return strings.ToLower(hostWithoutPort(host))
+}
 
+//记录读取Host/SNI或者连接后端时触发的超时
+func (p *Proxy) logTimeout(conn net.Conn, err error){
+	if kind := convertTimeout(err); kind != ""{
+		p.logLn("%s timeout fired for conn %s", kind, conn.RemoteAddr().String())
+	}
 }
 
+//按配置向后端写入客户端连接的PROXY protocol头部
+func (p *Proxy) writeProxyHeader(client net.Conn, backend net.Conn) error{
+	if p.sendProxyProtocol == 0{
+		return nil
+	}
+
+	return WriteProxyHeader(backend, p.sendProxyProtocol, client.RemoteAddr(), client.LocalAddr())
+}
 
 func (p *Proxy) start(){
 	p.logLn("start %s server", p.name)
 	go p.accept()
 
 	for conn := range p.conns{
-		p.handle(conn)
+		go p.handle(conn)
 	}//for
 }
 
@@ -158,34 +461,65 @@ func getListener(listen string) net.Listener{
 	return listener
 }
 
+func newProxy(listener net.Listener, name string, opts []Option) *Proxy{
+	proxy := &Proxy{
+		Listener:listener,
+		conns:make(chan net.Conn, 15),
+		name:name,
+		active:make(map[uint64]*connEntry),
+	}
+
+	for _, opt := range opts{
+		opt(proxy)
+	}
+
+	return proxy
+}
+
 func NewCrackProxy(
 	listen string,
 	getProxy func(*Request) (net.Conn, error),
-	handlerRequest func(*Request) *Request) Server{
+	handlerRequest func(*Request) *Request,
+	opts ...Option) Server{
 
-	listener := getListener(listen)
-
-	converter := crackConverter{getProxy:getProxy, handlerRequest:handlerRequest}
-	crack := &Proxy{
-		Listener:listener,
-		conns:make(chan net.Conn, 15),
-		name:"crack-proxy",
-		converter:&converter,
-	}
+	crack := newProxy(getListener(listen), "crack-proxy", opts)
+	crack.converter = &crackConverter{getProxy:getProxy, handlerRequest:handlerRequest}
 
 	return crack
 }
 
 
-func NewCommonProxy(listen string, getProxy func(*Request) (net.Conn, error)) Server{
-	listener := getListener(listen)
-	converter := httpConverter{getProxy:getProxy}
+func NewCommonProxy(listen string, getProxy func(*Request) (net.Conn, error), opts ...Option) Server{
+	proxy := newProxy(getListener(listen), "http-proxy", opts)
+	proxy.converter = &httpConverter{getProxy:getProxy}
 
-	proxy := &Proxy{
-		Listener:listener,
-		conns:make(chan net.Conn, 15),
-		name:"http-proxy",
-		converter:&converter,
+	return proxy
+}
+
+//按照ClientHello中的SNI选择后端,TLS流量原样透传
+func NewTlsProxy(listen string, getProxy func(*ClientHello) (net.Conn, error), opts ...Option) Server{
+	proxy := newProxy(getListener(listen), "tls-proxy", opts)
+	proxy.converter = &tlsConverter{getProxy:getProxy}
+
+	return proxy
+}
+
+//按请求转发的代理,keep-alive连接上的每个请求都由route重新选择后端
+//route返回后端地址,同一连接上相同地址的后端连接会被复用
+//onExchange在每次请求/响应完成后调用,可以为nil
+func NewKeepAliveProxy(
+	listen string,
+	route func(*Request) (string, error),
+	handlerRequest func(*Request) *Request,
+	onExchange func(*Exchange),
+	opts ...Option) Server{
+
+	proxy := newProxy(getListener(listen), "keepalive-proxy", opts)
+	proxy.session = &keepAliveServer{
+		route: route,
+		handlerRequest: handlerRequest,
+		onExchange: onExchange,
+		dial: defaultDial,
 	}
 
 	return proxy
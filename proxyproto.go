@@ -0,0 +1,240 @@
+package go_virtual_host
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+//HAProxy PROXY protocol
+//https://www.haproxy.org/download/2.0/doc/proxy-protocol.txt
+
+var errProxyProtocol = errors.New("invalid proxy protocol header")
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	//v1头部最长107个字节
+	maxProxyV1Len = 107
+
+	proxyV2Local = 0x20
+	proxyV2Proxy = 0x21
+	proxyV2TCP4 = 0x11
+	proxyV2TCP6 = 0x21
+)
+
+//向w写入PROXY头部,version为1或2
+//src和dst不是TCP地址时v1写入UNKNOWN,v2写入LOCAL命令
+func WriteProxyHeader(w io.Writer, version int, src net.Addr, dst net.Addr) error{
+	var header []byte
+
+	switch version {
+	case 1:
+		header = proxyV1Header(src, dst)
+	case 2:
+		header = proxyV2Header(src, dst)
+	default:
+		return fmt.Errorf("unsupported proxy protocol version %d", version)
+	}
+
+	_, err := w.Write(header)
+	return err
+}
+
+func tcpAddrs(src net.Addr, dst net.Addr) (*net.TCPAddr, *net.TCPAddr, bool){
+	s, ok1 := src.(*net.TCPAddr)
+	d, ok2 := dst.(*net.TCPAddr)
+	if !ok1 || !ok2{
+		return nil, nil, false
+	}
+
+	//v4和v6地址不能混用
+	if (s.IP.To4() == nil) != (d.IP.To4() == nil){
+		return nil, nil, false
+	}
+	return s, d, true
+}
+
+func proxyV1Header(src net.Addr, dst net.Addr) []byte{
+	s, d, ok := tcpAddrs(src, dst)
+	if !ok{
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+
+	family := "TCP4"
+	sIP, dIP := s.IP.To4(), d.IP.To4()
+	if sIP == nil{
+		family, sIP, dIP = "TCP6", s.IP.To16(), d.IP.To16()
+	}
+
+	return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, sIP, dIP, s.Port, d.Port))
+}
+
+func proxyV2Header(src net.Addr, dst net.Addr) []byte{
+	var b bytes.Buffer
+	b.Write(proxyV2Signature)
+
+	s, d, ok := tcpAddrs(src, dst)
+	if !ok{
+		b.Write([]byte{proxyV2Local, 0x00, 0x00, 0x00})
+		return b.Bytes()
+	}
+
+	family := byte(proxyV2TCP4)
+	sIP, dIP := s.IP.To4(), d.IP.To4()
+	if sIP == nil{
+		family, sIP, dIP = proxyV2TCP6, s.IP.To16(), d.IP.To16()
+	}
+
+	b.Write([]byte{proxyV2Proxy, family})
+	_ = binary.Write(&b, binary.BigEndian, uint16(2 * len(sIP) + 4))
+	b.Write(sIP)
+	b.Write(dIP)
+	_ = binary.Write(&b, binary.BigEndian, uint16(s.Port))
+	_ = binary.Write(&b, binary.BigEndian, uint16(d.Port))
+	return b.Bytes()
+}
+
+//从br中读取PROXY头部,v1和v2自动识别
+//UNKNOWN和LOCAL返回的地址为nil
+func readProxyHeader(br *bufio.Reader) (src net.Addr, dst net.Addr, err error){
+	p, err := br.Peek(len(proxyV2Signature))
+	if err != nil{
+		return nil, nil, err
+	}
+
+	if bytes.Equal(p, proxyV2Signature){
+		return readProxyV2(br)
+	}
+
+	if bytes.HasPrefix(p, []byte("PROXY ")){
+		return readProxyV1(br)
+	}
+
+	return nil, nil, errProxyProtocol
+}
+
+func readProxyV1(br *bufio.Reader) (src net.Addr, dst net.Addr, err error){
+	var line []byte
+	for len(line) < maxProxyV1Len{
+		var c byte
+		if c, err = br.ReadByte(); err != nil{
+			return
+		}
+		line = append(line, c)
+		if c == '\n'{
+			break
+		}
+	}//for
+
+	if !bytes.HasSuffix(line, []byte("\r\n")){
+		return nil, nil, errProxyProtocol
+	}
+
+	fields := strings.Split(string(line[: len(line) - 2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN"{
+		return nil, nil, nil
+	}
+
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6"){
+		return nil, nil, errProxyProtocol
+	}
+
+	sIP, dIP := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	sPort, err1 := strconv.ParseUint(fields[4], 10, 16)
+	dPort, err2 := strconv.ParseUint(fields[5], 10, 16)
+	if sIP == nil || dIP == nil || err1 != nil || err2 != nil{
+		return nil, nil, errProxyProtocol
+	}
+
+	return &net.TCPAddr{IP: sIP, Port: int(sPort)}, &net.TCPAddr{IP: dIP, Port: int(dPort)}, nil
+}
+
+func readProxyV2(br *bufio.Reader) (src net.Addr, dst net.Addr, err error){
+	header := make([]byte, 16)
+	if _, err = io.ReadFull(br, header); err != nil{
+		return
+	}
+
+	command, family := header[12], header[13]
+	length := int(binary.BigEndian.Uint16(header[14: 16]))
+
+	data := make([]byte, length)
+	if _, err = io.ReadFull(br, data); err != nil{
+		return
+	}
+
+	if command == proxyV2Local{
+		return nil, nil, nil
+	}
+
+	if command != proxyV2Proxy{
+		return nil, nil, errProxyProtocol
+	}
+
+	ipLen := 0
+	switch family {
+	case proxyV2TCP4:
+		ipLen = 4
+	case proxyV2TCP6:
+		ipLen = 16
+	default:
+		//其他协议族不关心地址
+		return nil, nil, nil
+	}
+
+	if len(data) < 2 * ipLen + 4{
+		return nil, nil, errProxyProtocol
+	}
+
+	sIP := net.IP(append([]byte(nil), data[: ipLen]...))
+	dIP := net.IP(append([]byte(nil), data[ipLen: 2 * ipLen]...))
+	ports := data[2 * ipLen: ]
+
+	src = &net.TCPAddr{IP: sIP, Port: int(binary.BigEndian.Uint16(ports[0: 2]))}
+	dst = &net.TCPAddr{IP: dIP, Port: int(binary.BigEndian.Uint16(ports[2: 4]))}
+	return src, dst, nil
+}
+
+//解析过PROXY头部的连接,RemoteAddr和LocalAddr返回头部中的地址
+type proxyProtoConn struct {
+	net.Conn
+	br *bufio.Reader
+	src net.Addr
+	dst net.Addr
+}
+
+func newProxyProtoConn(conn net.Conn) (*proxyProtoConn, error){
+	br := bufio.NewReader(conn)
+
+	src, dst, err := readProxyHeader(br)
+	if err != nil{
+		return nil, err
+	}
+
+	return &proxyProtoConn{Conn: conn, br: br, src: src, dst: dst}, nil
+}
+
+func (pc *proxyProtoConn) Read(b []byte) (int, error){
+	return pc.br.Read(b)
+}
+
+func (pc *proxyProtoConn) RemoteAddr() net.Addr{
+	if pc.src != nil{
+		return pc.src
+	}
+	return pc.Conn.RemoteAddr()
+}
+
+func (pc *proxyProtoConn) LocalAddr() net.Addr{
+	if pc.dst != nil{
+		return pc.dst
+	}
+	return pc.Conn.LocalAddr()
+}
@@ -0,0 +1,58 @@
+package go_virtual_host
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestProxyHeaderRoundTrip(t *testing.T) {
+	addrs := [][2]net.Addr{
+		{&net.TCPAddr{IP: net.ParseIP("192.168.1.2"), Port: 5678}, &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 443}},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 5678}, &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443}},
+	}
+
+	for _, version := range []int{1, 2}{
+		for _, addr := range addrs{
+			var b bytes.Buffer
+			if err := WriteProxyHeader(&b, version, addr[0], addr[1]); err != nil{
+				t.Fatal(err)
+			}
+			b.WriteString("GET / HTTP/1.1\r\n")
+
+			br := bufio.NewReader(&b)
+			src, dst, err := readProxyHeader(br)
+			if err != nil{
+				t.Fatalf("v%d %s: %v", version, addr[0], err)
+			}
+			if src.String() != addr[0].String() || dst.String() != addr[1].String(){
+				t.Fatalf("v%d: expect %s %s, got %s %s", version, addr[0], addr[1], src, dst)
+			}
+
+			line, _ := br.ReadString('\n')
+			if line != "GET / HTTP/1.1\r\n"{
+				t.Fatalf("v%d: payload corrupted: %q", version, line)
+			}
+		}
+	}
+}
+
+func TestProxyHeaderUnknown(t *testing.T) {
+	for _, version := range []int{1, 2}{
+		var b bytes.Buffer
+		if err := WriteProxyHeader(&b, version, &net.UnixAddr{Name: "a"}, &net.UnixAddr{Name: "b"}); err != nil{
+			t.Fatal(err)
+		}
+		b.WriteString("payload!")
+
+		src, dst, err := readProxyHeader(bufio.NewReader(&b))
+		if err != nil || src != nil || dst != nil{
+			t.Fatalf("v%d: expect nil addrs, got %v %v %v", version, src, dst, err)
+		}
+	}
+
+	if _, _, err := readProxyHeader(bufio.NewReader(bytes.NewBufferString("GET / HTTP/1.1\r\n"))); err != errProxyProtocol{
+		t.Fatalf("expect errProxyProtocol, got %v", err)
+	}
+}
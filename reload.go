@@ -0,0 +1,511 @@
+package go_virtual_host
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+//重新加载配置的统计信息
+type ReloadStats struct {
+	Successes uint64
+	Failures uint64
+
+	//最后一次重新加载的时间和结果
+	LastReload time.Time
+	LastError error
+}
+
+//正在运行的listener
+type managedListener struct {
+	cfg *ListenerConfig
+	holder *routerHolder
+	proxy *Proxy
+}
+
+//listen地址、模式和PROXY protocol设置变化时需要重新监听
+func (ml *managedListener) needRestart(l *ListenerConfig) bool{
+	return ml.cfg.Listen != l.Listen ||
+		ml.cfg.Mode != l.Mode ||
+		ml.cfg.ProxyProtocol != l.ProxyProtocol ||
+		ml.cfg.AcceptProxyProtocol != l.AcceptProxyProtocol
+}
+
+//根据配置文件运行所有代理,并支持不中断连接地重新加载配置
+//新的连接使用新的路由,已经建立的连接不受影响
+//配置有错误时保留原来的配置
+type Manager struct {
+	path string
+
+	mu sync.Mutex
+	cfg *Config
+	listeners map[string]*managedListener
+	stats ReloadStats
+
+	//当前配置的后端集群和停止健康检查的函数
+	pools map[string]*BackendPool
+	stopHealthChecks func()
+
+	//所有代理共用的监控指标,通过管理接口的/metrics输出
+	metrics *Metrics
+	admin *adminServer
+
+	//所有代理共用的访问日志,重新加载配置时替换输出
+	accessLog *AccessLog
+	accessLogFile io.Closer
+
+	//所有代理共用的Tracer,重新加载配置时替换exporter
+	tracer *Tracer
+
+	//通过管理接口drain的后端,重新加载配置后仍然保持,key为后端集群的名字和地址
+	drained map[string]map[string]bool
+
+	//监听listener的地址,默认为net.Listen
+	listen func(network string, address string) (net.Listener, error)
+}
+
+func NewManager(path string) (*Manager, error){
+	cfg, err := LoadConfig(path)
+	if err != nil{
+		return nil, err
+	}
+
+	m := &Manager{
+		path: path,
+		cfg: cfg,
+		listeners: make(map[string]*managedListener),
+		metrics: NewMetrics(),
+		accessLog: &AccessLog{},
+		tracer: NewTracer(nil),
+		drained: make(map[string]map[string]bool),
+		listen: net.Listen,
+	}
+	m.metrics.setSources(m.BackendStatus, m.ReloadStats)
+	return m, nil
+}
+
+func (m *Manager) logLn(format string, values ...interface{}){
+	format = fmt.Sprintf("[manager:%s]: %s\n", m.path, format)
+	fmt.Printf(format, values...)
+}
+
+//当前生效的配置
+func (m *Manager) Config() *Config{
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.cfg
+}
+
+func (m *Manager) ReloadStats() ReloadStats{
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.stats
+}
+
+//当前运行的代理,key为listener的名字
+func (m *Manager) Proxies() map[string]*Proxy{
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	proxies := make(map[string]*Proxy, len(m.listeners))
+	for name, ml := range m.listeners{
+		proxies[name] = ml.proxy
+	}
+	return proxies
+}
+
+func (m *Manager) Metrics() *Metrics{
+	return m.metrics
+}
+
+//当前配置中所有后端的状态,key为后端集群的名字
+func (m *Manager) BackendStatus() map[string][]BackendStatus{
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	status := make(map[string][]BackendStatus, len(m.pools))
+	for name, pool := range m.pools{
+		status[name] = pool.Status()
+	}
+	return status
+}
+
+func lookupBackend(pools map[string]*BackendPool, pool string, addr string) *Backend{
+	if p, ok := pools[pool]; ok{
+		return p.Backend(addr)
+	}
+	return nil
+}
+
+//drain之后不再选择该后端,已经建立的连接不受影响
+func (m *Manager) DrainBackend(pool string, addr string, drained bool) error{
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	b := lookupBackend(m.pools, pool, addr)
+	if b == nil{
+		return fmt.Errorf("backend %s not found in %s", addr, pool)
+	}
+	b.SetDrained(drained)
+
+	if drained{
+		if m.drained[pool] == nil{
+			m.drained[pool] = make(map[string]bool)
+		}
+		m.drained[pool][addr] = true
+	}else{
+		delete(m.drained[pool], addr)
+	}
+
+	m.logLn("backend %s in %s drained: %v", addr, pool, drained)
+	return nil
+}
+
+//所有listener正在处理的连接
+func (m *Manager) Connections() []ConnInfo{
+	var infos []ConnInfo
+	for name, proxy := range m.Proxies(){
+		for _, info := range proxy.Connections(){
+			info.Listener = name
+			infos = append(infos, info)
+		}
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ID < infos[j].ID
+	})
+	return infos
+}
+
+//关闭id对应的连接,连接不存在时返回false
+func (m *Manager) CloseConnection(id uint64) bool{
+	for _, proxy := range m.Proxies(){
+		if proxy.CloseConnection(id){
+			return true
+		}
+	}
+	return false
+}
+
+//监听配置中的所有listener并开始处理连接
+func (m *Manager) Start() error{
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.apply(m.cfg)
+}
+
+//重新读取配置文件并应用
+func (m *Manager) Reload() error{
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	cfg, err := LoadConfig(m.path)
+	if err == nil{
+		err = m.apply(cfg)
+	}
+
+	m.stats.LastReload = time.Now()
+	m.stats.LastError = err
+
+	if err != nil{
+		m.stats.Failures++
+		m.logLn("reload config failed, keep the old one: %v", err)
+		return err
+	}
+
+	m.stats.Successes++
+	m.cfg = cfg
+	m.logLn("reload config success, %d listeners running", len(m.listeners))
+	return nil
+}
+
+//关闭所有listener,已经建立的连接不受影响
+func (m *Manager) Stop(){
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for name, ml := range m.listeners{
+		_ = ml.proxy.Close()
+		delete(m.listeners, name)
+	}
+
+	if m.stopHealthChecks != nil{
+		m.stopHealthChecks()
+		m.stopHealthChecks = nil
+	}
+
+	m.switchAdmin(m.cfg, nil)
+	m.setAccessLog(nil, nil, "")
+	m.tracer.SetExporter(nil)
+	m.tracer.Flush()
+}
+
+//替换访问日志的输出并关闭原来的文件,格式已经在校验配置时检查过
+func (m *Manager) setAccessLog(w io.Writer, file io.Closer, format string){
+	_ = m.accessLog.SetOutput(w, format)
+
+	if m.accessLogFile != nil{
+		_ = m.accessLogFile.Close()
+	}
+	m.accessLogFile = file
+}
+
+//先生成所有路由并监听新的地址,全部成功之后才替换正在运行的配置
+func (m *Manager) apply(cfg *Config) error{
+	routers, pools, err := newListenerRouters(cfg)
+	if err != nil{
+		return err
+	}
+
+	for _, router := range routers{
+		router.metrics = m.metrics
+		router.accessLog = m.accessLog
+		router.tracer = m.tracer
+	}
+
+	for name, addrs := range m.drained{
+		for addr := range addrs{
+			if b := lookupBackend(pools, name, addr); b != nil{
+				b.SetDrained(true)
+			}
+		}
+	}//for
+
+	//需要新监听的listener,同一地址重新监听的需要先关闭旧的
+	opened := make(map[string]net.Listener)
+	var later []*listenerRouter
+
+	closeOpened := func() {
+		for _, listener := range opened{
+			_ = listener.Close()
+		}
+	}
+
+	for _, router := range routers{
+		name := router.cfg.name()
+		old, ok := m.listeners[name]
+		if ok && !old.needRestart(router.cfg){
+			continue
+		}
+
+		if ok && old.cfg.Listen == router.cfg.Listen{
+			later = append(later, router)
+			continue
+		}
+
+		listener, err := m.listen("tcp", router.cfg.Listen)
+		if err != nil{
+			closeOpened()
+			return fmt.Errorf("listener %s: %v", name, err)
+		}
+		opened[name] = listener
+	}//for
+
+	//每次都重新打开日志文件,外部工具切分日志之后发送SIGHUP即可
+	var (
+		accessWriter io.Writer
+		accessFile io.Closer
+		accessFormat string
+	)
+	if cfg.AccessLog != nil{
+		if accessWriter, accessFile, err = cfg.AccessLog.open(); err != nil{
+			closeOpened()
+			return fmt.Errorf("access_log: %v", err)
+		}
+		accessFormat = cfg.AccessLog.Format
+	}
+
+	adminListener, adminChanged, err := m.listenAdmin(cfg)
+	if err != nil{
+		closeOpened()
+		if accessFile != nil{
+			_ = accessFile.Close()
+		}
+		return fmt.Errorf("admin: %v", err)
+	}
+
+	//同一地址重新监听只能先关闭旧的,失败时按原来的路由恢复已经关闭的listener
+	if err = m.restartLater(later, opened); err != nil{
+		closeOpened()
+		if accessFile != nil{
+			_ = accessFile.Close()
+		}
+		if adminListener != nil{
+			_ = adminListener.Close()
+		}
+		return err
+	}
+
+	//以下不会再失败,开始替换
+	if adminChanged{
+		m.switchAdmin(cfg, adminListener)
+	}
+	m.setAccessLog(accessWriter, accessFile, accessFormat)
+
+	if cfg.Tracing != nil{
+		m.tracer.SetExporter(cfg.Tracing.exporter())
+	}else{
+		m.tracer.SetExporter(nil)
+	}
+
+	keep := make(map[string]bool, len(routers))
+	for _, router := range routers{
+		keep[router.cfg.name()] = true
+	}
+
+	for name, ml := range m.listeners{
+		_, reopen := opened[name]
+		if !keep[name] || reopen{
+			m.logLn("stop listener %s on %s", name, ml.cfg.Listen)
+			_ = ml.proxy.Close()
+			delete(m.listeners, name)
+		}
+	}//for
+
+	for _, router := range routers{
+		name := router.cfg.name()
+		if ml, ok := m.listeners[name]; ok{
+			ml.cfg = router.cfg
+			ml.holder.set(router)
+			ml.proxy.SetTimeouts(router.timeouts)
+			ml.proxy.SetPeekLimits(router.limits)
+			continue
+		}
+
+		listener, ok := opened[name]
+		if !ok{
+			continue
+		}
+
+		holder := newRouterHolder(router)
+		ml := &managedListener{cfg: router.cfg, holder: holder, proxy: holder.newProxy(listener)}
+		m.listeners[name] = ml
+		m.logLn("start listener %s on %s (%s)", name, router.cfg.Listen, router.cfg.Mode)
+		ml.proxy.AsyncStart()
+	}//for
+
+	//新的后端集群重新开始健康检查
+	if m.stopHealthChecks != nil{
+		m.stopHealthChecks()
+	}
+	m.pools = pools
+	m.stopHealthChecks = startHealthChecks(cfg, pools)
+
+	return nil
+}
+
+//关闭同一地址上的旧listener并重新监听,新监听的加入opened
+//任何一个失败时用旧的路由重新监听已经关闭的地址,返回错误
+func (m *Manager) restartLater(later []*listenerRouter, opened map[string]net.Listener) error{
+	var closed []*managedListener
+
+	for _, router := range later{
+		name := router.cfg.name()
+		old := m.listeners[name]
+		_ = old.proxy.Close()
+		closed = append(closed, old)
+
+		listener, err := m.listen("tcp", router.cfg.Listen)
+		if err == nil{
+			opened[name] = listener
+			continue
+		}
+
+		for _, ml := range closed{
+			if l, ok := opened[ml.cfg.name()]; ok{
+				_ = l.Close()
+				delete(opened, ml.cfg.name())
+			}
+			m.restore(ml)
+		}//for
+		return fmt.Errorf("restart listener %s on %s: %v", name, router.cfg.Listen, err)
+	}//for
+
+	return nil
+}
+
+//按旧的路由重新监听旧listener实际的地址,仍然失败时移除该listener
+func (m *Manager) restore(ml *managedListener){
+	name, addr := ml.cfg.name(), ml.proxy.Addr().String()
+
+	listener, err := m.listen("tcp", addr)
+	if err != nil{
+		m.logLn("restore listener %s on %s error: %v", name, addr, err)
+		delete(m.listeners, name)
+		return
+	}
+
+	ml.proxy = ml.holder.newProxy(listener)
+	m.logLn("restore listener %s on %s (%s)", name, addr, ml.cfg.Mode)
+	ml.proxy.AsyncStart()
+}
+
+//收到SIGHUP时重新加载配置,返回的函数用于停止监听信号
+func (m *Manager) WatchSignals() (stop func()){
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	done := make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case <-signals:
+				m.logLn("SIGHUP received, reloading")
+				_ = m.Reload()
+			case <-done:
+				return
+			}
+		}//for
+	}()
+
+	return func() {
+		signal.Stop(signals)
+		close(done)
+	}
+}
+
+//定期检查配置文件的修改时间和大小,变化时重新加载
+func (m *Manager) WatchFile(interval time.Duration) (stop func()){
+	done := make(chan struct{})
+
+	stat := func() (time.Time, int64) {
+		info, err := os.Stat(m.path)
+		if err != nil{
+			return time.Time{}, -1
+		}
+		return info.ModTime(), info.Size()
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		modTime, size := stat()
+		for {
+			select {
+			case <-ticker.C:
+				t, s := stat()
+				if s < 0 || (t.Equal(modTime) && s == size){
+					continue
+				}
+
+				modTime, size = t, s
+				m.logLn("config file changed, reloading")
+				_ = m.Reload()
+			case <-done:
+				return
+			}
+		}//for
+	}()
+
+	return func() {
+		close(done)
+	}
+}
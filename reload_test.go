@@ -0,0 +1,156 @@
+package go_virtual_host
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeConfig(t *testing.T, path string, backend string){
+	data := fmt.Sprintf(`{
+  "listeners": [{"name": "web", "listen": "127.0.0.1:0", "mode": "keepalive", "hosts": [{"backend": "web"}]}],
+  "backends": {"web": {"addresses": [%q]}}
+}`, backend)
+
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil{
+		t.Fatal(err)
+	}
+}
+
+func getBody(t *testing.T, addr string) string{
+	conn, err := net.Dial("tcp", addr)
+	if err != nil{
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	_, _ = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n")
+	tr := NewTextReader(conn)
+	response, err := tr.ReadResponse()
+	if err != nil{
+		t.Fatal(err)
+	}
+	body, err := tr.ReadUntilN(response.ContentLength)
+	if err != nil{
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestManagerReload(t *testing.T) {
+	a := startBackend(t, "a")
+	defer a.Close()
+	b := startBackend(t, "b")
+	defer b.Close()
+
+	dir, err := ioutil.TempDir("", "vhost")
+	if err != nil{
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config.json")
+	writeConfig(t, path, a.Addr().String())
+
+	m, err := NewManager(path)
+	if err != nil{
+		t.Fatal(err)
+	}
+	if err = m.Start(); err != nil{
+		t.Fatal(err)
+	}
+	defer m.Stop()
+
+	proxy := m.Proxies()["web"]
+	addr := proxy.Addr().String()
+	if body := getBody(t, addr); body != "a /"{
+		t.Fatalf("expect a /, got %q", body)
+	}
+
+	//错误的配置不会替换当前配置
+	if err = ioutil.WriteFile(path, []byte(`{"listeners": []}`), 0644); err != nil{
+		t.Fatal(err)
+	}
+	if err = m.Reload(); err == nil{
+		t.Fatal("expect reload error")
+	}
+	if body := getBody(t, addr); body != "a /"{
+		t.Fatalf("expect a /, got %q", body)
+	}
+
+	writeConfig(t, path, b.Addr().String())
+	if err = m.Reload(); err != nil{
+		t.Fatal(err)
+	}
+	if m.Proxies()["web"] != proxy{
+		t.Fatal("listener should not be restarted")
+	}
+	if body := getBody(t, addr); body != "b /"{
+		t.Fatalf("expect b /, got %q", body)
+	}
+
+	stats := m.ReloadStats()
+	if stats.Successes != 1 || stats.Failures != 1 || stats.LastError != nil{
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestManagerReloadRestartFailure(t *testing.T) {
+	a := startBackend(t, "a")
+	defer a.Close()
+
+	dir, err := ioutil.TempDir("", "vhost")
+	if err != nil{
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config.json")
+	writeConfig(t, path, a.Addr().String())
+
+	m, err := NewManager(path)
+	if err != nil{
+		t.Fatal(err)
+	}
+	if err = m.Start(); err != nil{
+		t.Fatal(err)
+	}
+	defer m.Stop()
+	addr := m.Proxies()["web"].Addr().String()
+
+	//修改模式需要在同一地址重新监听,第一次监听失败
+	failed := false
+	m.listen = func(network string, address string) (net.Listener, error) {
+		if !failed{
+			failed = true
+			return nil, fmt.Errorf("listen %s: address in use", address)
+		}
+		return net.Listen(network, address)
+	}
+
+	data := fmt.Sprintf(`{
+  "listeners": [{"name": "web", "listen": "127.0.0.1:0", "mode": "crack", "hosts": [{"backend": "web"}]}],
+  "backends": {"web": {"addresses": [%q]}}
+}`, a.Addr().String())
+	if err = ioutil.WriteFile(path, []byte(data), 0644); err != nil{
+		t.Fatal(err)
+	}
+	if err = m.Reload(); err == nil{
+		t.Fatal("expect reload error")
+	}
+
+	//旧的listener按原来的配置恢复
+	if m.Config().Listeners[0].Mode != ModeKeepAlive || m.Proxies()["web"] == nil{
+		t.Fatalf("expect old config kept, got %+v", m.Config().Listeners[0])
+	}
+	if body := getBody(t, addr); body != "a /"{
+		t.Fatalf("expect a /, got %q", body)
+	}
+	if stats := m.ReloadStats(); stats.Successes != 0 || stats.Failures != 1{
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
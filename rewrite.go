@@ -0,0 +1,210 @@
+package go_virtual_host
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+//类似nginx rewrite的URL重写规则,Pattern匹配请求路径,不包括query
+//crack模式下后端由原始请求选择,内部重写只改变转发的URI
+type RewriteRule struct {
+	Pattern string `json:"pattern"`
+
+	//可以使用$1、${name}引用捕获组,重定向时可以是完整的URL
+	//包含?时?之后为新的query,原来的query追加在之后,以?结尾时丢弃原来的query
+	Replacement string `json:"replacement"`
+
+	//0表示内部重写,301、302、307、308表示返回重定向
+	Redirect int `json:"redirect,omitempty"`
+
+	//匹配之后不再执行之后的规则,重定向之后总是不再执行
+	Last bool `json:"last,omitempty"`
+
+	regex *regexp.Regexp
+}
+
+func validRedirect(status int) bool{
+	switch status {
+	case 301, 302, 307, 308:
+		return true
+	}
+	return false
+}
+
+func (r *RewriteRule) compile() (err error){
+	if r.Redirect != 0 && !validRedirect(r.Redirect){
+		return fmt.Errorf("unsupported redirect status %d, expect 301, 302, 307 or 308", r.Redirect)
+	}
+
+	if r.Redirect == 0 && !strings.HasPrefix(r.Replacement, "/") && !strings.HasPrefix(r.Replacement, "$"){
+		return errors.New("replacement of internal rewrite must start with /")
+	}
+
+	r.regex, err = regexp.Compile(r.Pattern)
+	return
+}
+
+//按规则重写path,没有匹配时返回false
+func (r *RewriteRule) rewrite(uri string) (string, bool){
+	path, query := uri, ""
+	if i := strings.IndexByte(uri, '?'); i >= 0{
+		path, query = uri[: i], uri[i + 1: ]
+	}
+
+	match := r.regex.FindStringSubmatchIndex(path)
+	if match == nil{
+		return "", false
+	}
+	target := string(r.regex.ExpandString(nil, r.Replacement, path, match))
+
+	switch {
+	case strings.HasSuffix(target, "?"):
+		target = strings.TrimSuffix(target, "?")
+	case query == "":
+	case strings.IndexByte(target, '?') < 0:
+		target += "?" + query
+	default:
+		target += "&" + query
+	}
+	return target, true
+}
+
+//按顺序执行规则,规则编译失败时返回错误
+func NewRewriter(rules ...*RewriteRule) (Middleware, error){
+	for i, rule := range rules{
+		if err := rule.compile(); err != nil{
+			return nil, fmt.Errorf("rewrite rule %d: %v", i, err)
+		}
+	}
+
+	return func(next RequestHandler) RequestHandler {
+		return func(ctx *ConnContext, request *Request) (*Request, *DirectResponse, error) {
+			for _, rule := range rules{
+				uri, ok := rule.rewrite(request.URI)
+				if !ok{
+					continue
+				}
+
+				if rule.Redirect != 0{
+					return nil, Redirect(rule.Redirect, request.encodeURI(uri)), nil
+				}
+
+				setURI(request, uri)
+				if rule.Last{
+					break
+				}
+			}//for
+			return next(ctx, request)
+		}
+	}, nil
+}
+
+//修改URI并重新解析Query
+func setURI(request *Request, uri string){
+	request.URI = uri
+
+	query := ""
+	if i := strings.IndexByte(uri, '?'); i >= 0{
+		query = uri[i + 1: ]
+	}
+	if values, err := url.ParseQuery(query); err == nil{
+		request.Query = values
+	}
+}
+
+//返回重定向响应
+func Redirect(status int, location string) *DirectResponse{
+	response := Respond(status, "redirect to " + location + "\n")
+	response.Header["Location"] = location
+	return response
+}
+
+//status为0时修改请求,否则返回重定向,Location使用编码之后的uri
+func rewriteOrRedirect(next RequestHandler, ctx *ConnContext, request *Request, status int, uri string) (*Request, *DirectResponse, error){
+	if status == 0{
+		setURI(request, uri)
+		return next(ctx, request)
+	}
+	return nil, Redirect(status, request.encodeURI(uri)), nil
+}
+
+func requestScheme(ctx *ConnContext) string{
+	if ctx != nil && ctx.TLS != nil{
+		return "https"
+	}
+	return "http"
+}
+
+//不是TLS连接时重定向到https,X-Forwarded-Proto为https的请求认为已经经过TLS
+//重定向时去掉Host中的端口
+func RedirectHTTPS(status int) Middleware{
+	return func(next RequestHandler) RequestHandler {
+		return func(ctx *ConnContext, request *Request) (*Request, *DirectResponse, error) {
+			host := request.Header("Host")
+			if requestScheme(ctx) == "https" || strings.EqualFold(request.Header("X-Forwarded-Proto"), "https") || host == ""{
+				return next(ctx, request)
+			}
+
+			if h, _, err := net.SplitHostPort(host); err == nil{
+				host = h
+			}
+			return nil, Redirect(status, "https://" + host + request.RequestURI()), nil
+		}
+	}
+}
+
+//把Host统一为带www.或者不带www.的形式,IP地址不处理
+func CanonicalWWW(www bool, status int) Middleware{
+	return func(next RequestHandler) RequestHandler {
+		return func(ctx *ConnContext, request *Request) (*Request, *DirectResponse, error) {
+			host := request.Header("Host")
+			name := host
+			if h, _, err := net.SplitHostPort(host); err == nil{
+				name = h
+			}
+			if name == "" || net.ParseIP(strings.Trim(name, "[]")) != nil{
+				return next(ctx, request)
+			}
+
+			has := strings.HasPrefix(strings.ToLower(host), "www.")
+			switch {
+			case www && !has:
+				host = "www." + host
+			case !www && has:
+				host = host[len("www."): ]
+			default:
+				return next(ctx, request)
+			}
+			return nil, Redirect(status, requestScheme(ctx) + "://" + host + request.RequestURI()), nil
+		}
+	}
+}
+
+//统一路径结尾的/,add为true时给最后一段不包含.的路径加上/,否则去掉根路径以外的/
+//status为0时只重写转发的URI
+func TrailingSlash(add bool, status int) Middleware{
+	return func(next RequestHandler) RequestHandler {
+		return func(ctx *ConnContext, request *Request) (*Request, *DirectResponse, error) {
+			path := request.Path()
+			rest := request.URI[len(path): ]
+
+			has := strings.HasSuffix(path, "/")
+			switch {
+			case add && !has && !strings.Contains(path[strings.LastIndexByte(path, '/') + 1: ], "."):
+				path += "/"
+			case !add && has && path != "/":
+				path = strings.TrimRight(path, "/")
+				if path == ""{
+					path = "/"
+				}
+			default:
+				return next(ctx, request)
+			}
+			return rewriteOrRedirect(next, ctx, request, status, path + rest)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package go_virtual_host
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestRewriteRule(t *testing.T) {
+	cases := []struct{
+		rule RewriteRule
+		uri string
+		expect string
+		ok bool
+	}{
+		{RewriteRule{Pattern: "^/old/(.*)$", Replacement: "/new/$1"}, "/old/a/b?x=1", "/new/a/b?x=1", true},
+		{RewriteRule{Pattern: "^/old/(.*)$", Replacement: "/new/$1"}, "/other", "", false},
+		{RewriteRule{Pattern: `^/u/(?P<id>\d+)$`, Replacement: "/user?id=${id}"}, "/u/42?x=1", "/user?id=42&x=1", true},
+		{RewriteRule{Pattern: `^/u/(\d+)$`, Replacement: "/user?id=$1?"}, "/u/42?x=1", "/user?id=42", true},
+		{RewriteRule{Pattern: `^/drop$`, Replacement: "/kept?"}, "/drop?x=1", "/kept", true},
+		{RewriteRule{Pattern: `^/(.*)$`, Replacement: "https://example.com/$1", Redirect: 308}, "/a?b=c", "https://example.com/a?b=c", true},
+	}
+
+	for i, c := range cases{
+		if err := c.rule.compile(); err != nil{
+			t.Fatalf("case %d: %v", i, err)
+		}
+		uri, ok := c.rule.rewrite(c.uri)
+		if ok != c.ok || uri != c.expect{
+			t.Fatalf("case %d: expect %q %v, got %q %v", i, c.expect, c.ok, uri, ok)
+		}
+	}//for
+
+	for _, rule := range []*RewriteRule{
+		{Pattern: "(", Replacement: "/"},
+		{Pattern: "^/", Replacement: "/", Redirect: 200},
+		{Pattern: "^/", Replacement: "relative"},
+	}{
+		if _, err := NewRewriter(rule); err == nil{
+			t.Fatalf("expect error for %+v", rule)
+		}
+	}
+}
+
+func TestRewriter(t *testing.T) {
+	rewriter, err := NewRewriter(
+		&RewriteRule{Pattern: "^/legacy/(.*)$", Replacement: "/v2/$1", Redirect: 301},
+		&RewriteRule{Pattern: "^/a/(.*)$", Replacement: "/b/$1"},
+		&RewriteRule{Pattern: "^/b/(.*)$", Replacement: "/c/$1?from=b", Last: true},
+		&RewriteRule{Pattern: "^/c/(.*)$", Replacement: "/d/$1"},
+	)
+	if err != nil{
+		t.Fatal(err)
+	}
+	handler := Chain(rewriter)
+
+	request, response, _ := handler(&ConnContext{}, &Request{URI: "/a/x?q=1"})
+	if response != nil || request.URI != "/c/x?from=b&q=1" || fmt.Sprint(request.Query["from"], request.Query["q"]) != "[b] [1]"{
+		t.Fatalf("unexpected rewrite %+v %v", request, response)
+	}
+
+	_, response, _ = handler(&ConnContext{}, &Request{URI: "/legacy/page"})
+	if response == nil || response.StatusCode != 301 || response.Header["Location"] != "/v2/page"{
+		t.Fatalf("unexpected redirect %+v", response)
+	}
+}
+
+func TestBuiltinRedirects(t *testing.T) {
+	newRequest := func(host string, uri string) *Request {
+		request := &Request{URI: uri}
+		request.SetHeader("Host", host)
+		return request
+	}
+	plain, secure := &ConnContext{}, &ConnContext{TLS: &tls.ConnectionState{}}
+
+	cases := []struct{
+		middleware Middleware
+		ctx *ConnContext
+		request *Request
+		//为空表示不重定向
+		location string
+		uri string
+	}{
+		{RedirectHTTPS(301), plain, newRequest("example.com:8080", "/a?b=1"), "https://example.com/a?b=1", ""},
+		{RedirectHTTPS(301), secure, newRequest("example.com", "/a"), "", "/a"},
+		{CanonicalWWW(true, 301), secure, newRequest("example.com", "/a"), "https://www.example.com/a", ""},
+		{CanonicalWWW(false, 308), plain, newRequest("WWW.example.com", "/a"), "http://example.com/a", ""},
+		{CanonicalWWW(true, 301), plain, newRequest("127.0.0.1:80", "/a"), "", "/a"},
+		{TrailingSlash(true, 301), plain, newRequest("a", "/docs?x=1"), "/docs/?x=1", ""},
+		{TrailingSlash(true, 301), plain, newRequest("a", "/logo.png"), "", "/logo.png"},
+		{TrailingSlash(false, 0), plain, newRequest("a", "/docs//?x=1"), "", "/docs?x=1"},
+		{TrailingSlash(false, 0), plain, newRequest("a", "/"), "", "/"},
+	}
+
+	for i, c := range cases{
+		request, response, _ := Chain(c.middleware)(c.ctx, c.request)
+		if c.location != ""{
+			if response == nil || response.Header["Location"] != c.location{
+				t.Fatalf("case %d: expect redirect to %q, got %+v", i, c.location, response)
+			}
+			continue
+		}
+
+		if response != nil || request.URI != c.uri{
+			t.Fatalf("case %d: expect %q, got %+v %+v", i, c.uri, request, response)
+		}
+	}//for
+}
+
+func TestCrackRewriteConfig(t *testing.T) {
+	backend := startEchoBackend(t)
+	defer backend.Close()
+
+	cfg, err := ParseConfig([]byte(`{
+		"listeners": [{"listen": "127.0.0.1:0", "mode": "crack",
+			"rewrites": [
+				{"pattern": "^/old/(.*)$", "replacement": "/new/$1", "redirect": 302},
+				{"pattern": "^/api/v1/(.*)$", "replacement": "/v1/$1"}
+			],
+			"hosts": [{"backend": "web"}]}],
+		"backends": {"web": {"addresses": ["` + backend.Addr().String() + `"]}}
+	}`))
+	if err != nil{
+		t.Fatal(err)
+	}
+
+	servers, stop, err := NewServersFromConfig(cfg)
+	if err != nil{
+		t.Fatal(err)
+	}
+	defer stop()
+	proxy := servers[0].(*Proxy)
+	defer proxy.Close()
+	proxy.AsyncStart()
+
+	conn, err := net.Dial("tcp", proxy.Addr().String())
+	if err != nil{
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	tr := NewTextReader(conn)
+
+	if _, body := roundTrip(t, conn, tr, "GET /api/v1/users?id=1 HTTP/1.1\r\nHost: a\r\n\r\n"); body != "a /v1/users?id=1 "{
+		t.Fatalf("unexpected body %q", body)
+	}
+	response, _ := roundTrip(t, conn, tr, "GET /old/page HTTP/1.1\r\nHost: a\r\n\r\n")
+	if response.StatusCode != 302 || response.Header("Location") != "/new/page"{
+		t.Fatalf("unexpected response %+v", response)
+	}
+}
+
+//解码之后的CR和LF不能出现在Location中,否则可以拆分出额外的响应头
+func TestRedirectResponseSplitting(t *testing.T) {
+	read := func(response *DirectResponse) *Response {
+		var b strings.Builder
+		if err := response.write(&b); err != nil{
+			t.Fatal(err)
+		}
+		parsed, err := NewTextReader(strings.NewReader(b.String())).ReadResponse()
+		if err != nil{
+			t.Fatal(err)
+		}
+		return parsed
+	}
+
+	cases := []struct{
+		middleware Middleware
+		location string
+	}{
+		{RedirectHTTPS(301), "https://example.com/a%0d%0aSet-Cookie:%20evil=1"},
+		{CanonicalWWW(true, 301), "http://www.example.com/a%0d%0aSet-Cookie:%20evil=1"},
+		{TrailingSlash(true, 301), "/a%0D%0ASet-Cookie:%20evil=1/"},
+	}
+	for i, c := range cases{
+		request, err := NewTextReader(strings.NewReader("GET /a%0d%0aSet-Cookie:%20evil=1 HTTP/1.1\r\nHost: example.com\r\n\r\n")).ReadRequest()
+		if err != nil{
+			t.Fatal(err)
+		}
+
+		_, response, _ := Chain(c.middleware)(&ConnContext{}, request)
+		if response == nil{
+			t.Fatalf("case %d: expect redirect", i)
+		}
+		parsed := read(response)
+		if parsed.Header("Set-Cookie") != "" || parsed.Header("Location") != c.location{
+			t.Fatalf("case %d: unexpected location %q, set-cookie %q", i, parsed.Header("Location"), parsed.Header("Set-Cookie"))
+		}
+	}//for
+
+	//中间件直接设置的header也不能拆分
+	response := Respond(200, "")
+	response.Header["X-Value"] = "a\r\nSet-Cookie: evil=1"
+	if parsed := read(response); parsed.Header("Set-Cookie") != "" || parsed.Header("X-Value") != "aSet-Cookie: evil=1"{
+		t.Fatalf("unexpected header %q, set-cookie %q", parsed.Header("X-Value"), parsed.Header("Set-Cookie"))
+	}
+}
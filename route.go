@@ -0,0 +1,327 @@
+package go_virtual_host
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+var errNoRoute = errors.New("no route matched")
+
+//路由规则,host和path同时匹配才会选中
+//Path、PathPrefix、PathRegex最多只能设置一个,都为空时匹配任意路径
+type Route struct {
+	//为空匹配任意host,支持*.example.com形式的通配
+	Host string
+
+	//精确匹配路径
+	Path string
+
+	//前缀匹配,多个前缀都匹配时选择最长的
+	PathPrefix string
+
+	//正则匹配
+	PathRegex string
+
+	//为空匹配任意方法
+	Methods []string
+
+	//header必须等于给定的值,值为空时只要求header存在
+	Headers map[string]string
+
+	//只匹配WebSocket升级请求
+	WebSocket bool
+
+	//转发之前去掉请求路径中的PathPrefix
+	StripPrefix bool
+
+	//后端地址
+	Backend string
+
+	regex *regexp.Regexp
+}
+
+func (r *Route) String() string{
+	path := "*"
+	switch {
+	case r.Path != "":
+		path = "=" + r.Path
+	case r.PathPrefix != "":
+		path = r.PathPrefix + "*"
+	case r.PathRegex != "":
+		path = "~" + r.PathRegex
+	}
+
+	host := r.Host
+	if host == ""{
+		host = "*"
+	}
+
+	return fmt.Sprintf("%s%s -> %s", host, path, r.Backend)
+}
+
+func (r *Route) compile() (err error){
+	n := 0
+	for _, p := range []string{r.Path, r.PathPrefix, r.PathRegex}{
+		if p != ""{
+			n++
+		}
+	}
+
+	if n > 1{
+		return errors.New("only one of path, path prefix and path regex can be set")
+	}
+
+	if r.StripPrefix && r.PathPrefix == ""{
+		return errors.New("strip prefix requires path prefix")
+	}
+
+	if r.PathRegex != ""{
+		if r.regex, err = regexp.Compile(r.PathRegex); err != nil{
+			return
+		}
+	}
+
+	return nil
+}
+
+//host匹配的优先级,精确匹配 > 通配(后缀越长越优先) > 任意,不匹配返回-1
+func (r *Route) hostScore(host string) int{
+	if r.Host == ""{
+		return 0
+	}
+
+	if strings.HasPrefix(r.Host, "*."){
+		suffix := r.Host[1: ]
+		if len(host) > len(suffix) && strings.HasSuffix(strings.ToLower(host), strings.ToLower(suffix)){
+			return 1 + len(suffix)
+		}
+		return -1
+	}
+
+	if strings.EqualFold(r.Host, host){
+		return 1 << 16
+	}
+
+	return -1
+}
+
+//path匹配的优先级,精确匹配 > 前缀(越长越优先) > 正则 > 任意,不匹配返回-1
+func (r *Route) pathScore(path string) int{
+	switch {
+	case r.Path != "":
+		if r.Path == path{
+			return 1 << 16
+		}
+	case r.PathPrefix != "":
+		if strings.HasPrefix(path, r.PathPrefix){
+			return 2 + len(r.PathPrefix)
+		}
+	case r.regex != nil:
+		if r.regex.MatchString(path){
+			return 1
+		}
+	default:
+		return 0
+	}
+
+	return -1
+}
+
+//设置的条件越多越具体,host和path相同时优先选择更具体的路由
+func (r *Route) predicateScore() int{
+	score := len(r.Headers)
+	if len(r.Methods) > 0{
+		score++
+	}
+	if r.WebSocket{
+		score++
+	}
+	return score
+}
+
+func (r *Route) matchPredicates(request *Request) bool{
+	if len(r.Methods) > 0{
+		matched := false
+		for _, method := range r.Methods{
+			if strings.EqualFold(method, request.Method){
+				matched = true
+				break
+			}
+		}//for
+
+		if !matched{
+			return false
+		}
+	}//if
+
+	if r.WebSocket && !request.IsWebSocket(){
+		return false
+	}
+
+	for key, value := range r.Headers{
+		v, ok := headerGet(request.header, key)
+		if !ok || (value != "" && v != value){
+			return false
+		}
+	}//for
+
+	return true
+}
+
+//去掉host中的端口
+func hostWithoutPort(host string) string{
+	if h, _, err := net.SplitHostPort(host); err == nil{
+		return h
+	}
+	return host
+}
+
+type RouteTable struct {
+	mu sync.RWMutex
+	routes []*Route
+}
+
+func NewRouteTable() *RouteTable{
+	return &RouteTable{}
+}
+
+func (rt *RouteTable) Add(route *Route) error{
+	if route.Backend == ""{
+		return fmt.Errorf("route %s: backend is empty", route)
+	}
+
+	if err := route.compile(); err != nil{
+		return fmt.Errorf("route %s: %v", route, err)
+	}
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	rt.routes = append(rt.routes, route)
+	return nil
+}
+
+//按添加顺序返回所有路由
+func (rt *RouteTable) Routes() []*Route{
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+
+	routes := make([]*Route, len(rt.routes))
+	copy(routes, rt.routes)
+	return routes
+}
+
+//选择优先级最高的路由,依次比较host、path和条件的数量,都相同时选择先添加的
+func (rt *RouteTable) Match(request *Request) (*Route, bool){
+	host := hostWithoutPort(request.Header("Host"))
+	path := request.Path()
+
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+
+	var (
+		best *Route
+		bestHost int
+		bestPath int
+		bestPredicate int
+	)
+
+	for _, route := range rt.routes{
+		hs := route.hostScore(host)
+		if hs < 0{
+			continue
+		}
+
+		ps := route.pathScore(path)
+		if ps < 0 || !route.matchPredicates(request){
+			continue
+		}
+
+		rs := route.predicateScore()
+		if best == nil || hs > bestHost || (hs == bestHost && (ps > bestPath || (ps == bestPath && rs > bestPredicate))){
+			best, bestHost, bestPath, bestPredicate = route, hs, ps, rs
+		}
+	}//for
+
+	return best, best != nil
+}
+
+//匹配路由并在需要时去掉路径前缀,返回后端地址
+//可以直接作为NewKeepAliveProxy的route
+func (rt *RouteTable) Route(request *Request) (string, error){
+	route, ok := rt.Match(request)
+	if !ok{
+		return "", errNoRoute
+	}
+
+	if route.StripPrefix{
+		request.stripPathPrefix(route.PathPrefix)
+	}
+
+	return route.Backend, nil
+}
+
+//可以直接作为NewCommonProxy和NewCrackProxy的getProxy
+func (rt *RouteTable) GetProxy(request *Request) (net.Conn, error){
+	route, ok := rt.Match(request)
+	if !ok{
+		return nil, errNoRoute
+	}
+
+	return net.Dial("tcp", route.Backend)
+}
+
+//crack模式下同一连接上的请求都转发到第一个请求选择的后端
+//之后的请求匹配到其他后端时响应421,客户端可以使用新的连接重试
+var errMisdirected = &HttpError{StatusCode: 421, Message: "request matches another backend, retry on a new connection"}
+
+//ConnContext.Values中记录连接选择的后端
+const boundBackendKey = "route.backend"
+
+func bindBackend(ctx *ConnContext, backend string) error{
+	if ctx == nil || ctx.Values == nil{
+		return nil
+	}
+
+	bound, ok := ctx.Values[boundBackendKey].(string)
+	if !ok{
+		ctx.Values[boundBackendKey] = backend
+		return nil
+	}
+
+	if bound != backend{
+		return errMisdirected
+	}
+	return nil
+}
+
+//HttpCrack的middleware,去掉匹配路由的路径前缀,通过WithMiddleware用于NewCrackProxy
+//后端由第一个请求选择,之后匹配到其他后端的请求响应421
+func (rt *RouteTable) Middleware() Middleware{
+	return routeMiddleware(rt.Match)
+}
+
+func routeMiddleware(match func(*Request) (*Route, bool)) Middleware{
+	return func(next RequestHandler) RequestHandler {
+		return func(ctx *ConnContext, request *Request) (*Request, *DirectResponse, error) {
+			route, ok := match(request)
+
+			//没有匹配的路由也不能转发到连接已经选择的后端
+			backend := ""
+			if ok{
+				backend = route.Backend
+			}
+			if err := bindBackend(ctx, backend); err != nil{
+				return nil, nil, err
+			}
+
+			if ok && route.StripPrefix{
+				request.stripPathPrefix(route.PathPrefix)
+			}
+			return next(ctx, request)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package go_virtual_host
+
+import (
+	"net"
+	"testing"
+)
+
+func TestRouteTableMatch(t *testing.T) {
+	rt := NewRouteTable()
+	routes := []*Route{
+		{Host: "example.com", Backend: "root"},
+		{Host: "example.com", PathPrefix: "/api/", Backend: "api"},
+		{Host: "example.com", PathPrefix: "/api/v2/", StripPrefix: true, Backend: "api-v2"},
+		{Host: "example.com", Path: "/api/health", Backend: "health"},
+		{Host: "example.com", PathRegex: `\.png$`, Backend: "images"},
+		{Host: "*.example.com", Backend: "wildcard"},
+		{Host: "example.com", PathPrefix: "/admin/", Methods: []string{"POST"}, Headers: map[string]string{"X-Admin": ""}, Backend: "admin"},
+	}
+	for _, route := range routes{
+		if err := rt.Add(route); err != nil{
+			t.Fatal(err)
+		}
+	}
+
+	cases := []struct{
+		method string
+		host string
+		uri string
+		header map[string]string
+		backend string
+		uriAfter string
+	}{
+		{"GET", "example.com", "/", nil, "root", "/"},
+		{"GET", "example.com:8080", "/api/users", nil, "api", "/api/users"},
+		{"GET", "example.com", "/api/v2/users?id=1", nil, "api-v2", "/users?id=1"},
+		{"GET", "example.com", "/api/health", nil, "health", "/api/health"},
+		{"GET", "example.com", "/logo.png", nil, "images", "/logo.png"},
+		{"GET", "www.example.com", "/api/users", nil, "wildcard", "/api/users"},
+		{"GET", "example.com", "/admin/x", map[string]string{"X-Admin": "1"}, "root", "/admin/x"},
+		{"POST", "example.com", "/admin/x", map[string]string{"x-admin": "1"}, "admin", "/admin/x"},
+	}
+
+	for _, c := range cases{
+		request := &Request{Method: c.method, URI: c.uri, Version: "HTTP/1.1"}
+		request.SetHeader("Host", c.host)
+		for key, value := range c.header{
+			request.SetHeader(key, value)
+		}
+
+		backend, err := rt.Route(request)
+		if err != nil{
+			t.Fatalf("%s %s%s: %v", c.method, c.host, c.uri, err)
+		}
+		if backend != c.backend || request.URI != c.uriAfter{
+			t.Fatalf("%s %s%s: expect %s %s, got %s %s", c.method, c.host, c.uri, c.backend, c.uriAfter, backend, request.URI)
+		}
+	}
+
+	request := &Request{Method: "GET", URI: "/", Version: "HTTP/1.1"}
+	request.SetHeader("Host", "other.com")
+	if _, err := rt.Route(request); err != errNoRoute{
+		t.Fatalf("expect errNoRoute, got %v", err)
+	}
+}
+
+func TestCrackRouteMiddleware(t *testing.T) {
+	api := startEchoBackend(t)
+	defer api.Close()
+
+	rt := NewRouteTable()
+	for _, route := range []*Route{
+		{PathPrefix: "/api", StripPrefix: true, Backend: api.Addr().String()},
+		{PathPrefix: "/v2", StripPrefix: true, Backend: api.Addr().String()},
+		{PathPrefix: "/static", StripPrefix: true, Backend: "127.0.0.1:1"},
+	}{
+		if err := rt.Add(route); err != nil{
+			t.Fatal(err)
+		}
+	}
+
+	proxy := NewCrackProxy("127.0.0.1:0", rt.GetProxy, nil, WithMiddleware(rt.Middleware())).(*Proxy)
+	defer proxy.Close()
+	proxy.AsyncStart()
+
+	conn, err := net.Dial("tcp", proxy.Addr().String())
+	if err != nil{
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	tr := NewTextReader(conn)
+
+	//同一后端的其他路由按各自的规则去掉前缀
+	if _, body := roundTrip(t, conn, tr, "GET /api/x HTTP/1.1\r\nHost: a\r\n\r\n"); body != "a /x "{
+		t.Fatalf("unexpected body %q", body)
+	}
+	if _, body := roundTrip(t, conn, tr, "GET /v2/y HTTP/1.1\r\nHost: a\r\n\r\n"); body != "a /y "{
+		t.Fatalf("unexpected body %q", body)
+	}
+
+	//连接已经选择了api,匹配到其他后端时不转发
+	if response, _ := roundTrip(t, conn, tr, "GET /static/z HTTP/1.1\r\nHost: a\r\n\r\n"); response.StatusCode != 421{
+		t.Fatalf("expect 421, got %d", response.StatusCode)
+	}
+}
@@ -46,12 +46,13 @@ func (s *sharedConn) Read(b []byte) (n int, err error){
 //sharedConn提供给外部正常使用
 //返回一个reader,从中读取需要peek的字节,并将读取的字节放入sharedConn的vbuff中
 //用teeReader即可
+//vbuff最多缓存maxPeek个字节,超过时reader返回LimitError,maxPeek不大于0时不限制
 
-func newSharedConn(conn net.Conn) (sc *sharedConn, reader io.Reader){
+func newSharedConn(conn net.Conn, maxPeek int) (sc *sharedConn, reader io.Reader){
 	sc = &sharedConn{
 		Conn: conn,
 		vbuff: bytes.NewBuffer(make([]byte, 0, initVbuffSize)),
 	}
 
-	return sc, io.TeeReader(conn, sc.vbuff)
+	return sc, io.TeeReader(conn, peekBuffer{sc.vbuff, maxPeek})
 }
\ No newline at end of file
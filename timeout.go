@@ -0,0 +1,245 @@
+package go_virtual_host
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	timeoutHeader = "header"
+	timeoutDial = "dial"
+	timeoutIdle = "idle"
+	timeoutLifetime = "lifetime"
+)
+
+//连接的超时设置,0表示不超时
+type Timeouts struct {
+	//读取Host或者SNI的时间,keepalive模式下为读取每个请求头的时间
+	Header time.Duration
+
+	//连接后端的时间,包括重试
+	Dial time.Duration
+
+	//两个方向都没有数据的时间,keepalive模式下为等待下一个请求的时间
+	Idle time.Duration
+
+	//连接的最长时间
+	Lifetime time.Duration
+}
+
+func WithTimeouts(timeouts Timeouts) Option{
+	return func(p *Proxy) {
+		p.SetTimeouts(timeouts)
+	}
+}
+
+//修改超时设置,只影响之后的连接
+func (p *Proxy) SetTimeouts(timeouts Timeouts){
+	p.timeouts.Store(timeouts)
+}
+
+func (p *Proxy) Timeouts() Timeouts{
+	timeouts, _ := p.timeouts.Load().(Timeouts)
+	return timeouts
+}
+
+type timeoutError struct {
+	kind string
+}
+
+func (e *timeoutError) Error() string{
+	return e.kind + " timeout"
+}
+
+func (e *timeoutError) Timeout() bool{
+	return true
+}
+
+func (e *timeoutError) Temporary() bool{
+	return true
+}
+
+func isTimeout(err error) bool{
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+//convert返回的错误是由哪个超时引起的,读取阶段的超时都是header超时
+func convertTimeout(err error) string{
+	var te *timeoutError
+	if errors.As(err, &te){
+		return te.kind
+	}
+
+	var oe *net.OpError
+	if errors.As(err, &oe) && oe.Op == "dial"{
+		if oe.Timeout(){
+			return timeoutDial
+		}
+		return ""
+	}
+
+	if isTimeout(err){
+		return timeoutHeader
+	}
+	return ""
+}
+
+//在timeout时间内完成dial,超时之后建立的连接会被关闭
+func dialTimeout(timeout time.Duration, dial func() (net.Conn, error)) (net.Conn, error){
+	if timeout <= 0{
+		return dial()
+	}
+
+	type result struct {
+		conn net.Conn
+		err error
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		conn, err := dial()
+		done <- result{conn, err}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case r := <-done:
+		return r.conn, r.err
+	case <-timer.C:
+	}
+
+	go func() {
+		if r := <-done; r.conn != nil{
+			_ = r.conn.Close()
+		}
+	}()
+	return nil, &timeoutError{timeoutDial}
+}
+
+//负责连接的lifetime和idle超时,超时后关闭所有注册的连接
+type connWatchdog struct {
+	p *Proxy
+	remote string
+
+	idle time.Duration
+	//最后一次读到数据的时间(UnixNano)
+	last int64
+
+	mu sync.Mutex
+	closers []io.Closer
+	lifetimeTimer *time.Timer
+	idleTimer *time.Timer
+	fired string
+	stopped bool
+}
+
+func newConnWatchdog(p *Proxy, conn net.Conn, timeouts Timeouts) *connWatchdog{
+	w := &connWatchdog{p: p, remote: conn.RemoteAddr().String(), closers: []io.Closer{conn}}
+
+	if timeouts.Lifetime > 0{
+		w.lifetimeTimer = time.AfterFunc(timeouts.Lifetime, func() {
+			w.fire(timeoutLifetime)
+		})
+	}
+	return w
+}
+
+//连接后端之后才开始计算idle
+func (w *connWatchdog) startIdle(idle time.Duration, closers ...io.Closer){
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.closers = append(w.closers, closers...)
+	if idle <= 0 || w.stopped{
+		return
+	}
+
+	w.idle = idle
+	w.touch()
+	w.idleTimer = time.AfterFunc(idle, w.checkIdle)
+}
+
+func (w *connWatchdog) tracksIdle() bool{
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.idle > 0
+}
+
+//分块splice时每块的最长等待时间,块结束时才更新idle计时,最多晚这么久
+func (w *connWatchdog) spliceWindow() time.Duration{
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.idle / 8
+}
+
+func (w *connWatchdog) touch(){
+	atomic.StoreInt64(&w.last, time.Now().UnixNano())
+}
+
+//没有超时就等到最早可能超时的时间再检查
+func (w *connWatchdog) checkIdle(){
+	since := time.Since(time.Unix(0, atomic.LoadInt64(&w.last)))
+	if since >= w.idle{
+		w.fire(timeoutIdle)
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.stopped{
+		w.idleTimer.Reset(w.idle - since)
+	}
+}
+
+func (w *connWatchdog) fire(kind string){
+	w.mu.Lock()
+	if w.stopped || w.fired != ""{
+		w.mu.Unlock()
+		return
+	}
+	w.fired = kind
+	closers := w.closers
+	w.mu.Unlock()
+
+	w.p.logLn("%s timeout fired for conn %s, closing", kind, w.remote)
+	for _, c := range closers{
+		_ = c.Close()
+	}
+}
+
+func (w *connWatchdog) stop(){
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.stopped = true
+	for _, t := range []*time.Timer{w.lifetimeTimer, w.idleTimer}{
+		if t != nil{
+			t.Stop()
+		}
+	}
+}
+
+//读到数据时更新idle计时并累加字节数,w和counter都可以为nil
+type activityReader struct {
+	io.Reader
+	w *connWatchdog
+	counter *int64
+}
+
+func (r activityReader) Read(b []byte) (int, error){
+	n, err := r.Reader.Read(b)
+	if n > 0{
+		if r.w != nil{
+			r.w.touch()
+		}
+		addCount(r.counter, int64(n))
+	}
+	return n, err
+}
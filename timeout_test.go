@@ -0,0 +1,91 @@
+package go_virtual_host
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHeaderTimeout(t *testing.T) {
+	backend := startBackend(t, "a")
+	defer backend.Close()
+
+	getProxy := func(request *Request) (net.Conn, error){
+		return net.Dial("tcp", backend.Addr().String())
+	}
+
+	server := NewCommonProxy("127.0.0.1:0", getProxy, WithTimeouts(Timeouts{Header: 50 * time.Millisecond}))
+	proxy := server.(*Proxy)
+	defer proxy.Close()
+	server.AsyncStart()
+
+	conn, err := net.Dial("tcp", proxy.Addr().String())
+	if err != nil{
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	//只发送一半请求头
+	_, _ = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: a.example.com\r\n")
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	data, err := ioutil.ReadAll(conn)
+	if err != nil{
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), "HTTP/1.1 408 "){
+		t.Fatalf("expect 408, got %q", data)
+	}
+}
+
+func TestIdleAndLifetimeTimeout(t *testing.T) {
+	backend := startBackend(t, "a")
+	defer backend.Close()
+
+	getProxy := func(request *Request) (net.Conn, error){
+		return net.Dial("tcp", backend.Addr().String())
+	}
+
+	for _, timeouts := range []Timeouts{{Idle: 50 * time.Millisecond}, {Lifetime: 100 * time.Millisecond}}{
+		server := NewCrackProxy("127.0.0.1:0", getProxy, nil, WithTimeouts(timeouts))
+		proxy := server.(*Proxy)
+		server.AsyncStart()
+
+		conn, err := net.Dial("tcp", proxy.Addr().String())
+		if err != nil{
+			t.Fatal(err)
+		}
+
+		_, _ = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: a.example.com\r\n\r\n")
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+		//收到响应之后连接应该被代理关闭,而不是等到读取超时
+		data, err := ioutil.ReadAll(conn)
+		if err != nil{
+			t.Fatalf("%+v: %v", timeouts, err)
+		}
+		if !strings.HasSuffix(string(data), "a /"){
+			t.Fatalf("%+v: unexpected response %q", timeouts, data)
+		}
+
+		_ = conn.Close()
+		_ = proxy.Close()
+	}
+}
+
+func TestDialTimeout(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+
+	_, err := dialTimeout(20 * time.Millisecond, func() (net.Conn, error) {
+		<-block
+		return nil, io.EOF
+	})
+
+	if convertTimeout(err) != timeoutDial{
+		t.Fatalf("expect dial timeout, got %v", err)
+	}
+}
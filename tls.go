@@ -2,9 +2,13 @@ package go_virtual_host
 
 import (
 	"bufio"
+	"crypto/md5"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"net"
+	"strconv"
+	"strings"
 )
 
 //tls记录层协议
@@ -64,12 +68,17 @@ func (tc *TlsConn) Host() string{
 }
 
 func TLS(conn net.Conn) (tc *TlsConn, err error){
-    sc, tee := newSharedConn(conn)
+    return newTlsConn(conn, DefaultPeekLimits)
+}
+
+func newTlsConn(conn net.Conn, limits PeekLimits) (tc *TlsConn, err error){
+    sc, tee := newSharedConn(conn, limits.MaxPeekBytes)
 
     clientHello, err := readClientHello(tee)
     if err != nil{
     	return nil, err
 	}//if
+	clientHello.remoteAddr = conn.RemoteAddr().String()
 
 	return &TlsConn{sharedConn: sc, clientHello:clientHello}, nil
 }
@@ -153,9 +162,33 @@ type ClientHello struct {
     //length 2 bytes
     //data length bytes
     ServerName string
+
+    //扩展字段的类型,按出现的顺序
+    Extensions []int
+
+    //supported_groups(0x000a)和ec_point_formats(0x000b)扩展的内容,用于计算指纹
+    SupportedGroups []int
+    PointFormats []int
+
+    //application_layer_protocol_negotiation(0x0010)扩展中客户端支持的协议
+    ALPN []string
+
+    //客户端地址,由TLS设置
+    remoteAddr string
+}
+
+//tls模式下用SNI作为Host生成请求,用于路由和负载均衡
+func helloRequest(hello *ClientHello) *Request{
+	request := &Request{URI: "/", RemoteAddr: hello.remoteAddr}
+	request.SetHeader("Host", hello.ServerName)
+	return request
 }
 
 
+//从reader中读取并解析ClientHello
+func ReadClientHello(reader io.Reader) (*ClientHello, error){
+	return readClientHello(reader)
+}
 
 func readClientHello(reader io.Reader) (client *ClientHello, err error){
 	bufReader := bufio.NewReader(reader)
@@ -317,6 +350,32 @@ func readClientHello(reader io.Reader) (client *ClientHello, err error){
         data := extensions[4: 4 + extLen]
 		extensions = extensions[4 + extLen: ]
 
+		client.Extensions = append(client.Extensions, extTyp)
+
+		switch extTyp {
+		case 0x000a:
+			if len(data) < 2 || len(data[2: ]) < uToInt(data[: 2]){
+				return nil, alertUnexpectedMsg
+			}
+			for groups := data[2: 2 + uToInt(data[: 2])]; len(groups) >= 2; groups = groups[2: ]{
+				client.SupportedGroups = append(client.SupportedGroups, uToInt(groups[: 2]))
+			}
+			continue
+		case 0x000b:
+			if len(data) < 1 || len(data[1: ]) < int(data[0]){
+				return nil, alertUnexpectedMsg
+			}
+			for _, f := range data[1: 1 + int(data[0])]{
+				client.PointFormats = append(client.PointFormats, int(f))
+			}
+			continue
+		case 0x0010:
+			if client.ALPN, err = readALPN(data); err != nil{
+				return nil, err
+			}
+			continue
+		}
+
 		if extTyp != 0x000{
 			continue
 		}//if
@@ -357,4 +416,59 @@ func readClientHello(reader io.Reader) (client *ClientHello, err error){
 	}//for
 
 	return client, nil
-}
\ No newline at end of file
+}
+//ALPN扩展的格式为 ListLength 2 bytes, 之后每个协议为 Length 1 byte, Name Length bytes
+func readALPN(data []byte) ([]string, error){
+	if len(data) < 2 || len(data[2: ]) < uToInt(data[: 2]){
+		return nil, alertUnexpectedMsg
+	}
+
+	var protocols []string
+	for list := data[2: 2 + uToInt(data[: 2])]; len(list) > 0; {
+		l := int(list[0])
+		if len(list[1: ]) < l{
+			return nil, alertUnexpectedMsg
+		}
+		protocols = append(protocols, string(list[1: 1 + l]))
+		list = list[1 + l: ]
+	}//for
+
+	return protocols, nil
+}
+
+//GREASE(RFC 8701)保留的值,计算指纹时忽略
+func isGrease(v int) bool{
+	return v & 0x0f0f == 0x0a0a && v >> 8 == v & 0xff
+}
+
+func joinInts(values []int) string{
+	s := make([]string, 0, len(values))
+	for _, v := range values{
+		if !isGrease(v){
+			s = append(s, strconv.Itoa(v))
+		}
+	}
+	return strings.Join(s, "-")
+}
+
+//JA3字符串: Version,CipherSuites,Extensions,SupportedGroups,PointFormats
+func (client *ClientHello) JA3() string{
+	ciphers := make([]int, 0, len(client.CipherSuits) / 2)
+	for i := 0; i + 1 < len(client.CipherSuits); i += 2{
+		ciphers = append(ciphers, uToInt(client.CipherSuits[i: i + 2]))
+	}
+
+	return strings.Join([]string{
+		strconv.Itoa(client.HandshakeVersion),
+		joinInts(ciphers),
+		joinInts(client.Extensions),
+		joinInts(client.SupportedGroups),
+		joinInts(client.PointFormats),
+	}, ",")
+}
+
+//客户端的JA3指纹,即JA3字符串的md5
+func (client *ClientHello) Fingerprint() string{
+	sum := md5.Sum([]byte(client.JA3()))
+	return hex.EncodeToString(sum[: ])
+}
@@ -1,2 +1,46 @@
 package go_virtual_host
 
+import (
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/hex"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestClientHelloALPNAndFingerprint(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+
+	go func() {
+		conn := tls.Client(client, &tls.Config{ServerName: "example.com", NextProtos: []string{"h2", "http/1.1"}})
+		_ = conn.Handshake()
+	}()
+
+	hello, err := ReadClientHello(server)
+	if err != nil{
+		t.Fatal(err)
+	}
+	_ = client.Close()
+
+	if hello.ServerName != "example.com" || strings.Join(hello.ALPN, ",") != "h2,http/1.1"{
+		t.Fatalf("unexpected hello %s %v", hello.ServerName, hello.ALPN)
+	}
+
+	//扩展中包含server_name(0)和ALPN(16)
+	ja3 := strings.Split(hello.JA3(), ",")
+	if len(ja3) != 5 || ja3[0] != "771" || ja3[1] == "" || ja3[3] == "" ||
+		!strings.Contains("-" + ja3[2] + "-", "-0-") || !strings.Contains("-" + ja3[2] + "-", "-16-"){
+		t.Fatalf("unexpected JA3 %q", hello.JA3())
+	}
+
+	sum := md5.Sum([]byte(hello.JA3()))
+	if hello.Fingerprint() != hex.EncodeToString(sum[: ]){
+		t.Fatalf("unexpected fingerprint %s", hello.Fingerprint())
+	}
+
+	if joinInts([]int{0x0a0a, 4865, 0xfafa}) != "4865"{
+		t.Fatal("GREASE values should be ignored")
+	}
+}
@@ -0,0 +1,658 @@
+package go_virtual_host
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type TraceID [16]byte
+
+type SpanID [8]byte
+
+func (id TraceID) String() string{
+	return hex.EncodeToString(id[: ])
+}
+
+func (id SpanID) String() string{
+	return hex.EncodeToString(id[: ])
+}
+
+func (id TraceID) isZero() bool{
+	return id == TraceID{}
+}
+
+func (id SpanID) isZero() bool{
+	return id == SpanID{}
+}
+
+//span中的事件
+type SpanEvent struct {
+	Name string
+	Time time.Time
+	Attributes map[string]interface{}
+}
+
+//代理处理的一个请求
+//属性的值为string、int64、float64或者bool
+type Span struct {
+	TraceID TraceID
+	SpanID SpanID
+	//从请求的traceparent中继承,新的trace为0
+	ParentSpanID SpanID
+	TraceState string
+	//没有采样的span不会导出,但仍然传递traceparent
+	Sampled bool
+
+	Name string
+	Start time.Time
+	End time.Time
+	Attributes map[string]interface{}
+	Events []SpanEvent
+	//不为空时span的状态为错误
+	Err string
+
+	mu sync.Mutex
+	tracer *Tracer
+	ended bool
+}
+
+func (s *Span) SetAttribute(key string, value interface{}){
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Attributes[key] = value
+}
+
+func (s *Span) AddEvent(name string, attributes map[string]interface{}){
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Events = append(s.Events, SpanEvent{Name: name, Time: time.Now(), Attributes: attributes})
+}
+
+func (s *Span) SetError(err error){
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Err = err.Error()
+}
+
+//结束span并交给exporter,重复调用时只有第一次生效
+func (s *Span) Finish(){
+	s.mu.Lock()
+	if s.ended{
+		s.mu.Unlock()
+		return
+	}
+	s.ended, s.End = true, time.Now()
+	s.mu.Unlock()
+
+	if s.Sampled{
+		s.tracer.export(s)
+	}
+}
+
+//W3C Trace Context格式: version-traceid-parentid-flags
+func (s *Span) traceparent() string{
+	flags := "00"
+	if s.Sampled{
+		flags = "01"
+	}
+	return "00-" + s.TraceID.String() + "-" + s.SpanID.String() + "-" + flags
+}
+
+//解析traceparent,格式错误或者id全为0时返回false
+func parseTraceparent(value string) (traceID TraceID, parentID SpanID, sampled bool, ok bool){
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff"{
+		return
+	}
+	//version 00只有4个部分,更高的版本可以在后面增加
+	if parts[0] == "00" && len(parts) != 4{
+		return
+	}
+
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2{
+		return
+	}
+	if strings.ToLower(value) != value{
+		return
+	}
+
+	if _, err := hex.Decode(traceID[: ], []byte(parts[1])); err != nil{
+		return
+	}
+	if _, err := hex.Decode(parentID[: ], []byte(parts[2])); err != nil{
+		return
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil || traceID.isZero() || parentID.isZero(){
+		return
+	}
+
+	return traceID, parentID, flags[0] & 0x01 == 1, true
+}
+
+func randomID(b []byte){
+	//crypto/rand失败时仍然得到不全为0的id
+	if _, err := rand.Read(b); err != nil{
+		binary.BigEndian.PutUint64(b[len(b) - 8: ], uint64(time.Now().UnixNano()))
+	}
+}
+
+//导出结束的span,例如发送到OTLP collector
+type SpanExporter interface {
+	ExportSpans(spans []*Span) error
+}
+
+const (
+	traceBatchSize = 256
+	traceBatchDelay = time.Second
+)
+
+//创建span并分批交给exporter,多个代理可以共用一个Tracer
+//exporter为nil时不创建span
+type Tracer struct {
+	mu sync.Mutex
+	exporter SpanExporter
+	batch []*Span
+	timer *time.Timer
+
+	//正在导出的批次
+	exporting sync.WaitGroup
+}
+
+func NewTracer(exporter SpanExporter) *Tracer{
+	return &Tracer{exporter: exporter}
+}
+
+//代理使用t为请求创建span,目前只有crack模式支持
+func WithTracer(t *Tracer) Option{
+	return func(p *Proxy) {
+		p.tracer = t
+	}
+}
+
+//替换exporter,尚未导出的span交给原来的exporter,exporter为nil时停止创建span
+func (t *Tracer) SetExporter(exporter SpanExporter){
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.flushLocked()
+	t.exporter = exporter
+}
+
+//立即导出尚未导出的span,并等待正在导出的批次完成
+func (t *Tracer) Flush(){
+	t.mu.Lock()
+	t.flushLocked()
+	t.mu.Unlock()
+
+	t.exporting.Wait()
+}
+
+func (t *Tracer) enabled() bool{
+	if t == nil{
+		return false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.exporter != nil
+}
+
+//开始一个span,traceparent有效时继续其中的trace,否则开始新的trace
+func (t *Tracer) StartSpan(name string, traceparent string, tracestate string, start time.Time) *Span{
+	span := &Span{
+		Name: name,
+		Start: start,
+		Attributes: make(map[string]interface{}),
+		tracer: t,
+		Sampled: true,
+	}
+
+	if traceID, parentID, sampled, ok := parseTraceparent(traceparent); ok{
+		span.TraceID, span.ParentSpanID, span.Sampled = traceID, parentID, sampled
+		span.TraceState = tracestate
+	}else{
+		randomID(span.TraceID[: ])
+	}
+	randomID(span.SpanID[: ])
+	return span
+}
+
+func (t *Tracer) export(span *Span){
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.exporter == nil{
+		return
+	}
+
+	t.batch = append(t.batch, span)
+	if len(t.batch) >= traceBatchSize{
+		t.flushLocked()
+		return
+	}
+
+	if t.timer == nil{
+		t.timer = time.AfterFunc(traceBatchDelay, func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.flushLocked()
+		})
+	}
+}
+
+func (t *Tracer) flushLocked(){
+	if t.timer != nil{
+		t.timer.Stop()
+		t.timer = nil
+	}
+
+	if len(t.batch) == 0 || t.exporter == nil{
+		return
+	}
+
+	spans, exporter := t.batch, t.exporter
+	t.batch = nil
+
+	t.exporting.Add(1)
+	go func() {
+		defer t.exporting.Done()
+		if err := exporter.ExportSpans(spans); err != nil{
+			fmt.Printf("[tracer]: export %d spans error: %v\n", len(spans), err)
+		}
+	}()
+}
+
+//把span保存在内存中,用于测试
+type InMemoryExporter struct {
+	mu sync.Mutex
+	spans []*Span
+}
+
+func (e *InMemoryExporter) ExportSpans(spans []*Span) error{
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, spans...)
+	return nil
+}
+
+//已经导出的span,按导出的顺序
+func (e *InMemoryExporter) Spans() []*Span{
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]*Span(nil), e.spans...)
+}
+
+func (e *InMemoryExporter) Reset(){
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = nil
+}
+
+//通过OTLP/HTTP以JSON编码发送span,endpoint例如http://localhost:4318/v1/traces
+type OTLPExporter struct {
+	endpoint string
+	service string
+	headers map[string]string
+	client *http.Client
+}
+
+func NewOTLPExporter(endpoint string, service string, headers map[string]string) *OTLPExporter{
+	return &OTLPExporter{
+		endpoint: endpoint,
+		service: service,
+		headers: headers,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (e *OTLPExporter) ExportSpans(spans []*Span) error{
+	body, err := json.Marshal(otlpRequest(e.service, spans))
+	if err != nil{
+		return err
+	}
+
+	request, err := http.NewRequest(http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil{
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	for key, value := range e.headers{
+		request.Header.Set(key, value)
+	}
+
+	response, err := e.client.Do(request)
+	if err != nil{
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode / 100 != 2{
+		return fmt.Errorf("otlp endpoint %s returns %s", e.endpoint, response.Status)
+	}
+	return nil
+}
+
+//OTLP的JSON编码,id使用hex,时间和整数使用字符串
+const (
+	otlpSpanKindServer = 2
+	otlpStatusError = 2
+)
+
+type otlpKeyValue struct {
+	Key string `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+type otlpEvent struct {
+	TimeUnixNano string `json:"timeUnixNano"`
+	Name string `json:"name"`
+	Attributes []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID string `json:"traceId"`
+	SpanID string `json:"spanId"`
+	ParentSpanID string `json:"parentSpanId,omitempty"`
+	TraceState string `json:"traceState,omitempty"`
+	Name string `json:"name"`
+	Kind int `json:"kind"`
+	StartTimeUnixNano string `json:"startTimeUnixNano"`
+	EndTimeUnixNano string `json:"endTimeUnixNano"`
+	Attributes []otlpKeyValue `json:"attributes,omitempty"`
+	Events []otlpEvent `json:"events,omitempty"`
+	Status map[string]interface{} `json:"status,omitempty"`
+}
+
+func otlpRequest(service string, spans []*Span) map[string]interface{}{
+	encoded := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans{
+		span := otlpSpan{
+			TraceID: s.TraceID.String(),
+			SpanID: s.SpanID.String(),
+			TraceState: s.TraceState,
+			Name: s.Name,
+			Kind: otlpSpanKindServer,
+			StartTimeUnixNano: otlpTime(s.Start),
+			EndTimeUnixNano: otlpTime(s.End),
+			Attributes: otlpAttributes(s.Attributes),
+		}
+		if !s.ParentSpanID.isZero(){
+			span.ParentSpanID = s.ParentSpanID.String()
+		}
+		for _, e := range s.Events{
+			span.Events = append(span.Events, otlpEvent{
+				TimeUnixNano: otlpTime(e.Time),
+				Name: e.Name,
+				Attributes: otlpAttributes(e.Attributes),
+			})
+		}
+		if s.Err != ""{
+			span.Status = map[string]interface{}{"code": otlpStatusError, "message": s.Err}
+		}
+		encoded = append(encoded, span)
+	}//for
+
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": otlpAttributes(map[string]interface{}{"service.name": service}),
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]interface{}{"name": "github.com/coderwf/go-virtual-host"},
+						"spans": encoded,
+					},
+				},
+			},
+		},
+	}
+}
+
+func otlpTime(t time.Time) string{
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+//按key排序,保证输出稳定
+func otlpAttributes(attributes map[string]interface{}) []otlpKeyValue{
+	keys := make([]string, 0, len(attributes))
+	for key := range attributes{
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	kvs := make([]otlpKeyValue, 0, len(keys))
+	for _, key := range keys{
+		var value map[string]interface{}
+		switch v := attributes[key].(type) {
+		case string:
+			value = map[string]interface{}{"stringValue": v}
+		case int:
+			value = map[string]interface{}{"intValue": strconv.Itoa(v)}
+		case int64:
+			value = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+		case float64:
+			value = map[string]interface{}{"doubleValue": v}
+		case bool:
+			value = map[string]interface{}{"boolValue": v}
+		default:
+			value = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+		}
+		kvs = append(kvs, otlpKeyValue{Key: key, Value: value})
+	}//for
+	return kvs
+}
+
+//crack模式下单个连接的tracing状态
+//每读取一个请求开始一个span,后端返回下一块数据时认为响应已经开始并结束最早的span
+//pipeline发送的请求无法准确对应响应,只是近似
+type crackTracing struct {
+	tracer *Tracer
+	listener string
+	client string
+
+	mu sync.Mutex
+	//最近读取的请求的span,用于注入traceparent
+	current *Span
+	//等待响应的span和请求交给后端的时间
+	pending []pendingSpan
+}
+
+type pendingSpan struct {
+	span *Span
+	forwarded time.Time
+}
+
+func newCrackTracing(p *Proxy, client string) *crackTracing{
+	if !p.tracer.enabled(){
+		return nil
+	}
+	return &crackTracing{tracer: p.tracer, listener: p.label(), client: client}
+}
+
+//为request开始span,使用request中原始的traceparent
+func (c *crackTracing) startSpan(request *Request, start time.Time){
+	if c == nil{
+		return
+	}
+
+	span := c.tracer.StartSpan("HTTP " + request.Method, request.Header("traceparent"), request.Header("tracestate"), start)
+	span.Attributes["http.method"] = request.Method
+	span.Attributes["http.target"] = request.URI
+	span.Attributes["http.host"] = request.Header("Host")
+	span.Attributes["http.flavor"] = strings.TrimPrefix(request.Version, "HTTP/")
+	span.Attributes["client.address"] = c.client
+	span.Attributes["vhost.listener"] = c.listener
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.current = span
+	c.pending = append(c.pending, pendingSpan{span: span, forwarded: time.Now()})
+}
+
+//在重写后的请求中写入当前span的traceparent
+func (c *crackTracing) inject(request *Request){
+	if c == nil{
+		return
+	}
+
+	c.mu.Lock()
+	span := c.current
+	c.mu.Unlock()
+
+	if span == nil{
+		return
+	}
+	request.SetHeader("traceparent", span.traceparent())
+	if span.TraceState != ""{
+		request.SetHeader("tracestate", span.TraceState)
+	}
+}
+
+//记录第一个请求的路由结果和连接后端的耗时,失败时结束span
+func (c *crackTracing) dialed(backend string, elapsed time.Duration, err error){
+	if c == nil{
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.pending) == 0{
+		return
+	}
+	last := &c.pending[len(c.pending) - 1]
+
+	if err != nil{
+		last.span.AddEvent("dial", map[string]interface{}{"dial.duration_ms": durationMs(elapsed), "error": err.Error()})
+		last.span.SetError(err)
+		last.span.Finish()
+		c.pending = c.pending[: len(c.pending) - 1]
+		return
+	}
+
+	last.span.AddEvent("route", map[string]interface{}{"backend": backend})
+	last.span.AddEvent("dial", map[string]interface{}{"dial.duration_ms": durationMs(elapsed)})
+	last.span.SetAttribute("vhost.backend", backend)
+	last.forwarded = time.Now()
+}
+
+//请求被middleware短路或者失败,不会再有后端的响应
+func (c *crackTracing) answered(status int){
+	if c == nil{
+		return
+	}
+
+	c.mu.Lock()
+	if len(c.pending) == 0{
+		c.mu.Unlock()
+		return
+	}
+	last := c.pending[len(c.pending) - 1]
+	c.pending = c.pending[: len(c.pending) - 1]
+	c.mu.Unlock()
+
+	last.span.SetAttribute("http.status_code", status)
+	last.span.AddEvent("answered by middleware", nil)
+	last.span.Finish()
+}
+
+//后端返回了数据,data为读取到的第一块数据
+func (c *crackTracing) responded(data []byte){
+	c.mu.Lock()
+	if len(c.pending) == 0{
+		c.mu.Unlock()
+		return
+	}
+	oldest := c.pending[0]
+	c.pending = c.pending[1: ]
+	c.mu.Unlock()
+
+	attributes := map[string]interface{}{"upstream.duration_ms": durationMs(time.Since(oldest.forwarded))}
+	if end := bytes.Index(data, []byte("\r\n")); end > 0{
+		if _, status, _, ok := parseStatusLine(string(data[: end])); ok{
+			oldest.span.SetAttribute("http.status_code", status)
+			if status >= 500{
+				oldest.span.SetError(fmt.Errorf("upstream returns %d", status))
+			}
+		}
+	}
+
+	oldest.span.AddEvent("response", attributes)
+	oldest.span.Finish()
+}
+
+//是否有等待响应的span
+func (c *crackTracing) waiting() bool{
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.pending) > 0
+}
+
+//连接结束,还在等待响应的span以错误结束
+func (c *crackTracing) close(){
+	c.mu.Lock()
+	pending := c.pending
+	c.pending = nil
+	c.mu.Unlock()
+
+	for _, p := range pending{
+		p.span.SetError(errNoResponse)
+		p.span.Finish()
+	}
+}
+
+var errNoResponse = errors.New("connection closed before response")
+
+func durationMs(d time.Duration) float64{
+	return float64(d) / float64(time.Millisecond)
+}
+
+//crack模式下开启tracing时的后端连接,读取时通知crackTracing响应已经开始
+//不是bufferedConn,转发后端的数据时不会使用splice
+type tracedConn struct {
+	net.Conn
+	tracing *crackTracing
+	closeOnce sync.Once
+}
+
+func (c *tracedConn) Read(p []byte) (int, error){
+	n, err := c.Conn.Read(p)
+	if n > 0{
+		c.tracing.responded(p[: n])
+	}
+	return n, err
+}
+
+func (c *tracedConn) Close() error{
+	c.closeOnce.Do(c.tracing.close)
+	return c.Conn.Close()
+}
+
+func (c *tracedConn) innerConn() net.Conn{
+	return c.Conn
+}
+
+//内部的连接不再解析响应,并且没有等待响应的span时不再需要通过tracedConn读取
+func (c *tracedConn) tracking() bool{
+	if tc, ok := c.Conn.(trackingConn); !ok || tc.tracking(){
+		return true
+	}
+	return c.tracing.waiting()
+}
+
+func (c *tracedConn) CloseWrite() error{
+	return closeWrite(c.Conn)
+}
@@ -0,0 +1,162 @@
+package go_virtual_host
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	traceID, parentID, sampled, ok := parseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if !ok || !sampled || traceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" || parentID.String() != "00f067aa0ba902b7"{
+		t.Fatalf("unexpected result %s %s %v %v", traceID, parentID, sampled, ok)
+	}
+
+	invalid := []string{
+		"",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01",
+	}
+	for _, value := range invalid{
+		if _, _, _, ok = parseTraceparent(value); ok{
+			t.Fatalf("expect %q to be invalid", value)
+		}
+	}//for
+
+	//更高的版本可以在后面增加字段
+	if _, _, sampled, ok = parseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-extra"); !ok || sampled{
+		t.Fatalf("expect future version accepted and not sampled")
+	}
+}
+
+//返回请求中的traceparent和tracestate
+func startTraceBackend(t *testing.T) net.Listener{
+	return startHttpBackend(t, func(conn net.Conn, tr *TextReader, request *Request) bool {
+		writeOK(conn, request.Header("traceparent") + " " + request.Header("tracestate"))
+		return true
+	})
+}
+
+func TestCrackTracing(t *testing.T) {
+	backend := startTraceBackend(t)
+	defer backend.Close()
+
+	exporter := &InMemoryExporter{}
+	tracer := NewTracer(exporter)
+
+	getProxy := func(request *Request) (net.Conn, error){
+		return net.Dial("tcp", backend.Addr().String())
+	}
+	proxy := NewCrackProxy("127.0.0.1:0", getProxy, nil, WithTracer(tracer)).(*Proxy)
+	defer proxy.Close()
+	proxy.AsyncStart()
+
+	conn, err := net.Dial("tcp", proxy.Addr().String())
+	if err != nil{
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	tr := NewTextReader(conn)
+	_, first := roundTrip(t, conn, tr, "GET /a HTTP/1.1\r\nHost: example.com\r\n" +
+		"traceparent: 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01\r\ntracestate: congo=t61rcWkgMzE\r\n\r\n")
+	_, second := roundTrip(t, conn, tr, "GET /b HTTP/1.1\r\nHost: example.com\r\n\r\n")
+
+	tracer.Flush()
+	spans := exporter.Spans()
+	if len(spans) != 2{
+		t.Fatalf("expect 2 spans, got %d", len(spans))
+	}
+
+	//第一个请求继续原来的trace
+	s := spans[0]
+	if s.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" || s.ParentSpanID.String() != "00f067aa0ba902b7" || s.TraceState != "congo=t61rcWkgMzE"{
+		t.Fatalf("unexpected span %+v", s)
+	}
+	if expect := s.traceparent() + " congo=t61rcWkgMzE"; first != expect{
+		t.Fatalf("expect backend got %q, got %q", expect, first)
+	}
+	if s.Attributes["http.status_code"] != 200 || s.Attributes["http.target"] != "/a" || s.Attributes["vhost.backend"] != backend.Addr().String(){
+		t.Fatalf("unexpected attributes %v", s.Attributes)
+	}
+
+	var events []string
+	for _, e := range s.Events{
+		events = append(events, e.Name)
+	}
+	if fmt.Sprint(events) != "[route dial response]"{
+		t.Fatalf("unexpected events %v", events)
+	}
+
+	//第二个请求开始新的trace
+	s = spans[1]
+	if s.TraceID.String() == "4bf92f3577b34da6a3ce929d0e0e4736" || !s.ParentSpanID.isZero() || s.Attributes["http.target"] != "/b"{
+		t.Fatalf("unexpected span %+v", s)
+	}
+	if second != s.traceparent() + " "{
+		t.Fatalf("unexpected traceparent %q", second)
+	}
+	if len(s.Events) != 1 || s.Events[0].Attributes["upstream.duration_ms"] == nil{
+		t.Fatalf("unexpected events %+v", s.Events)
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	bodies := make(chan []byte, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/json" || r.Header.Get("Authorization") != "token"{
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies <- body
+	}))
+	defer server.Close()
+
+	tracer := NewTracer(NewOTLPExporter(server.URL, "test", map[string]string{"Authorization": "token"}))
+	span := tracer.StartSpan("HTTP GET", "", "", time.Unix(1, 0))
+	span.SetAttribute("http.status_code", 502)
+	span.AddEvent("dial", map[string]interface{}{"dial.duration_ms": 1.5})
+	span.SetError(fmt.Errorf("bad gateway"))
+	span.Finish()
+	tracer.Flush()
+
+	var request struct{
+		ResourceSpans []struct{
+			Resource struct{
+				Attributes []otlpKeyValue
+			}
+			ScopeSpans []struct{
+				Spans []otlpSpan
+			}
+		}
+	}
+	if err := json.Unmarshal(<-bodies, &request); err != nil{
+		t.Fatal(err)
+	}
+
+	if v := request.ResourceSpans[0].Resource.Attributes[0]; v.Key != "service.name" || v.Value["stringValue"] != "test"{
+		t.Fatalf("unexpected resource %+v", v)
+	}
+
+	s := request.ResourceSpans[0].ScopeSpans[0].Spans[0]
+	if s.TraceID != span.TraceID.String() || s.SpanID != span.SpanID.String() || s.ParentSpanID != "" ||
+		s.StartTimeUnixNano != "1000000000" || s.Kind != otlpSpanKindServer{
+		t.Fatalf("unexpected span %+v", s)
+	}
+	if s.Attributes[0].Value["intValue"] != "502" || s.Events[0].Attributes[0].Value["doubleValue"] != 1.5{
+		t.Fatalf("unexpected attributes %+v %+v", s.Attributes, s.Events)
+	}
+	if s.Status["message"] != "bad gateway"{
+		t.Fatalf("unexpected status %+v", s.Status)
+	}
+}
@@ -0,0 +1,286 @@
+package go_virtual_host
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"sync"
+)
+
+//请求要求升级的协议,例如websocket、h2c,不是升级请求时为空
+func (r *Request) UpgradeProtocol() string{
+	if !headerHasToken(r.Header("Connection"), "upgrade"){
+		return ""
+	}
+	return strings.ToLower(strings.TrimSpace(r.Header("Upgrade")))
+}
+
+func (r *Request) IsWebSocket() bool{
+	return r.UpgradeProtocol() == "websocket"
+}
+
+//crack模式下后端返回101之后调用,之后连接上的数据原样转发
+//request为转发到后端的升级请求,protocol为UpgradeProtocol
+type UpgradeHook func(ctx *ConnContext, request *Request, protocol string)
+
+func WithUpgradeHook(hook UpgradeHook) Option{
+	return func(p *Proxy) {
+		p.upgradeHook = hook
+	}
+}
+
+//后端响应的解析状态
+const (
+	trackHead = iota
+	trackBody
+	trackChunkSize
+	trackChunkData
+	trackTrailer
+	//升级成功、响应直到连接关闭或者无法解析,不再解析之后的数据
+	trackStopped
+)
+
+//响应头的最大字节数,超过时不再解析
+const maxTrackedHeadBytes = 64 << 10
+
+//crack模式下客户端和后端两个方向共享的升级状态
+//HttpCrack转发升级请求之后停止解析请求,等到后端返回升级请求的响应:
+//101时之后客户端的数据原样转发,否则继续按HTTP/1解析
+type crackUpgrade struct {
+	mu sync.Mutex
+	//已经转发、还没有收到响应的请求
+	pending []trackedRequest
+
+	//升级请求的结果,true表示后端返回了101
+	result chan bool
+	//后端连接关闭或者不再解析响应
+	done chan struct{}
+	doneOnce sync.Once
+
+	//以下只在读取后端连接时使用
+	state int
+	head []byte
+	line []byte
+	remain int64
+}
+
+type trackedRequest struct {
+	method string
+	upgrade bool
+}
+
+func newCrackUpgrade() *crackUpgrade{
+	return &crackUpgrade{result: make(chan bool, 1), done: make(chan struct{})}
+}
+
+//记录转发到后端的请求
+func (u *crackUpgrade) forwarded(request *Request){
+	if u == nil{
+		return
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.pending = append(u.pending, trackedRequest{method: request.Method, upgrade: request.UpgradeProtocol() != ""})
+}
+
+//等待升级请求的结果,没有后端的状态时认为升级成功
+func (u *crackUpgrade) wait() bool{
+	if u == nil{
+		return true
+	}
+
+	select {
+	case ok := <-u.result:
+		return ok
+	case <-u.done:
+	}
+
+	//后端返回101之后立即关闭连接时result和done同时就绪
+	select {
+	case ok := <-u.result:
+		return ok
+	default:
+		return false
+	}
+}
+
+func (u *crackUpgrade) stop(){
+	u.state = trackStopped
+	u.doneOnce.Do(func() {
+		close(u.done)
+	})
+}
+
+//解析后端返回的数据,只用于找到每个响应的边界
+func (u *crackUpgrade) received(data []byte){
+	for len(data) > 0 && u.state != trackStopped{
+		switch u.state {
+		case trackBody, trackChunkData:
+			n := int64(len(data))
+			if n > u.remain{
+				n = u.remain
+			}
+			u.remain -= n
+			data = data[n: ]
+
+			if u.remain == 0{
+				if u.state == trackBody{
+					u.state = trackHead
+				}else{
+					u.state = trackChunkSize
+				}
+			}
+
+		default:
+			var (
+				line []byte
+				ok bool
+			)
+			if line, data, ok = u.readLine(data); !ok{
+				continue
+			}
+			u.receivedLine(line)
+		}
+	}//for
+}
+
+//读取一行,不完整时先缓存起来
+func (u *crackUpgrade) readLine(data []byte) (line []byte, rest []byte, ok bool){
+	i := bytes.IndexByte(data, '\n')
+	if i < 0{
+		u.line = append(u.line, data...)
+		if len(u.line) + len(u.head) > maxTrackedHeadBytes{
+			u.stop()
+		}
+		return nil, nil, false
+	}
+
+	line = append(u.line, data[: i + 1]...)
+	u.line = nil
+	return line, data[i + 1: ], true
+}
+
+func (u *crackUpgrade) receivedLine(line []byte){
+	empty := len(bytes.TrimRight(line, "\r\n")) == 0
+
+	switch u.state {
+	case trackHead:
+		//响应之间多余的空行
+		if empty && len(u.head) == 0{
+			return
+		}
+		u.head = append(u.head, line...)
+		if len(u.head) > maxTrackedHeadBytes{
+			u.stop()
+			return
+		}
+		if empty{
+			head := u.head
+			u.head = nil
+			u.responseHead(head)
+		}
+
+	case trackChunkSize:
+		size, err := parseChunkSize(strings.TrimRight(string(line), "\r\n"))
+		if err != nil{
+			u.stop()
+			return
+		}
+		if size == 0{
+			u.state = trackTrailer
+			return
+		}
+		//chunk数据以及结尾的\r\n
+		u.state, u.remain = trackChunkData, size + 2
+
+	case trackTrailer:
+		if empty{
+			u.state = trackHead
+		}
+	}
+}
+
+//收到一个完整的响应头
+func (u *crackUpgrade) responseHead(head []byte){
+	response, err := NewTextReader(bytes.NewReader(head)).ReadResponse()
+	if err != nil{
+		u.stop()
+		return
+	}
+
+	u.mu.Lock()
+	if len(u.pending) == 0{
+		u.mu.Unlock()
+		u.stop()
+		return
+	}
+	request := u.pending[0]
+	//101以外的1xx之后还有最终的响应
+	final := response.StatusCode == 101 || response.StatusCode < 100 || response.StatusCode >= 200
+	if final{
+		u.pending = u.pending[1: ]
+	}
+	u.mu.Unlock()
+
+	if response.StatusCode == 101{
+		if request.upgrade{
+			u.result <- true
+		}
+		u.stop()
+		return
+	}
+	if !final{
+		return
+	}
+	if request.upgrade{
+		u.result <- false
+	}
+
+	switch responseBodyKind(&Request{Method: request.method}, response) {
+	case bodyLength:
+		u.state, u.remain = trackBody, int64(response.ContentLength)
+	case bodyChunked:
+		u.state = trackChunkSize
+	case bodyUntilClose:
+		u.stop()
+	}
+}
+
+//crack模式下的后端连接,读取时解析响应找到升级请求的结果
+//不是bufferedConn,转发后端的数据时不会使用splice
+type upgradeConn struct {
+	net.Conn
+	upgrade *crackUpgrade
+}
+
+func (c *upgradeConn) Read(p []byte) (int, error){
+	n, err := c.Conn.Read(p)
+	if n > 0{
+		c.upgrade.received(p[: n])
+	}
+	if err != nil{
+		c.upgrade.stop()
+	}
+	return n, err
+}
+
+func (c *upgradeConn) Close() error{
+	c.upgrade.doneOnce.Do(func() {
+		close(c.upgrade.done)
+	})
+	return c.Conn.Close()
+}
+
+func (c *upgradeConn) innerConn() net.Conn{
+	return c.Conn
+}
+
+//升级成功或者不再解析响应之后可以直接读取内部的连接
+func (c *upgradeConn) tracking() bool{
+	return c.upgrade.state != trackStopped
+}
+
+func (c *upgradeConn) CloseWrite() error{
+	return closeWrite(c.Conn)
+}
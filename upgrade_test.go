@@ -0,0 +1,201 @@
+package go_virtual_host
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestUpgradeTracker(t *testing.T) {
+	u := newCrackUpgrade()
+	for _, method := range []string{"GET", "HEAD", "GET", "GET", "GET"}{
+		u.forwarded(&Request{Method: method})
+	}
+	upgrade := &Request{Method: "GET"}
+	upgrade.SetHeader("Connection", "keep-alive, Upgrade")
+	upgrade.SetHeader("Upgrade", "WebSocket")
+	u.forwarded(upgrade)
+
+	responses := "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello" +
+		//HEAD的响应没有body
+		"HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\n" +
+		"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n0\r\nX-T: 1\r\n\r\n" +
+		"HTTP/1.1 304 Not Modified\r\nContent-Length: 10\r\n\r\n" +
+		"HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 204 No Content\r\n\r\n" +
+		"HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\n\r\n\x81\x05hello"
+
+	//每次只收到3个字节
+	for i := 0; i < len(responses); i += 3{
+		end := i + 3
+		if end > len(responses){
+			end = len(responses)
+		}
+		u.received([]byte(responses[i: end]))
+	}//for
+
+	if !u.wait() || u.state != trackStopped || len(u.pending) != 0{
+		t.Fatalf("expect switched, state %d pending %v", u.state, u.pending)
+	}
+
+	//升级被拒绝
+	u = newCrackUpgrade()
+	u.forwarded(upgrade)
+	u.received([]byte("HTTP/1.1 400 Bad Request\r\nContent-Length: 0\r\n\r\n"))
+	if u.wait() || u.state != trackHead{
+		t.Fatalf("expect rejected, state %d", u.state)
+	}
+
+	//后端没有响应就关闭
+	u = newCrackUpgrade()
+	u.forwarded(upgrade)
+	u.stop()
+	if u.wait(){
+		t.Fatal("expect not switched")
+	}
+}
+
+//升级请求返回101之后原样回显,其他请求返回X-Crack和路径
+func startUpgradeBackend(t *testing.T) net.Listener{
+	return startHttpBackend(t, func(conn net.Conn, tr *TextReader, request *Request) bool {
+		switch {
+		case request.IsWebSocket() && request.Path() == "/ws":
+			_, _ = io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+			_, _ = io.Copy(conn, tr.br)
+			return false
+		case request.IsWebSocket():
+			_, _ = io.WriteString(conn, "HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\n\r\n")
+		default:
+			writeOK(conn, request.Header("X-Crack") + " " + request.URI)
+		}
+		return true
+	})
+}
+
+func TestCrackUpgrade(t *testing.T) {
+	backend := startUpgradeBackend(t)
+	defer backend.Close()
+
+	getProxy := func(request *Request) (net.Conn, error){
+		return net.Dial("tcp", backend.Addr().String())
+	}
+	upgraded := make(chan string, 1)
+	hook := func(ctx *ConnContext, request *Request, protocol string) {
+		upgraded <- fmt.Sprintf("%v %s %s", ctx.ClientAddr != nil, request.URI, protocol)
+	}
+
+	proxy := NewCrackProxy("127.0.0.1:0", getProxy, nil, WithUpgradeHook(hook),
+		WithMiddleware(SetHeaders(map[string]string{"X-Crack": "1"}))).(*Proxy)
+	defer proxy.Close()
+	proxy.AsyncStart()
+
+	conn, err := net.Dial("tcp", proxy.Addr().String())
+	if err != nil{
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	tr := NewTextReader(conn)
+
+	if _, body := roundTrip(t, conn, tr, "GET /a HTTP/1.1\r\nHost: a\r\n\r\n"); body != "1 /a"{
+		t.Fatalf("unexpected body %q", body)
+	}
+
+	//升级被拒绝之后继续按HTTP/1解析
+	ws := "Host: a\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n"
+	if response, _ := roundTrip(t, conn, tr, "GET /denied HTTP/1.1\r\n" + ws); response.StatusCode != 403{
+		t.Fatalf("expect 403, got %d", response.StatusCode)
+	}
+	if _, body := roundTrip(t, conn, tr, "GET /b HTTP/1.1\r\nHost: a\r\n\r\n"); body != "1 /b"{
+		t.Fatalf("unexpected body %q", body)
+	}
+
+	//升级之后的数据原样转发
+	if _, err = io.WriteString(conn, "GET /ws HTTP/1.1\r\n" + ws); err != nil{
+		t.Fatal(err)
+	}
+	if response, err := tr.ReadResponse(); err != nil || response.StatusCode != 101{
+		t.Fatalf("expect 101, got %v %v", response, err)
+	}
+	if info := <-upgraded; info != "true /ws websocket"{
+		t.Fatalf("unexpected upgrade hook %q", info)
+	}
+
+	frames := "\x81\x05hello GET /not-http HTTP/1.1\r\n\r\n\x00\xff"
+	if _, err = io.WriteString(conn, frames); err != nil{
+		t.Fatal(err)
+	}
+	echo, err := tr.ReadUntilN(len(frames))
+	if err != nil || string(echo) != frames{
+		t.Fatalf("expect raw echo, got %q %v", echo, err)
+	}
+}
+
+func TestWebSocketRoute(t *testing.T) {
+	table := NewRouteTable()
+	for _, route := range []*Route{
+		{PathPrefix: "/chat", Backend: "web"},
+		{PathPrefix: "/chat", WebSocket: true, Backend: "ws"},
+		{PathPrefix: "/chat", Methods: []string{"POST"}, Backend: "post"},
+	}{
+		if err := table.Add(route); err != nil{
+			t.Fatal(err)
+		}
+	}
+
+	request := &Request{Method: "GET", URI: "/chat/room"}
+	if route, _ := table.Match(request); route.Backend != "web"{
+		t.Fatalf("expect web, got %s", route.Backend)
+	}
+
+	request.Method = "POST"
+	if route, _ := table.Match(request); route.Backend != "post"{
+		t.Fatalf("expect post, got %s", route.Backend)
+	}
+
+	//更具体的路由优先,和添加的顺序无关
+	request.Method = "GET"
+	request.SetHeader("Connection", "Upgrade")
+	request.SetHeader("Upgrade", "websocket")
+	if route, _ := table.Match(request); route.Backend != "ws"{
+		t.Fatalf("expect ws, got %s", route.Backend)
+	}
+}
+
+func TestKeepAliveUpgrade(t *testing.T) {
+	backend := startUpgradeBackend(t)
+	defer backend.Close()
+
+	route := func(request *Request) (string, error){
+		return backend.Addr().String(), nil
+	}
+	proxy := NewKeepAliveProxy("127.0.0.1:0", route, nil, nil).(*Proxy)
+	defer proxy.Close()
+	proxy.AsyncStart()
+
+	conn, err := net.Dial("tcp", proxy.Addr().String())
+	if err != nil{
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	tr := NewTextReader(conn)
+
+	if _, body := roundTrip(t, conn, tr, "GET /a HTTP/1.1\r\nHost: a\r\n\r\n"); body != " /a"{
+		t.Fatalf("unexpected body %q", body)
+	}
+
+	//101之后的数据不再按HTTP/1解析
+	frames := "\x81\x05hello GET /not-http HTTP/1.1\r\n\r\n\x00\xff"
+	if _, err = io.WriteString(conn, "GET /ws HTTP/1.1\r\nHost: a\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n" + frames); err != nil{
+		t.Fatal(err)
+	}
+	if response, err := tr.ReadResponse(); err != nil || response.StatusCode != 101{
+		t.Fatalf("expect 101, got %v %v", response, err)
+	}
+	echo, err := tr.ReadUntilN(len(frames))
+	if err != nil || string(echo) != frames{
+		t.Fatalf("expect raw echo, got %q %v", echo, err)
+	}
+}